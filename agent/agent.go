@@ -2,49 +2,61 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/mitre/gocat/config"
 	"github.com/mitre/gocat/contact"
 	"github.com/mitre/gocat/encoders"
 	"github.com/mitre/gocat/execute"
 	"github.com/mitre/gocat/output"
 	"github.com/mitre/gocat/privdetect"
+	"github.com/mitre/gocat/protocol"
 	"github.com/mitre/gocat/proxy"
 )
 
 var beaconFailureThreshold = 3
 
 type AgentInterface interface {
-	Beacon() map[string]interface{}
+	Beacon() *protocol.Beacon
 	Initialize(server string, group string, c2Config map[string]string, enableLocalP2pReceivers bool) error
-	RunInstruction(instruction map[string]interface{}, submitResults bool)
+	RunInstruction(instruction protocol.Instruction, submitResults bool)
+	ScheduleInstruction(instruction protocol.Instruction)
+	SetKillDate(killDate time.Time)
+	CancelInstructions(ids []string)
+	CancelAllInstructions()
+	ReportRejectedInstruction(rejected *protocol.InstructionError)
 	Terminate()
-	GetFullProfile() map[string]interface{}
-	GetTrimmedProfile() map[string]interface{}
+	GetFullProfile() protocol.Profile
+	GetTrimmedProfile() protocol.Profile
 	SetCommunicationChannels(c2Config map[string]string) error
 	SetPaw(paw string)
 	Display()
-	DownloadPayloadsForInstruction(instruction map[string]interface{}) ([]string, map[string][]byte)
+	DownloadPayloadsForInstruction(instruction protocol.Instruction) ([]string, map[string][]byte)
 	FetchPayloadBytes(payload string) []byte
 	ActivateLocalP2pReceivers()
 	TerminateLocalP2pReceivers()
 	HandleBeaconFailure() error
 	DiscoverPeers()
 	AttemptSelectComChannel(requestedChannelConfig map[string]string, requestedChannel string) error
+	ProcessContactChange(c2Config map[string]string, requestedChannel string) error
 	GetCurrentContactName() string
-	UploadFiles(instruction map[string]interface{})
-	ProcessExecutorChange(executorChange map[string]interface{}) error
+	UploadFiles(instruction protocol.Instruction)
+	ProcessExecutorChange(executorChange protocol.ExecutorChange) error
+	ProcessEncoderChange(c2Config map[string]string, beaconEncoders []string, fileEncoders []string) error
+	ProcessClientCertificate(c2Config map[string]string, clientCert protocol.ClientCertificate) error
+	ProcessP2pKey(key string)
+	AttemptFailback() *protocol.Beacon
 }
 
 // Implements AgentInterface
@@ -69,11 +81,18 @@ type Agent struct {
 	availableDataEncoders []string
 
 	// Communication methods
+	servers             []config.Server // C2 servers in order of preference
+	serverIndex         int             // index of the C2 server in use, or last used if the agent is using a peer
+	lastFailbackAttempt time.Time
+	c2Config            map[string]string
+	channelMu           sync.RWMutex // held for writing while the channel to C2 changes, and for reading while jobs look it up
 	beaconContact       contact.Contact
+	peerRelay           contact.Contact // relays the messages of local peer-to-peer receivers through beaconContact
 	failedBeaconCounter int
 	upstreamDestAddr    string // address of server/peer that agent uses to contact C2
 	tunnel              contact.Tunnel
 	usingTunnel         bool
+	clientCertIdentity  string // subject of the TLS client certificate used by the current contact, if any
 
 	// peer-to-peer info
 	enableLocalP2pReceivers   bool
@@ -83,13 +102,17 @@ type Agent struct {
 	availablePeerReceivers    map[string][]string          // maps P2P protocol to receiver addresses running on peer machines
 	exhaustedPeerReceivers    map[string][]string          // maps P2P protocol to receiver addresses that the agent has tried using.
 	usingPeerReceivers        bool                         // True if connecting to C2 via proxy peer
+	peerRoute                 *proxy.RouteInfo             // route to C2 advertised by the upstream peer, if known
 
-	// Deadman instructions to run before termination. Will be list of instruction mappings.
-	deadmanInstructions []map[string]interface{}
+	// Deadman instructions to run before termination.
+	deadmanInstructions []protocol.Instruction
+
+	// Runs instructions received from C2.
+	jobs *jobScheduler
 }
 
 // Set up agent variables.
-func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, group string, c2Config map[string]string, enableLocalP2pReceivers bool, initialDelay int, paw string, originLinkID string) error {
+func (a *Agent) Initialize(servers []config.Server, tunnelConfig *contact.TunnelConfig, group string, c2Config map[string]string, peers map[string][]string, enableLocalP2pReceivers bool, initialDelay int, paw string, originLinkID string, maxJobs int, jobQueueSize int) error {
 	host, err := os.Hostname()
 	if err != nil {
 		return err
@@ -99,8 +122,15 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	} else {
 		return err
 	}
-	a.server = server
-	a.upstreamDestAddr = server
+	if len(servers) == 0 {
+		return errors.New("No C2 server configured.")
+	}
+	a.servers = servers
+	a.serverIndex = 0
+	a.server = servers[0].Address
+	a.upstreamDestAddr = servers[0].Address
+	a.c2Config = c2Config
+	a.peerRelay = &channelContact{agent: a}
 	a.tunnelConfig = tunnelConfig
 	a.tunnel = nil
 	a.group = group
@@ -116,6 +146,9 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	a.failedBeaconCounter = 0
 	a.originLinkID = originLinkID
 	a.availableDataEncoders = encoders.GetAvailableDataEncoders()
+	a.jobs = newJobScheduler(maxJobs, jobQueueSize, func(ctx context.Context, instruction protocol.Instruction) {
+		a.runInstruction(ctx, instruction, true)
+	}, a.reportDroppedInstruction)
 
 	a.hostIPAddrs, err = proxy.GetLocalIPv4Addresses()
 	if err != nil {
@@ -130,10 +163,13 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	// Load peer proxy receiver information
 	a.exhaustedPeerReceivers = make(map[string][]string)
 	a.usingPeerReceivers = false
-	a.availablePeerReceivers, err = proxy.GetAvailablePeerReceivers()
-	a.availablePeerReceivers[c2Config["c2Name"]] = append(a.availablePeerReceivers[c2Config["c2Name"]], server)
-	if err != nil {
-		return err
+	a.availablePeerReceivers = make(map[string][]string)
+	for proxyChannel, addresses := range peers {
+		a.availablePeerReceivers[proxyChannel] = append([]string(nil), addresses...)
+	}
+	for _, server := range servers {
+		serverChannel := server.ApplyTo(c2Config)["c2Name"]
+		a.availablePeerReceivers[serverChannel] = append(a.availablePeerReceivers[serverChannel], server.Address)
 	}
 	a.DiscoverPeers()
 
@@ -146,7 +182,7 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 	}
 
 	// Set up contacts
-	if err = a.SetCommunicationChannels(c2Config); err != nil {
+	if err = a.SetCommunicationChannels(servers[0].ApplyTo(c2Config)); err != nil {
 		return err
 	}
 
@@ -162,86 +198,95 @@ func (a *Agent) Initialize(server string, tunnelConfig *contact.TunnelConfig, gr
 }
 
 // Returns full profile for agent.
-func (a *Agent) GetFullProfile() map[string]interface{} {
-	return map[string]interface{}{
-		"paw":                a.paw,
-		"server":             a.server,
-		"group":              a.group,
-		"host":               a.host,
-		"contact":            a.GetCurrentContactName(),
-		"username":           a.username,
-		"architecture":       a.architecture,
-		"platform":           a.platform,
-		"location":           a.location,
-		"pid":                a.pid,
-		"ppid":               a.ppid,
-		"executors":          execute.AvailableExecutors(),
-		"privilege":          a.privilege,
-		"exe_name":           a.exe_name,
-		"proxy_receivers":    a.localP2pReceiverAddresses,
-		"origin_link_id":     a.originLinkID,
-		"deadman_enabled":    true,
-		"available_contacts": contact.GetAvailableCommChannels(),
-		"host_ip_addrs":      a.hostIPAddrs,
-		"upstream_dest":      a.upstreamDestAddr,
+func (a *Agent) GetFullProfile() protocol.Profile {
+	return protocol.Profile{
+		Paw:               a.paw,
+		Server:            a.server,
+		Group:             a.group,
+		Host:              a.host,
+		Contact:           a.GetCurrentContactName(),
+		Username:          a.username,
+		Architecture:      a.architecture,
+		Platform:          a.platform,
+		Location:          a.location,
+		Pid:               a.pid,
+		Ppid:              a.ppid,
+		Executors:         execute.AvailableExecutors(),
+		Privilege:         a.privilege,
+		ExeName:           a.exe_name,
+		ProxyReceivers:    a.localP2pReceiverAddresses,
+		OriginLinkID:      a.originLinkID,
+		DeadmanEnabled:    true,
+		AvailableContacts: contact.GetAvailableCommChannels(),
+		AvailableEncoders: a.availableDataEncoders,
+		HostIPAddrs:       a.hostIPAddrs,
+		UpstreamDest:      a.upstreamDestAddr,
+		ClientCertID:      a.clientCertIdentity,
+		RunningLinks:      a.jobs.list(),
 	}
 }
 
 // Return minimal subset of agent profile.
-func (a *Agent) GetTrimmedProfile() map[string]interface{} {
-	return map[string]interface{}{
-		"paw":           a.paw,
-		"server":        a.server,
-		"platform":      a.platform,
-		"host":          a.host,
-		"contact":       a.GetCurrentContactName(),
-		"upstream_dest": a.upstreamDestAddr,
-	}
+func (a *Agent) GetTrimmedProfile() protocol.Profile {
+	return a.GetFullProfile().Trimmed()
 }
 
-// Pings C2 for instructions and returns them.
-func (a *Agent) Beacon() map[string]interface{} {
-	var beacon map[string]interface{}
+// Pings C2 for instructions and returns them. Returns nil if the beacon failed or was malformed.
+func (a *Agent) Beacon() *protocol.Beacon {
 	profile := a.GetFullProfile()
 	response := a.beaconContact.GetBeaconBytes(profile)
+	a.updateLocalRoute(response != nil)
 	if response != nil {
-		beacon = a.processBeacon(response)
-	} else {
-		output.VerbosePrint("[-] beacon: DEAD")
+		return a.processBeacon(response)
 	}
-	return beacon
+	output.VerbosePrint("[-] beacon: DEAD")
+	return nil
 }
 
 // Converts the given data into a beacon with instructions.
-func (a *Agent) processBeacon(data []byte) map[string]interface{} {
-	var beacon map[string]interface{}
-	if err := json.Unmarshal(data, &beacon); err != nil {
+func (a *Agent) processBeacon(data []byte) *protocol.Beacon {
+	beacon, err := protocol.ParseBeacon(data)
+	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Malformed beacon received: %s", err.Error()))
-	} else {
-		var commands interface{}
-		if err := json.Unmarshal([]byte(beacon["instructions"].(string)), &commands); err != nil {
-			output.VerbosePrint(fmt.Sprintf("[-] Malformed beacon instructions received: %s", err.Error()))
-		} else {
-			output.VerbosePrint(fmt.Sprintf("[+] Beacon (%s): ALIVE", a.GetCurrentContactName()))
-			beacon["sleep"] = int(beacon["sleep"].(float64))
-			beacon["watchdog"] = int(beacon["watchdog"].(float64))
-			beacon["instructions"] = commands
-		}
+		return nil
 	}
+	output.VerbosePrint(fmt.Sprintf("[+] Beacon (%s): ALIVE", a.GetCurrentContactName()))
 	return beacon
 }
 
 // If too many consecutive failures occur for the current communication method, switch to a new proxy method.
-// Return an error if switch fails.
+// Return an error if switch fails. The upstream peer's route is probed before the channel is locked, so that jobs and
+// peers are not held up by it.
 func (a *Agent) HandleBeaconFailure() error {
 	a.failedBeaconCounter += 1
 	if a.failedBeaconCounter >= beaconFailureThreshold {
-		// Reset counter and try switching proxy methods
+		a.channelMu.Lock()
+		defer a.channelMu.Unlock()
+		// Reset counter and try the next C2 server, then switching proxy methods
 		a.failedBeaconCounter = 0
+		a.lastFailbackAttempt = time.Now()
+		if !a.usingPeerReceivers {
+			if err := a.failoverToNextServer(); err == nil {
+				return nil
+			}
+		}
 		output.VerbosePrint("[!] Reached beacon failure threshold. Attempting to switch to new peer proxy method.")
 		a.usingTunnel = false
 		return a.findAvailablePeerProxyClient()
 	}
+	route, lost := a.probeUpstreamPeerRoute()
+	if !lost && route == nil {
+		return nil
+	}
+	a.channelMu.Lock()
+	defer a.channelMu.Unlock()
+	if lost {
+		// No point waiting for the threshold if the upstream peer cannot reach C2 either.
+		a.failedBeaconCounter = 0
+		output.VerbosePrint("[!] Upstream peer lost its route to C2. Attempting to switch to new peer proxy method.")
+		return a.findAvailablePeerProxyClient()
+	}
+	a.peerRoute = route
 	return nil
 }
 
@@ -252,6 +297,9 @@ func (a *Agent) Terminate() {
 		a.TerminateLocalP2pReceivers()
 	}
 
+	// Let running instructions finish, or kill them, before the deadman instructions run.
+	a.jobs.stop(jobStopGracePeriod)
+
 	// Run deadman instructions prior to termination
 	a.ExecuteDeadmanInstructions()
 	output.VerbosePrint("[*] Terminating Sandcat Agent... goodbye.")
@@ -259,22 +307,146 @@ func (a *Agent) Terminate() {
 
 // Runs a single instruction and send results if specified.
 // Will handle payload downloads according to executor.
-func (a *Agent) RunInstruction(instruction map[string]interface{}, submitResults bool) {
-	result := a.runInstructionCommand(instruction)
+func (a *Agent) RunInstruction(instruction protocol.Instruction, submitResults bool) {
+	a.runInstruction(context.Background(), instruction, submitResults)
+}
+
+// Queues an instruction to run once a worker is available, and submits its results. Instructions that cannot be
+// queued are reported back to C2 as errored, unless they are already queued or running and report their own results.
+func (a *Agent) ScheduleInstruction(instruction protocol.Instruction) {
+	err := a.jobs.submit(instruction)
+	if err == nil {
+		return
+	}
+	if err == errJobAlreadyScheduled {
+		output.VerbosePrint(fmt.Sprintf("[*] Instruction %s is already scheduled", instruction.ID))
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[-] Could not schedule instruction %s: %s", instruction.ID, err.Error()))
+	result := protocol.Result{
+		ID:                instruction.ID,
+		Output:            []byte(err.Error()),
+		Status:            execute.ERROR_STATUS,
+		Pid:               execute.ERROR_PID,
+		AgentReportedTime: getFormattedTimestamp(time.Now().UTC(), "2006-01-02T15:04:05Z"),
+	}
+	a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+		coms.SendExecutionResults(profile.Trimmed(), result)
+	})
+}
+
+// Reports an instruction that was still queued when the agent terminated back to C2 as cancelled, so that it does not
+// remain pending on the server.
+func (a *Agent) reportDroppedInstruction(instruction protocol.Instruction) {
+	result := protocol.Result{
+		ID:                instruction.ID,
+		Output:            []byte("Instruction cancelled: agent is terminating"),
+		Status:            execute.CANCELLED_STATUS,
+		Pid:               execute.ERROR_PID,
+		AgentReportedTime: getFormattedTimestamp(time.Now().UTC(), "2006-01-02T15:04:05Z"),
+	}
+	a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+		coms.SendExecutionResults(profile.Trimmed(), result)
+	})
+}
+
+// Stops the agent from starting instructions other than deadman instructions once the kill date passes.
+func (a *Agent) SetKillDate(killDate time.Time) {
+	a.jobs.setKillDate(killDate)
+}
+
+// Cancels the queued or running instructions with the given IDs, killing their processes. The cancelled
+// instructions report their results with a cancelled status.
+func (a *Agent) CancelInstructions(ids []string) {
+	for _, id := range ids {
+		if a.jobs.cancel(id) {
+			output.VerbosePrint(fmt.Sprintf("[*] Cancelling instruction %s", id))
+		} else {
+			output.VerbosePrint(fmt.Sprintf("[-] Cannot cancel instruction %s: not queued or running", id))
+		}
+	}
+}
+
+// Cancels all queued and running instructions, killing their processes.
+func (a *Agent) CancelAllInstructions() {
+	if cancelled := a.jobs.cancelAll(); cancelled > 0 {
+		output.VerbosePrint(fmt.Sprintf("[*] Cancelled %d instructions", cancelled))
+	}
+}
+
+func (a *Agent) runInstruction(ctx context.Context, instruction protocol.Instruction, submitResults bool) {
+	result := a.runInstructionCommand(ctx, instruction)
 	if submitResults {
-		output.VerbosePrint(fmt.Sprintf("[*] Submitting results for link %s via C2 channel %s", result["id"].(string), a.GetCurrentContactName()))
-		a.beaconContact.SendExecutionResults(a.GetTrimmedProfile(), result)
+		a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+			output.VerbosePrint(fmt.Sprintf("[*] Submitting results for link %s via C2 channel %s", result.ID, coms.GetName()))
+			coms.SendExecutionResults(profile.Trimmed(), result)
+		})
+	}
+	if result.Status == execute.OUT_OF_SCOPE_STATUS || result.Status == execute.CANCELLED_STATUS {
+		output.VerbosePrint(fmt.Sprintf("[!] Skipping file uploads for instruction %s: %s", result.ID, string(result.Output)))
+		return
 	}
 	a.UploadFiles(instruction)
 }
 
-func (a *Agent) runInstructionCommand(instruction map[string]interface{}) map[string]interface{} {
-	onDiskPayloads, inMemoryPayloads := a.DownloadPayloadsForInstruction(instruction)
+// Reports an instruction that failed validation back to C2 as an errored result, so that it does not
+// remain pending on the server. Instructions without a recoverable ID can only be logged.
+func (a *Agent) ReportRejectedInstruction(rejected *protocol.InstructionError) {
+	output.VerbosePrint(fmt.Sprintf("[-] Rejected %s", rejected.Error()))
+	if len(rejected.ID) == 0 {
+		return
+	}
+	result := protocol.Result{
+		ID:                rejected.ID,
+		Output:            []byte(rejected.Error()),
+		Status:            execute.ERROR_STATUS,
+		Pid:               execute.ERROR_PID,
+		AgentReportedTime: getFormattedTimestamp(time.Now().UTC(), "2006-01-02T15:04:05Z"),
+	}
+	a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+		coms.SendExecutionResults(profile.Trimmed(), result)
+	})
+}
+
+func (a *Agent) runInstructionCommand(ctx context.Context, instruction protocol.Instruction) protocol.Result {
+	// Only deadman instructions run after the kill date, as part of termination.
+	if !instruction.Deadman && a.jobs.killDateReached() {
+		return protocol.Result{
+			ID:                instruction.ID,
+			Output:            []byte("Instruction refused: kill date reached"),
+			Status:            execute.CANCELLED_STATUS,
+			Pid:               execute.ERROR_PID,
+			AgentReportedTime: getFormattedTimestamp(time.Now().UTC(), "2006-01-02T15:04:05Z"),
+		}
+	}
+	// Refuse instructions outside the engagement scope before their payloads are written.
+	if err := execute.CheckInstructionScope(instruction); err != nil {
+		return protocol.Result{
+			ID:                instruction.ID,
+			Output:            []byte(fmt.Sprintf("Instruction refused: %s", err.Error())),
+			Status:            execute.OUT_OF_SCOPE_STATUS,
+			Pid:               execute.ERROR_PID,
+			AgentReportedTime: getFormattedTimestamp(time.Now().UTC(), "2006-01-02T15:04:05Z"),
+		}
+	}
+	var onDiskPayloads []string
+	var inMemoryPayloads map[string][]byte
+	if ctx.Err() == nil {
+		onDiskPayloads, inMemoryPayloads = a.DownloadPayloadsForInstruction(instruction)
+	}
+	var profile protocol.Profile
+	a.useChannel(func(_ contact.Contact, fullProfile protocol.Profile) {
+		profile = fullProfile.Trimmed()
+	})
 	info := execute.InstructionInfo{
-		Profile:          a.GetTrimmedProfile(),
+		Profile:          profile,
 		Instruction:      instruction,
 		OnDiskPayloads:   onDiskPayloads,
 		InMemoryPayloads: inMemoryPayloads,
+		Context:          ctx,
+		ProcessStarted: func(pid int) {
+			a.jobs.setPid(instruction.ID, pid)
+		},
 	}
 
 	// Execute command
@@ -284,36 +456,31 @@ func (a *Agent) runInstructionCommand(instruction map[string]interface{}) map[st
 	a.removePayloadsOnDisk(onDiskPayloads)
 
 	// Handle results
-	result := make(map[string]interface{})
-	result["id"] = instruction["id"]
-	result["output"] = commandOutput
-	result["status"] = status
-	result["pid"] = pid
-	result["agent_reported_time"] = getFormattedTimestamp(commandTimestamp, "2006-01-02T15:04:05Z")
-	return result
-}
-
-func (a *Agent) UploadFiles(instruction map[string]interface{}) {
-	if instruction["uploads"] != nil && len(instruction["uploads"].([]interface{})) > 0 {
-		uploads, ok := instruction["uploads"].([]interface{})
-		if !ok {
-			output.VerbosePrint(fmt.Sprintf(
-				"[!] Error: expected []interface{}, but received %T for upload info",
-				instruction["uploads"],
-			))
-			return
-		}
+	return protocol.Result{
+		ID:                instruction.ID,
+		Output:            commandOutput,
+		Status:            status,
+		Pid:               pid,
+		AgentReportedTime: getFormattedTimestamp(commandTimestamp, "2006-01-02T15:04:05Z"),
+	}
+}
 
-		for _, path := range uploads {
-			filePath := path.(string)
-			if err := a.uploadSingleFile(filePath); err != nil {
-				output.VerbosePrint(fmt.Sprintf("[!] Error uploading file %s: %v", filePath, err.Error()))
-			}
+func (a *Agent) UploadFiles(instruction protocol.Instruction) {
+	for _, filePath := range instruction.Uploads {
+		if err := a.uploadSingleFile(filePath); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error uploading file %s: %v", filePath, err.Error()))
 		}
 	}
 }
 
+// Uploads the file unless the host or the path is outside the engagement scope, whatever the instruction's status.
 func (a *Agent) uploadSingleFile(path string) error {
+	if err := execute.CheckHostScope(); err != nil {
+		return err
+	}
+	if err := execute.CheckPathScope(path); err != nil {
+		return err
+	}
 	output.VerbosePrint(fmt.Sprintf("Uploading file: %s", path))
 
 	// Get file bytes
@@ -322,7 +489,10 @@ func (a *Agent) uploadSingleFile(path string) error {
 		return err
 	}
 
-	return a.beaconContact.UploadFileBytes(a.GetFullProfile(), filepath.Base(path), fetchedBytes)
+	a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+		err = coms.UploadFileBytes(profile, filepath.Base(path), fetchedBytes)
+	})
+	return err
 }
 
 func (a *Agent) removePayloadsOnDisk(payloads []string) {
@@ -362,9 +532,15 @@ func (a *Agent) AttemptSelectComChannel(requestedChannelConfig map[string]string
 	if !ok {
 		return errors.New(fmt.Sprintf("%s channel not available", requestedChannel))
 	}
+	return a.selectComChannel(requestedChannelConfig, requestedChannel, coms)
+}
+
+// Sets the given contact as the agent's communication channel if its requirements are met.
+func (a *Agent) selectComChannel(requestedChannelConfig map[string]string, requestedChannel string, coms contact.Contact) error {
 	coms.SetUpstreamDestAddr(a.upstreamDestAddr)
 	valid, config := coms.C2RequirementsMet(a.GetFullProfile(), requestedChannelConfig)
 	if valid {
+		a.clientCertIdentity = ""
 		if config != nil {
 			a.modifyAgentConfiguration(config)
 		}
@@ -406,15 +582,22 @@ func (a *Agent) displayLocalReceiverInformation() {
 			output.VerbosePrint(fmt.Sprintf("%s local proxy receiver available at %s", protocol, address))
 		}
 	}
+	for receiverName, receiver := range a.localP2pReceivers {
+		if reporter, ok := receiver.(proxy.PeerStatsReporter); ok {
+			for _, stats := range reporter.GetPeerStats() {
+				output.VerbosePrint(fmt.Sprintf("%s proxy receiver peer %s (paw %s): %d requests, %d rejected, %d errors, %d in flight, %d bytes in, %d bytes out",
+					receiverName, stats.Address, stats.Paw, stats.Requests, stats.Rejected, stats.Errors, stats.InFlight, stats.BytesIn, stats.BytesOut))
+			}
+		}
+	}
 }
 
 // Will download each individual payload listed for the given executor. The executor will determine
 // which payloads get written to disk, and which ones get saved in memory.
 // Returns list of payload names for the payloads written to disk, and a map of payload names linked to their
 // respective bytes for payloads saved in memory.
-func (a *Agent) DownloadPayloadsForInstruction(instruction map[string]interface{}) ([]string, map[string][]byte) {
-	payloads := instruction["payloads"].([]interface{})
-	executorName := instruction["executor"].(string)
+func (a *Agent) DownloadPayloadsForInstruction(instruction protocol.Instruction) ([]string, map[string][]byte) {
+	executorName := instruction.Executor
 	executor, ok := execute.Executors[executorName]
 	var onDiskPayloadNames []string
 	inMemoryPayloads := make(map[string][]byte)
@@ -422,9 +605,7 @@ func (a *Agent) DownloadPayloadsForInstruction(instruction map[string]interface{
 		output.VerbosePrint(fmt.Sprintf("[!] No executor found for executor name %s. Not downloading payloads.", executorName))
 		return onDiskPayloadNames, inMemoryPayloads
 	}
-	availablePayloads := reflect.ValueOf(payloads)
-	for i := 0; i < availablePayloads.Len(); i++ {
-		payloadName := availablePayloads.Index(i).Elem().String()
+	for _, payloadName := range instruction.Payloads {
 		payloadBytes, filename := a.FetchPayloadBytes(payloadName)
 		if len(payloadBytes) == 0 || len(filename) == 0 {
 			output.VerbosePrint(fmt.Sprintf("Failed to fetch payload bytes for payload %s", payloadName))
@@ -461,12 +642,44 @@ func (a *Agent) WritePayloadToDisk(filename string, payloadBytes []byte) (string
 
 // Will request payload bytes from the C2 for the specified payload and return them.
 func (a *Agent) FetchPayloadBytes(payload string) ([]byte, string) {
-	output.VerbosePrint(fmt.Sprintf("[*] Fetching new payload bytes via C2 channel %s: %s", a.GetCurrentContactName(), payload))
-	return a.beaconContact.GetPayloadBytes(a.GetTrimmedProfile(), payload)
+	var payloadBytes []byte
+	var filename string
+	a.useChannel(func(coms contact.Contact, profile protocol.Profile) {
+		output.VerbosePrint(fmt.Sprintf("[*] Fetching new payload bytes via C2 channel %s: %s", coms.GetName(), payload))
+		payloadBytes, filename = coms.GetPayloadBytes(profile.Trimmed(), payload)
+	})
+	return payloadBytes, filename
 }
 
 func (a *Agent) Sleep(sleepTime float64) {
-	time.Sleep(time.Duration(sleepTime) * time.Second)
+	time.Sleep(time.Duration(sleepTime * float64(time.Second)))
+}
+
+// Sleeps outside the beacon schedule. The connection that the current contact keeps open to the server is closed
+// first, so that the server cannot push beacons until the agent beacons again. Beacons the server pushed before are
+// left queued for the next sleep.
+func (a *Agent) SleepQuietly(sleepTime float64) {
+	contact.CloseConnection(a.getChannelContact())
+	a.Sleep(sleepTime)
+}
+
+// Sleeps until the next beacon is due. If the current contact supports server-pushed instructions, returns early
+// with the pushed beacon as soon as the server sends one. Returns nil if the full sleep time elapsed.
+func (a *Agent) SleepUntilNextBeacon(sleepTime float64) *protocol.Beacon {
+	pushContact, ok := a.beaconContact.(contact.PushContact)
+	if !ok {
+		a.Sleep(sleepTime)
+		return nil
+	}
+	deadline := time.Now().Add(time.Duration(sleepTime * float64(time.Second)))
+	for remaining := time.Until(deadline); remaining > 0; remaining = time.Until(deadline) {
+		if response := pushContact.WaitForPushedBeacon(remaining); response != nil {
+			if beacon := a.processBeacon(response); beacon != nil {
+				return beacon
+			}
+		}
+	}
+	return nil
 }
 
 func (a *Agent) GetPaw() string {
@@ -474,6 +687,12 @@ func (a *Agent) GetPaw() string {
 }
 
 func (a *Agent) SetPaw(paw string) {
+	a.channelMu.Lock()
+	defer a.channelMu.Unlock()
+	a.setPaw(paw)
+}
+
+func (a *Agent) setPaw(paw string) {
 	if len(paw) > 0 {
 		a.paw = paw
 		if a.enableLocalP2pReceivers {
@@ -488,24 +707,27 @@ func (a *Agent) GetBeaconContact() contact.Contact {
 	return a.beaconContact
 }
 
-func (a *Agent) StoreDeadmanInstruction(instruction map[string]interface{}) {
+func (a *Agent) StoreDeadmanInstruction(instruction protocol.Instruction) {
 	a.deadmanInstructions = append(a.deadmanInstructions, instruction)
 }
 
 func (a *Agent) ExecuteDeadmanInstructions() {
 	for _, instruction := range a.deadmanInstructions {
-		output.VerbosePrint(fmt.Sprintf("[*] Running deadman instruction %s", instruction["id"]))
+		output.VerbosePrint(fmt.Sprintf("[*] Running deadman instruction %s", instruction.ID))
 		a.RunInstruction(instruction, false)
 	}
 }
 
 func (a *Agent) modifyAgentConfiguration(config map[string]string) {
 	if val, ok := config["paw"]; ok {
-		a.SetPaw(val)
+		a.setPaw(val)
 	}
 	if val, ok := config["upstreamDest"]; ok {
 		a.updateUpstreamDestAddr(val)
 	}
+	if val, ok := config["clientCertIdentity"]; ok {
+		a.clientCertIdentity = val
+	}
 }
 
 func (a *Agent) updateUpstreamDestAddr(newDestAddr string) {
@@ -552,7 +774,7 @@ func (a *Agent) DiscoverPeers() {
 	// Recover on any panic on the external module call and not take down the whole agent.
 	defer func() {
 		if err := recover(); err != nil {
-			output.VerbosePrint(fmt.Sprintf("[-] Panic occurred when calling zeroconf:", err))
+			output.VerbosePrint(fmt.Sprintf("[-] Panic occurred when calling zeroconf: %v", err))
 		}
 	}()
 
@@ -582,14 +804,72 @@ func (a *Agent) GetCurrentContactName() string {
 	return ""
 }
 
-func (a *Agent) ProcessExecutorChange(executorUpdateMap interface{}) error {
-	executorUpdate, ok := executorUpdateMap.(map[string]interface{})
-	if !ok {
-		return errors.New("Malformed executor update mapping.")
+// Switches the data encoder chains used by the current communication channel. Both requested chains are
+// validated before the C2 config is modified, so an unusable request leaves the current encoders in place.
+func (a *Agent) ProcessEncoderChange(c2Config map[string]string, beaconEncoders []string, fileEncoders []string) error {
+	for _, requestedChain := range [][]string{beaconEncoders, fileEncoders} {
+		if len(requestedChain) > 0 {
+			if _, err := encoders.NewChain(requestedChain); err != nil {
+				return err
+			}
+		}
+	}
+	if len(beaconEncoders) > 0 {
+		c2Config["beaconEncoders"] = strings.Join(beaconEncoders, ",")
+	}
+	if len(fileEncoders) > 0 {
+		c2Config["fileEncoders"] = strings.Join(fileEncoders, ",")
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Switching data encoders (beacon=%s, file=%s)", c2Config["beaconEncoders"], c2Config["fileEncoders"]))
+	return a.reapplyContactConfig(c2Config)
+}
+
+// Applies the changed C2 config to the contact currently in use. Peer-to-peer clients ignore it, as the upstream
+// peer's contact talks to C2 on their behalf, and pick it up once the agent switches back to a C2 server.
+func (a *Agent) reapplyContactConfig(c2Config map[string]string) error {
+	a.channelMu.Lock()
+	defer a.channelMu.Unlock()
+	if a.beaconContact == nil {
+		return errors.New("No communication channel in use.")
+	}
+	return a.selectComChannel(a.getServerConfig(c2Config), a.GetCurrentContactName(), a.beaconContact)
+}
+
+// Switches the current communication channel to the TLS client certificate delivered by the server.
+// The certificate replaces any linked or file-based client certificate in the C2 config. Agents that relay through
+// a peer keep it until they switch back to a C2 server.
+func (a *Agent) ProcessClientCertificate(c2Config map[string]string, clientCert protocol.ClientCertificate) error {
+	if _, err := tls.X509KeyPair([]byte(clientCert.Certificate), []byte(clientCert.Key)); err != nil {
+		return err
+	}
+	c2Config["tlsClientCert"] = base64.StdEncoding.EncodeToString([]byte(clientCert.Certificate))
+	c2Config["tlsClientKey"] = base64.StdEncoding.EncodeToString([]byte(clientCert.Key))
+	delete(c2Config, "tlsClientCertFile")
+	delete(c2Config, "tlsClientKeyFile")
+	output.VerbosePrint("[*] Received TLS client certificate from C2")
+	return a.reapplyContactConfig(c2Config)
+}
+
+// Switches peer-to-peer messages to the group key delivered by the server. Messages sealed with the previous key
+// are still accepted, so that peers can switch over at their own pace. Local peer-to-peer receivers that waited for a
+// key are started.
+func (a *Agent) ProcessP2pKey(key string) {
+	if !proxy.SetGroupKey(key) {
+		return
+	}
+	output.VerbosePrint("[*] Received peer-to-peer group key from C2")
+	if a.enableLocalP2pReceivers && len(a.localP2pReceivers) == 0 {
+		// The receivers were not started for lack of a key. Jobs read their addresses for the profile.
+		a.channelMu.Lock()
+		defer a.channelMu.Unlock()
+		a.ActivateLocalP2pReceivers()
 	}
-	executorName := executorUpdate["executor"].(string)
-	action := executorUpdate["action"].(string)
-	value := executorUpdate["value"]
+}
+
+func (a *Agent) ProcessExecutorChange(executorUpdate protocol.ExecutorChange) error {
+	executorName := executorUpdate.Executor
+	action := executorUpdate.Action
+	newPath := executorUpdate.Value
 	if len(executorName) > 0 && len(action) > 0 {
 		executor, ok := execute.Executors[executorName]
 		if !ok {
@@ -601,12 +881,8 @@ func (a *Agent) ProcessExecutorChange(executorUpdateMap interface{}) error {
 			execute.RemoveExecutor(executorName)
 			return nil
 		case "update_path":
-			newPath, ok := value.(string)
-			if !ok {
-				return errors.New(fmt.Sprintf(
-					"[!] Error: expected string for new executor path, but received %T",
-					value,
-				))
+			if len(newPath) == 0 {
+				return errors.New("[!] Error: missing new executor path")
 			}
 			output.VerbosePrint(fmt.Sprintf("[*] Updating executor %s with new path %s", executorName, newPath))
 			executor.UpdateBinary(newPath)
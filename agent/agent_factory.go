@@ -1,14 +1,15 @@
 package agent
 
 import (
+	"github.com/mitre/gocat/config"
 	"github.com/mitre/gocat/contact"
 )
 
 // Creates and initializes a new Agent. Upon success, returns a pointer to the agent and nil Error.
 // Upon failure, returns nil and an error.
-func AgentFactory(server string, tunnelConfig *contact.TunnelConfig, group string, c2Config map[string]string, enableLocalP2pReceivers bool, initialDelay int, paw string, originLinkID string) (*Agent, error) {
+func AgentFactory(servers []config.Server, tunnelConfig *contact.TunnelConfig, group string, c2Config map[string]string, peers map[string][]string, enableLocalP2pReceivers bool, initialDelay int, paw string, originLinkID string, maxJobs int, jobQueueSize int) (*Agent, error) {
 	newAgent := &Agent{}
-	if err := newAgent.Initialize(server, tunnelConfig, group, c2Config, enableLocalP2pReceivers, initialDelay, paw, originLinkID); err != nil {
+	if err := newAgent.Initialize(servers, tunnelConfig, group, c2Config, peers, enableLocalP2pReceivers, initialDelay, paw, originLinkID, maxJobs, jobQueueSize); err != nil {
 		return nil, err
 	} else {
 		newAgent.Sleep(newAgent.initialDelay)
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Default limits of the instruction scheduler.
+const (
+	defaultMaxJobs      = 8
+	defaultJobQueueSize = 256
+)
+
+// Returned when an instruction is submitted again while it is queued or running, e.g. after it was pushed to the
+// agent and then returned by a beacon. Its result is reported once it finishes.
+var errJobAlreadyScheduled = errors.New("Instruction is already scheduled.")
+
+// How long a terminating agent lets running instructions finish before it cancels them, and then waits for the
+// cancelled instructions to exit.
+const jobStopGracePeriod = 30 * time.Second
+
+// An instruction that was scheduled to run.
+type job struct {
+	instruction protocol.Instruction
+	ctx         context.Context
+	cancel      context.CancelFunc
+	running     bool
+	pid         int
+}
+
+// Runs instructions on a fixed number of workers. Instructions that arrive while all workers are busy wait in a
+// bounded queue. Instructions still queued when the scheduler stops are handed to drop instead, if set.
+type jobScheduler struct {
+	queue   chan *job
+	maxJobs int
+	run     func(ctx context.Context, instruction protocol.Instruction)
+	drop    func(instruction protocol.Instruction)
+	workers sync.WaitGroup
+
+	mu       sync.Mutex      // guards jobs, stopping and killDate
+	jobs     map[string]*job // queued and running jobs by instruction ID
+	stopping bool
+	killDate time.Time // no instructions start from this time on, unless zero
+}
+
+func newJobScheduler(maxJobs int, queueSize int, run func(ctx context.Context, instruction protocol.Instruction), drop func(instruction protocol.Instruction)) *jobScheduler {
+	if maxJobs <= 0 {
+		maxJobs = defaultMaxJobs
+	}
+	if queueSize <= 0 {
+		queueSize = defaultJobQueueSize
+	}
+	scheduler := &jobScheduler{
+		queue:   make(chan *job, maxJobs+queueSize),
+		maxJobs: maxJobs,
+		run:     run,
+		drop:    drop,
+		jobs:    make(map[string]*job),
+	}
+	scheduler.workers.Add(maxJobs)
+	for i := 0; i < maxJobs; i++ {
+		go scheduler.work()
+	}
+	return scheduler
+}
+
+// Queues the instruction. Returns an error if the queue is full, the scheduler is stopping or the kill date passed, and
+// errJobAlreadyScheduled if the instruction is already queued or running.
+func (s *jobScheduler) submit(instruction protocol.Instruction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return errors.New("Agent is terminating.")
+	}
+	if s.pastKillDate() {
+		return errors.New("Kill date reached.")
+	}
+	if _, ok := s.jobs[instruction.ID]; ok {
+		return errJobAlreadyScheduled
+	}
+	if len(s.jobs) >= cap(s.queue) {
+		return errors.New(fmt.Sprintf("Job queue is full (%d instructions waiting).", cap(s.queue)-s.maxJobs))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	newJob := &job{instruction: instruction, ctx: ctx, cancel: cancel}
+	s.jobs[instruction.ID] = newJob
+	s.queue <- newJob
+	return nil
+}
+
+// Sets the time from which no more instructions are accepted or started. The zero time sets no limit.
+func (s *jobScheduler) setKillDate(killDate time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.killDate = killDate
+}
+
+// Returns true if the kill date passed.
+func (s *jobScheduler) killDateReached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pastKillDate()
+}
+
+func (s *jobScheduler) pastKillDate() bool {
+	return !s.killDate.IsZero() && !time.Now().Before(s.killDate)
+}
+
+// Cancels the queued or running job for the given instruction ID. Returns false if there is no such job.
+func (s *jobScheduler) cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancelledJob, ok := s.jobs[id]; ok {
+		cancelledJob.cancel()
+		return true
+	}
+	return false
+}
+
+// Cancels all queued and running jobs. Returns the number of cancelled jobs.
+func (s *jobScheduler) cancelAll() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancelledJob := range s.jobs {
+		cancelledJob.cancel()
+	}
+	return len(s.jobs)
+}
+
+// Records the PID of the process that runs the job for the given instruction ID.
+func (s *jobScheduler) setPid(id string, pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if runningJob, ok := s.jobs[id]; ok {
+		runningJob.pid = pid
+	}
+}
+
+// Returns the queued and running jobs, ordered by instruction ID.
+func (s *jobScheduler) list() []protocol.RunningLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	links := make([]protocol.RunningLink, 0, len(s.jobs))
+	for id, listedJob := range s.jobs {
+		link := protocol.RunningLink{ID: id, Status: protocol.LINK_QUEUED, Pid: listedJob.pid}
+		if listedJob.running {
+			link.Status = protocol.LINK_RUNNING
+		}
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].ID < links[j].ID
+	})
+	return links
+}
+
+func (s *jobScheduler) work() {
+	defer s.workers.Done()
+	for nextJob := range s.queue {
+		// Jobs that were still queued when the scheduler stopped were already dropped.
+		if !s.startJob(nextJob) {
+			s.run(nextJob.ctx, nextJob.instruction)
+		}
+		nextJob.cancel()
+		s.mu.Lock()
+		delete(s.jobs, nextJob.instruction.ID)
+		s.mu.Unlock()
+	}
+}
+
+// Marks the job as running. Returns true if the scheduler is stopping, in which case the job must be dropped.
+func (s *jobScheduler) startJob(startedJob *job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	startedJob.running = !s.stopping
+	return s.stopping
+}
+
+// Stops accepting instructions, drops the queued ones and waits up to the grace period for the running ones to
+// finish. Dropped instructions are handed to drop before the wait. Instructions still running after that are cancelled, which kills their processes, and awaited for another
+// grace period. Returns false if instructions were still running in the end.
+func (s *jobScheduler) stop(gracePeriod time.Duration) bool {
+	s.mu.Lock()
+	if s.stopping {
+		s.mu.Unlock()
+		return true
+	}
+	s.stopping = true
+	close(s.queue)
+	var dropped []protocol.Instruction
+	for _, queuedJob := range s.jobs {
+		if !queuedJob.running {
+			dropped = append(dropped, queuedJob.instruction)
+		}
+	}
+	s.mu.Unlock()
+	for _, instruction := range dropped {
+		output.VerbosePrint(fmt.Sprintf("[*] Dropping queued instruction %s", instruction.ID))
+		if s.drop != nil {
+			s.drop(instruction)
+		}
+	}
+	finished := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(finished)
+	}()
+	output.VerbosePrint("[*] Waiting for running instructions to finish")
+	select {
+	case <-finished:
+		return true
+	case <-time.After(gracePeriod):
+	}
+	output.VerbosePrint(fmt.Sprintf("[!] Cancelling %d instructions still running", s.cancelAll()))
+	select {
+	case <-finished:
+		return true
+	case <-time.After(gracePeriod):
+		output.VerbosePrint("[!] Cancelled instructions did not exit in time")
+		return false
+	}
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/execute"
+	"github.com/mitre/gocat/protocol"
+)
+
+func TestJobSchedulerStopWaitsForRunningJobs(t *testing.T) {
+	finished := make(chan string, 1)
+	scheduler := newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {
+		time.Sleep(100 * time.Millisecond)
+		if ctx.Err() == nil {
+			finished <- instruction.ID
+		}
+	}, nil)
+	if err := scheduler.submit(protocol.Instruction{ID: "short"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !scheduler.stop(time.Second) {
+		t.Fatal("stop gave up on a job that finished within the grace period")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Error("job did not finish uncancelled")
+	}
+	if err := scheduler.submit(protocol.Instruction{ID: "late"}); err == nil {
+		t.Error("stopped scheduler accepted an instruction")
+	}
+}
+
+func TestJobSchedulerStopCancelsJobsAfterGracePeriod(t *testing.T) {
+	scheduler := newJobScheduler(2, 1, func(ctx context.Context, instruction protocol.Instruction) {
+		<-ctx.Done()
+	}, nil)
+	for _, id := range []string{"first", "second"} {
+		if err := scheduler.submit(protocol.Instruction{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if !scheduler.stop(100 * time.Millisecond) {
+		t.Fatal("cancelled jobs did not exit")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stop took %s", elapsed)
+	}
+	if links := scheduler.list(); len(links) > 0 {
+		t.Errorf("jobs left after stop: %v", links)
+	}
+}
+
+func TestJobSchedulerStopGivesUpOnStuckJobs(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	scheduler := newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {
+		<-release
+	}, nil)
+	if err := scheduler.submit(protocol.Instruction{ID: "stuck"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if scheduler.stop(50 * time.Millisecond) {
+		t.Error("stop reported a stuck job as finished")
+	}
+}
+
+func TestJobSchedulerRefusesInstructionsAfterKillDate(t *testing.T) {
+	scheduler := newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {}, nil)
+	defer scheduler.stop(time.Second)
+	scheduler.setKillDate(time.Now().Add(-time.Second))
+	if err := scheduler.submit(protocol.Instruction{ID: "late"}); err == nil {
+		t.Error("scheduler accepted an instruction after the kill date")
+	}
+}
+
+func TestAgentRefusesQueuedInstructionsAfterKillDate(t *testing.T) {
+	a := &Agent{jobs: newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {}, nil)}
+	defer a.jobs.stop(time.Second)
+	a.SetKillDate(time.Now().Add(-time.Second))
+	result := a.runInstructionCommand(context.Background(), protocol.Instruction{ID: "queued", Executor: "sh", Command: "echo late"})
+	if result.Status != execute.CANCELLED_STATUS {
+		t.Errorf("expected status %s for an instruction started after the kill date, got %s", execute.CANCELLED_STATUS, result.Status)
+	}
+}
+
+func TestJobSchedulerRefusesDuplicateInstructions(t *testing.T) {
+	release := make(chan struct{})
+	scheduler := newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {
+		<-release
+	}, nil)
+	defer scheduler.stop(time.Second)
+	defer close(release)
+	if err := scheduler.submit(protocol.Instruction{ID: "pushed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.submit(protocol.Instruction{ID: "pushed"}); err != errJobAlreadyScheduled {
+		t.Errorf("expected errJobAlreadyScheduled for a duplicate instruction, got %v", err)
+	}
+}
+
+func TestJobSchedulerStopDropsQueuedJobs(t *testing.T) {
+	var ran, dropped []string
+	var mu sync.Mutex
+	scheduler := newJobScheduler(1, 1, func(ctx context.Context, instruction protocol.Instruction) {
+		mu.Lock()
+		ran = append(ran, instruction.ID)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+	}, func(instruction protocol.Instruction) {
+		mu.Lock()
+		dropped = append(dropped, instruction.ID)
+		mu.Unlock()
+	})
+	for _, id := range []string{"running", "queued"} {
+		if err := scheduler.submit(protocol.Instruction{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !scheduler.stop(time.Second) {
+		t.Fatal("running job did not finish")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ran) != 1 || ran[0] != "running" || len(dropped) != 1 || dropped[0] != "queued" {
+		t.Errorf("expected the running job to finish and the queued one to be dropped, ran %v and dropped %v", ran, dropped)
+	}
+}
@@ -3,14 +3,21 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 
 	"github.com/mitre/gocat/output"
 	"github.com/mitre/gocat/proxy"
 )
 
+// Starts the local peer-to-peer receivers. Without a linked group key, they are started once C2 delivers one.
 func (a *Agent) ActivateLocalP2pReceivers() {
+	if !proxy.HasGroupKey() {
+		output.VerbosePrint("[!] No peer-to-peer group key linked in. Peer-to-peer receivers will start once C2 delivers one.")
+		return
+	}
 	for receiverName, p2pReceiver := range proxy.P2pReceiverChannels {
-		if err := p2pReceiver.InitializeReceiver(&a.server, &a.beaconContact, a.p2pReceiverWaitGroup); err != nil {
+		if err := p2pReceiver.InitializeReceiver(&a.server, &a.peerRelay, a.p2pReceiverWaitGroup); err != nil {
 			output.VerbosePrint(fmt.Sprintf("[-] Error when initializing p2p receiver %s: %s", receiverName, err.Error()))
 		} else {
 			output.VerbosePrint(fmt.Sprintf("[*] Initialized p2p receiver %s", receiverName))
@@ -40,7 +47,8 @@ func (a *Agent) storeLocalP2pReceiverAddresses(receiverName string, p2pReceiver
 }
 
 // Attempts to look for any compatible peer-to-peer proxy clients for available proxy receivers.
-// Sets the first valid one it can find. Returns an error if no valid proxy clients are found.
+// Receivers are tried in order of the route to C2 they advertise, so the shortest healthy route is set if there is
+// one. Returns an error if no valid proxy clients are found.
 func (a *Agent) findAvailablePeerProxyClient() error {
 	if len(a.availablePeerReceivers) == 0 {
 		// Either we used all available peers, or we simply never had any to start with. Refresh
@@ -51,33 +59,163 @@ func (a *Agent) findAvailablePeerProxyClient() error {
 		output.VerbosePrint("[*] All available peer proxy receivers have been tried. Retrying them.")
 		a.refreshAvailablePeerReceivers()
 	}
-	for proxyChannel, receiverAddresses := range a.availablePeerReceivers {
-		if len(receiverAddresses) > 0 {
-			output.VerbosePrint(fmt.Sprintf("[-] Verifying proxy channel %s", proxyChannel))
-
-			// Attempt to set the new coms channel.
-			if err := a.AttemptSelectComChannel(nil, proxyChannel); err != nil {
-				output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use proxy channel %s: %s", proxyChannel, err.Error()))
-
-				// Remove the invalid proxy channel from the pool. Safe to remove during iteration.
-				delete(a.availablePeerReceivers, proxyChannel)
-				continue
-			}
-			// Successfully set the channel. Update dest address.
-			a.usingPeerReceivers = true
-			addressToUse := receiverAddresses[0]
-			a.updateUpstreamDestAddr(addressToUse)
-			output.VerbosePrint(fmt.Sprintf("[*] Updated agent's destination address to proxy peer address: %s", addressToUse))
-
-			// Mark proxy channel and peer receiver address as used.
-			a.markPeerReceiverAsUsed(proxyChannel, addressToUse)
-			a.peerProxyReceiverDisplay()
-			return nil
+	invalidChannels := make(map[string]bool)
+	for _, candidate := range a.rankPeerReceivers() {
+		proxyChannel := candidate.proxyChannel
+		if invalidChannels[proxyChannel] {
+			continue
+		}
+		output.VerbosePrint(fmt.Sprintf("[-] Verifying proxy channel %s", proxyChannel))
+		addressToUse := candidate.address
+
+		// Attempt to set the new coms channel.
+		if err := a.attemptSelectPeerProxyChannel(proxyChannel, addressToUse); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use proxy channel %s: %s", proxyChannel, err.Error()))
+
+			// Remove the invalid proxy channel from the pool.
+			delete(a.availablePeerReceivers, proxyChannel)
+			invalidChannels[proxyChannel] = true
+			continue
 		}
+		// Successfully set the channel. Update dest address.
+		a.usingPeerReceivers = !a.isServerAddress(addressToUse)
+		a.peerRoute = candidate.route
+		a.updateUpstreamDestAddr(addressToUse)
+		output.VerbosePrint(fmt.Sprintf("[*] Updated agent's destination address to proxy peer address: %s", addressToUse))
+
+		// Mark proxy channel and peer receiver address as used.
+		a.markPeerReceiverAsUsed(proxyChannel, addressToUse)
+		a.peerProxyReceiverDisplay()
+		return nil
 	}
 	return errors.New("No available compatible peer-to-peer proxy clients found.")
 }
 
+// Ranks of peer receivers, from most to least preferred.
+const (
+	routeHealthy = iota
+	routeUnknown // the C2 server itself, or receivers whose client cannot ask for routes
+	routeUnhealthy
+	routeUnreachable
+	routeLoop
+)
+
+// A peer proxy receiver that the agent could switch to.
+type peerCandidate struct {
+	proxyChannel string
+	address      string
+	route        *proxy.RouteInfo // route advertised by the receiver, if known
+	rank         int
+}
+
+// Asks each available peer receiver for its route to C2 and returns them sorted by preference: healthy routes
+// first, shortest first, followed by receivers with unknown, unhealthy or no routes. Routes that pass through this
+// agent come last.
+func (a *Agent) rankPeerReceivers() []*peerCandidate {
+	proxyChannels := make([]string, 0, len(a.availablePeerReceivers))
+	for proxyChannel := range a.availablePeerReceivers {
+		proxyChannels = append(proxyChannels, proxyChannel)
+	}
+	sort.Strings(proxyChannels)
+	var candidates []*peerCandidate
+	var waitgroup sync.WaitGroup
+	for _, proxyChannel := range proxyChannels {
+		for _, address := range a.availablePeerReceivers[proxyChannel] {
+			candidate := &peerCandidate{proxyChannel: proxyChannel, address: address}
+			candidates = append(candidates, candidate)
+			waitgroup.Add(1)
+			go func() {
+				defer waitgroup.Done()
+				a.probePeerRoute(candidate)
+			}()
+		}
+	}
+	waitgroup.Wait()
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].rank == routeHealthy && candidates[i].route.Hops < candidates[j].route.Hops
+	})
+	return candidates
+}
+
+func (a *Agent) probePeerRoute(candidate *peerCandidate) {
+	candidate.rank = routeUnknown
+	if a.isServerAddress(candidate.address) {
+		return
+	}
+	prober, ok := proxy.P2pClientChannels[candidate.proxyChannel].(proxy.RouteProber)
+	if !ok {
+		return
+	}
+	route, err := prober.ProbeRoute(candidate.address, a.paw)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Could not get route from peer %s: %s", candidate.address, err.Error()))
+		candidate.rank = routeUnreachable
+		return
+	}
+	candidate.route = &route
+	switch {
+	case route.Contains(a.paw):
+		candidate.rank = routeLoop
+	case route.Healthy:
+		candidate.rank = routeHealthy
+	default:
+		candidate.rank = routeUnhealthy
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Peer %s advertises route with %d hops, healthy=%v", candidate.address, route.Hops, route.Healthy))
+}
+
+// Asks the upstream peer for its current route to C2 and returns it. Returns true if the peer is unreachable or its
+// route is no longer usable, e.g. because an intermediate peer died. Returns a nil route if the agent does not relay
+// through a peer that advertises routes.
+func (a *Agent) probeUpstreamPeerRoute() (*proxy.RouteInfo, bool) {
+	if !a.usingPeerReceivers || a.isServerAddress(a.upstreamDestAddr) {
+		return nil, false
+	}
+	prober, ok := a.beaconContact.(proxy.RouteProber)
+	if !ok {
+		return nil, false
+	}
+	route, err := prober.ProbeRoute(a.upstreamDestAddr, a.paw)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Upstream peer %s is unreachable: %s", a.upstreamDestAddr, err.Error()))
+		return nil, true
+	}
+	if !route.Healthy || route.Contains(a.paw) {
+		return nil, true
+	}
+	return &route, false
+}
+
+// Updates the route to C2 that the local proxy receivers advertise, after a beacon succeeded or failed.
+func (a *Agent) updateLocalRoute(healthy bool) {
+	route := proxy.RouteInfo{Healthy: healthy}
+	if a.usingPeerReceivers && !a.isServerAddress(a.upstreamDestAddr) {
+		route.Hops = 1
+		if a.peerRoute != nil {
+			route.Hops = a.peerRoute.Hops + 1
+			route.Path = append([]string{a.peerRoute.Paw}, a.peerRoute.Path...)
+		}
+	}
+	proxy.SetLocalRoute(route)
+}
+
+// Attempts to set the communication channel used to reach the given proxy receiver address. Peer receivers are
+// reached through the matching peer-to-peer client if there is one, while C2 servers are always reached through their
+// configured communication channel.
+func (a *Agent) attemptSelectPeerProxyChannel(proxyChannel string, receiverAddress string) error {
+	if serverIndex := a.getServerIndex(receiverAddress); serverIndex >= 0 {
+		return a.selectServer(serverIndex)
+	}
+	if coms, ok := proxy.P2pClientChannels[proxyChannel]; ok {
+		output.VerbosePrint(fmt.Sprintf("[*] Attempting to set peer-to-peer client %s", proxyChannel))
+		return a.selectComChannel(nil, proxyChannel, coms)
+	}
+	return a.AttemptSelectComChannel(nil, proxyChannel)
+}
+
 // Mark the peer proxy channel and receiver address as exhausted, so the agent doesn't try using it again
 // before trying the remaining ones.
 func (a *Agent) markPeerReceiverAsUsed(proxyChannel string, usedAddress string) {
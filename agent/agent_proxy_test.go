@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+	"github.com/mitre/gocat/proxy"
+)
+
+// Peer-to-peer client whose receivers advertise fixed routes, keyed by receiver address. Receivers without a route
+// are unreachable.
+type testRouteClient struct {
+	routes map[string]proxy.RouteInfo
+}
+
+func (c *testRouteClient) GetBeaconBytes(profile protocol.Profile) []byte { return nil }
+
+func (c *testRouteClient) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	return nil, ""
+}
+
+func (c *testRouteClient) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+
+func (c *testRouteClient) SendExecutionResults(profile protocol.Profile, result protocol.Result) {}
+
+func (c *testRouteClient) GetName() string { return "RouteTest" }
+
+func (c *testRouteClient) SetUpstreamDestAddr(upstreamDestAddr string) {}
+
+func (c *testRouteClient) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	return nil
+}
+
+func (c *testRouteClient) ProbeRoute(receiverAddr string, paw string) (proxy.RouteInfo, error) {
+	route, ok := c.routes[receiverAddr]
+	if !ok {
+		return route, errors.New("connection refused")
+	}
+	return route, nil
+}
+
+func TestRankPeerReceiversPrefersShortestHealthyRoute(t *testing.T) {
+	proxy.P2pClientChannels["RouteTest"] = &testRouteClient{routes: map[string]proxy.RouteInfo{
+		"test://long":      {Paw: "longpaw", Hops: 3, Path: []string{"a", "b"}, Healthy: true},
+		"test://short":     {Paw: "shortpaw", Hops: 1, Healthy: true},
+		"test://unhealthy": {Paw: "unhealthypaw", Hops: 0, Healthy: false},
+		"test://loop":      {Paw: "looppaw", Hops: 2, Path: []string{"agentpaw"}, Healthy: true},
+	}}
+	defer delete(proxy.P2pClientChannels, "RouteTest")
+	a := &Agent{
+		paw:     "agentpaw",
+		servers: []config.Server{{Address: "http://c2"}},
+		availablePeerReceivers: map[string][]string{
+			"RouteTest": {"test://loop", "test://unreachable", "test://unhealthy", "test://long", "test://short"},
+			"HTTP":      {"http://c2"},
+		},
+	}
+
+	expected := []string{"test://short", "test://long", "http://c2", "test://unhealthy", "test://unreachable", "test://loop"}
+	candidates := a.rankPeerReceivers()
+	if len(candidates) != len(expected) {
+		t.Fatalf("ranked %d receivers, expected %d", len(candidates), len(expected))
+	}
+	for i, candidate := range candidates {
+		if candidate.address != expected[i] {
+			t.Errorf("receiver %d is %s, expected %s", i, candidate.address, expected[i])
+		}
+	}
+}
+
+// Peer-to-peer receiver that records whether it was started.
+type testReceiver struct {
+	started   bool
+	waitgroup *sync.WaitGroup
+}
+
+func (r *testReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	r.started = true
+	r.waitgroup = waitgroup
+	return nil
+}
+
+func (r *testReceiver) RunReceiver() { r.waitgroup.Done() }
+
+func (r *testReceiver) UpdateAgentPaw(newPaw string) {}
+
+func (r *testReceiver) Terminate() {}
+
+func (r *testReceiver) GetReceiverAddresses() []string { return []string{"test://receiver"} }
+
+func TestReceiversStartOnceC2DeliversGroupKey(t *testing.T) {
+	if proxy.HasGroupKey() {
+		t.Skip("peer-to-peer group key already set")
+	}
+	receiver := &testReceiver{}
+	savedChannels := proxy.P2pReceiverChannels
+	proxy.P2pReceiverChannels = map[string]proxy.P2pReceiver{"Test": receiver}
+	defer func() { proxy.P2pReceiverChannels = savedChannels }()
+	a := &Agent{
+		enableLocalP2pReceivers:   true,
+		localP2pReceivers:         make(map[string]proxy.P2pReceiver),
+		localP2pReceiverAddresses: make(map[string][]string),
+		p2pReceiverWaitGroup:      &sync.WaitGroup{},
+	}
+
+	a.ActivateLocalP2pReceivers()
+	if receiver.started {
+		t.Fatal("receiver started without a group key")
+	}
+	a.ProcessP2pKey("delivered key")
+	defer proxy.SetGroupKey("")
+	if !receiver.started || len(a.localP2pReceiverAddresses["Test"]) != 1 {
+		t.Errorf("receiver not started with the delivered key: addresses %v", a.localP2pReceiverAddresses)
+	}
+	a.TerminateLocalP2pReceivers()
+}
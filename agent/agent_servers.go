@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+	"github.com/mitre/gocat/proxy"
+)
+
+// How long the agent waits after switching away from the primary C2 server before probing it again.
+var failbackInterval = 5 * time.Minute
+
+// Switches the agent to the C2 server at the given index in its list of servers, using that server's contact and
+// proxy. The previous server is kept if the contact cannot be set.
+func (a *Agent) selectServer(index int) error {
+	server := a.servers[index]
+	previousServer, previousDestAddr := a.server, a.upstreamDestAddr
+	a.server = server.Address
+	a.upstreamDestAddr = server.Address
+	serverConfig := server.ApplyTo(a.c2Config)
+	if err := a.AttemptSelectComChannel(serverConfig, serverConfig["c2Name"]); err != nil {
+		a.server = previousServer
+		a.updateUpstreamDestAddr(previousDestAddr)
+		return err
+	}
+	a.serverIndex = index
+	a.usingTunnel = false
+	a.usingPeerReceivers = false
+	a.peerRoute = nil
+	a.updateUpstreamDestAddr(server.Address)
+	output.VerbosePrint(fmt.Sprintf("[*] Switched to C2 server %d: %s", index, server.Address))
+	return nil
+}
+
+// Switches to the next C2 server in order of preference. Returns an error once the last server has been tried, so
+// that the agent can fall back to peer proxy receivers.
+func (a *Agent) failoverToNextServer() error {
+	for index := a.serverIndex + 1; index < len(a.servers); index++ {
+		output.VerbosePrint(fmt.Sprintf("[!] Reached beacon failure threshold. Attempting to fail over to C2 server %s", a.servers[index].Address))
+		if err := a.selectServer(index); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error attempting to use C2 server %s: %s", a.servers[index].Address, err.Error()))
+			continue
+		}
+		return nil
+	}
+	return errors.New("No remaining C2 servers to fail over to.")
+}
+
+// Switches to the contact that C2 asked for, with the proxy of the current C2 server applied.
+func (a *Agent) ProcessContactChange(c2Config map[string]string, requestedChannel string) error {
+	c2Config["c2Name"] = requestedChannel
+	a.channelMu.Lock()
+	defer a.channelMu.Unlock()
+	serverConfig := a.getServerConfig(c2Config)
+	serverConfig["c2Name"] = requestedChannel
+	return a.AttemptSelectComChannel(serverConfig, requestedChannel)
+}
+
+// Returns the given contact settings with the contact and proxy of the current C2 server applied.
+func (a *Agent) getServerConfig(c2Config map[string]string) map[string]string {
+	return a.servers[a.serverIndex].ApplyTo(c2Config)
+}
+
+// Returns the index of the C2 server with the given address, or -1 if the address is not a C2 server.
+func (a *Agent) getServerIndex(address string) int {
+	for index, server := range a.servers {
+		if server.Address == address {
+			return index
+		}
+	}
+	return -1
+}
+
+func (a *Agent) isServerAddress(address string) bool {
+	return a.getServerIndex(address) >= 0
+}
+
+// Periodically tries to beacon to the primary C2 server while the agent uses a fallback server or a peer. The primary
+// server is probed over a separate instance of its contact, for no longer than the contact's request timeout, while
+// jobs and peers keep using the current channel. Returns the beacon if the primary server answered, in which case the
+// agent switches to it. Otherwise, nil is returned.
+func (a *Agent) AttemptFailback() *protocol.Beacon {
+	if (a.serverIndex == 0 && !a.usingPeerReceivers) || time.Since(a.lastFailbackAttempt) < failbackInterval {
+		return nil
+	}
+	a.lastFailbackAttempt = time.Now()
+	primary := a.servers[0]
+	output.VerbosePrint(fmt.Sprintf("[*] Probing primary C2 server %s", primary.Address))
+	serverConfig := primary.ApplyTo(a.c2Config)
+	profile := a.GetFullProfile()
+	profile.Server = primary.Address
+	profile.UpstreamDest = primary.Address
+	profile.Contact = serverConfig["c2Name"]
+	response, err := contact.ProbeBeacon(serverConfig["c2Name"], serverConfig, primary.Address, profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Primary C2 server still unavailable: %s", err.Error()))
+		return nil
+	}
+	beacon := a.processBeacon(response)
+	if beacon == nil {
+		return nil
+	}
+
+	// The beacon is returned even if the switch fails, as the server already handed out its instructions.
+	a.channelMu.Lock()
+	defer a.channelMu.Unlock()
+	previousIndex, previousDestAddr := a.serverIndex, a.upstreamDestAddr
+	previousContact, previousUsingPeers, previousRoute := a.beaconContact, a.usingPeerReceivers, a.peerRoute
+	if err = a.selectServer(0); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error attempting to use primary C2 server: %s", err.Error()))
+		a.restoreChannel(previousIndex, previousDestAddr, previousContact, previousUsingPeers, previousRoute)
+		return beacon
+	}
+	a.failedBeaconCounter = 0
+	a.updateLocalRoute(true)
+	output.VerbosePrint("[+] Failed back to primary C2 server")
+	return beacon
+}
+
+// Returns to the C2 server or peer proxy receiver that the agent used before a failback attempt.
+func (a *Agent) restoreChannel(serverIndex int, destAddr string, coms contact.Contact, usingPeerReceivers bool, route *proxy.RouteInfo) {
+	if !usingPeerReceivers {
+		if err := a.selectServer(serverIndex); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error returning to C2 server %s: %s", a.servers[serverIndex].Address, err.Error()))
+		}
+		return
+	}
+	a.serverIndex = serverIndex
+	a.server = a.servers[serverIndex].Address
+	a.upstreamDestAddr = destAddr
+	if err := a.selectComChannel(nil, coms.GetName(), coms); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error returning to peer proxy receiver %s: %s", destAddr, err.Error()))
+		return
+	}
+	a.usingPeerReceivers = true
+	a.peerRoute = route
+}
+
+// Calls use with the contact in use and the agent's full profile, both read while the channel to C2 cannot change.
+// Used by jobs, which run alongside the main loop that switches channels. The lock is released before use is called,
+// so that failover does not wait for slow uploads or payload downloads to finish.
+func (a *Agent) useChannel(use func(coms contact.Contact, profile protocol.Profile)) {
+	a.channelMu.RLock()
+	coms, profile := a.beaconContact, a.GetFullProfile()
+	a.channelMu.RUnlock()
+	use(coms, profile)
+}
+
+// Returns the contact in use, read while the channel to C2 cannot change.
+func (a *Agent) getChannelContact() contact.Contact {
+	a.channelMu.RLock()
+	defer a.channelMu.RUnlock()
+	return a.beaconContact
+}
+
+// Contact handed to the local peer-to-peer receivers, which relays their messages through the contact the agent uses
+// at the time. The agent configures its contacts itself, so the receivers cannot.
+type channelContact struct {
+	agent *Agent
+}
+
+func (c *channelContact) GetBeaconBytes(profile protocol.Profile) []byte {
+	return c.agent.getChannelContact().GetBeaconBytes(profile)
+}
+
+func (c *channelContact) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	return c.agent.getChannelContact().GetPayloadBytes(profile, payload)
+}
+
+func (c *channelContact) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	return false, nil
+}
+
+func (c *channelContact) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	c.agent.getChannelContact().SendExecutionResults(profile, result)
+}
+
+func (c *channelContact) GetName() string {
+	return c.agent.getChannelContact().GetName()
+}
+
+func (c *channelContact) SetUpstreamDestAddr(upstreamDestAddr string) {}
+
+func (c *channelContact) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	return c.agent.getChannelContact().UploadFileBytes(profile, uploadName, data)
+}
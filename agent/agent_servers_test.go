@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+func TestFailbackProbeDoesNotDivertJobs(t *testing.T) {
+	primary := c2test.NewServer()
+	defer primary.Close()
+	primary.SetAvailable(false)
+	fallback := c2test.NewServer()
+	defer fallback.Close()
+
+	savedInterval := failbackInterval
+	failbackInterval = 0
+	defer func() { failbackInterval = savedInterval }()
+
+	servers := []config.Server{{Address: primary.URL()}, {Address: fallback.URL()}}
+	c2Config := map[string]string{"c2Name": "HTTP", "beaconEncoders": "base64", "fileEncoders": "plain-text"}
+	a, err := AgentFactory(servers, &contact.TunnelConfig{}, "red", c2Config, nil, false, 0, "failbackpaw", "", 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.selectServer(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Jobs submit results while the main loop keeps probing the unavailable primary server.
+	var jobs sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		jobs.Add(1)
+		go func(id string) {
+			defer jobs.Done()
+			a.runInstruction(context.Background(), c2test.NewInstruction(id, "sh", "echo "+id), true)
+		}(fmt.Sprintf("link-%d", i))
+	}
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	for probing := true; probing; {
+		select {
+		case <-done:
+			probing = false
+		default:
+			if a.AttemptFailback() != nil {
+				t.Fatal("failed back to an unavailable server")
+			}
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		fallback.RequireResult(t, fmt.Sprintf("link-%d", i), 5*time.Second)
+	}
+	if len(primary.Results()) > 0 {
+		t.Errorf("results sent to the primary server during a probe: %d", len(primary.Results()))
+	}
+	if a.serverIndex != 1 || a.upstreamDestAddr != fallback.URL() {
+		t.Errorf("agent did not return to the fallback server: index %d, destination %s", a.serverIndex, a.upstreamDestAddr)
+	}
+}
+
+func TestFailbackProbeDoesNotBlockJobs(t *testing.T) {
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer primary.Close()
+	defer close(release)
+	fallback := c2test.NewServer()
+	defer fallback.Close()
+
+	savedInterval := failbackInterval
+	failbackInterval = 0
+	defer func() { failbackInterval = savedInterval }()
+
+	servers := []config.Server{{Address: primary.URL}, {Address: fallback.URL()}}
+	c2Config := map[string]string{"c2Name": "HTTP", "beaconEncoders": "base64", "fileEncoders": "plain-text"}
+	a, err := AgentFactory(servers, &contact.TunnelConfig{}, "red", c2Config, nil, false, 0, "hangingpaw", "", 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.selectServer(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The primary server accepts the probe but never answers it.
+	probed := make(chan *protocol.Beacon, 1)
+	go func() {
+		probed <- a.AttemptFailback()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	a.runInstruction(context.Background(), c2test.NewInstruction("link-during-probe", "sh", "echo probing"), true)
+	fallback.RequireResult(t, "link-during-probe", 5*time.Second)
+
+	release <- struct{}{}
+	if beacon := <-probed; beacon != nil {
+		t.Fatal("failed back to a server that did not answer")
+	}
+	if a.serverIndex != 1 || a.upstreamDestAddr != fallback.URL() {
+		t.Errorf("agent left the fallback server: index %d, destination %s", a.serverIndex, a.upstreamDestAddr)
+	}
+}
+
+func TestFailoverDoesNotWaitForUploads(t *testing.T) {
+	uploading := make(chan struct{}, 1)
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file/upload" {
+			uploading <- struct{}{}
+			<-release
+		}
+	}))
+	defer primary.Close()
+	defer close(release)
+	fallback := c2test.NewServer()
+	defer fallback.Close()
+
+	servers := []config.Server{{Address: primary.URL}, {Address: fallback.URL()}}
+	c2Config := map[string]string{"c2Name": "HTTP", "beaconEncoders": "base64", "fileEncoders": "plain-text"}
+	a, err := AgentFactory(servers, &contact.TunnelConfig{}, "red", c2Config, nil, false, 0, "uploadingpaw", "", 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	// The primary server accepts the upload but never answers it.
+	go a.uploadSingleFile(file.Name())
+	select {
+	case <-uploading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not reach the primary server")
+	}
+	failedOver := make(chan error, 1)
+	go func() {
+		a.failedBeaconCounter = beaconFailureThreshold - 1
+		failedOver <- a.HandleBeaconFailure()
+	}()
+	select {
+	case err = <-failedOver:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failover waited for the upload to finish")
+	}
+	if a.serverIndex != 1 || a.upstreamDestAddr != fallback.URL() {
+		t.Errorf("agent did not fail over: index %d, destination %s", a.serverIndex, a.upstreamDestAddr)
+	}
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/contact"
+)
+
+func TestSleepQuietlyClosesPushConnectionAndDefersPushes(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	c2Config := map[string]string{"c2Name": "WebSocket", "beaconEncoders": "base64", "fileEncoders": "plain-text"}
+	a, err := AgentFactory([]config.Server{{Address: server.URL()}}, &contact.TunnelConfig{}, "red", c2Config, nil, false, 0, "quietpaw", "", 4, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Terminate()
+	if a.Beacon() == nil {
+		t.Fatal("beacon failed")
+	}
+	server.QueueInstruction(c2test.NewInstruction("link-pushed", "sh", "echo pushed"))
+	if pushed, err := server.Push(); err != nil || pushed != 1 {
+		t.Fatalf("push reached %d agents: %v", pushed, err)
+	}
+	// Give the contact time to receive the push before its connection is closed.
+	time.Sleep(200 * time.Millisecond)
+
+	a.SleepQuietly(0.1)
+	deadline := time.Now().Add(5 * time.Second)
+	for pushed, _ := server.Push(); pushed > 0; pushed, _ = server.Push() {
+		if time.Now().After(deadline) {
+			t.Fatal("push connection still open after a quiet sleep")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The beacon pushed before the quiet sleep is processed once the agent sleeps between beacons again.
+	beacon := a.SleepUntilNextBeacon(5)
+	if beacon == nil || len(beacon.Instructions) != 1 || beacon.Instructions[0].ID != "link-pushed" {
+		t.Errorf("pushed beacon not deferred: %+v", beacon)
+	}
+}
@@ -0,0 +1,64 @@
+package c2test
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+const DefaultTimeout = 60
+
+// NewInstruction builds an instruction that runs the given plaintext command with the given executor.
+func NewInstruction(id string, executor string, command string) protocol.Instruction {
+	return protocol.Instruction{
+		ID:       id,
+		Command:  base64.StdEncoding.EncodeToString([]byte(command)),
+		Executor: executor,
+		Timeout:  DefaultTimeout,
+		Payloads: []string{},
+		Uploads:  []string{},
+	}
+}
+
+// RequireBeacons fails the test unless at least count beacons are received within the timeout.
+func (s *Server) RequireBeacons(t testing.TB, count int, timeout time.Duration) []protocol.Profile {
+	t.Helper()
+	beacons, err := s.WaitForBeacons(count, timeout)
+	if err != nil {
+		t.Fatalf("c2test: %s", err.Error())
+	}
+	return beacons
+}
+
+// RequireResult fails the test unless a result for the given link ID is received within the timeout.
+func (s *Server) RequireResult(t testing.TB, id string, timeout time.Duration) protocol.Result {
+	t.Helper()
+	result, err := s.WaitForResult(id, timeout)
+	if err != nil {
+		t.Fatalf("c2test: %s", err.Error())
+	}
+	return result
+}
+
+// RequireResultStatus fails the test unless a result for the given link ID with the given status is received
+// within the timeout.
+func (s *Server) RequireResultStatus(t testing.TB, id string, status string, timeout time.Duration) protocol.Result {
+	t.Helper()
+	result := s.RequireResult(t, id, timeout)
+	if result.Status != status {
+		t.Fatalf("c2test: link %s finished with status %s, expected %s. Output: %s", id, result.Status, status, string(result.Output))
+	}
+	return result
+}
+
+// RequireUpload fails the test unless a file with the given name is uploaded within the timeout.
+func (s *Server) RequireUpload(t testing.TB, name string, timeout time.Duration) Upload {
+	t.Helper()
+	upload, err := s.WaitForUpload(name, timeout)
+	if err != nil {
+		t.Fatalf("c2test: %s", err.Error())
+	}
+	return upload
+}
@@ -0,0 +1,200 @@
+package c2test
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dnsResponseChunkSize = 180
+
+var (
+	dnsChunkAck      = net.IPv4(10, 0, 0, 1)
+	dnsMessageAck    = net.IPv4(10, 0, 0, 2)
+	dnsLabelEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Message exchanged with agents using the DNS contact.
+type dnsMessage struct {
+	Name     string `json:"name,omitempty"`
+	Paw      string `json:"paw,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// A message being reassembled from its chunks, and the server's response once it is complete.
+type dnsTransfer struct {
+	chunks   map[int][]byte
+	total    int
+	response []byte
+}
+
+// StartDNS starts an authoritative DNS server for domain on a local UDP port, answering the DNS contact's queries
+// the same way the HTTP endpoints answer requests. Returns the address agents should use as their DNS server.
+// The DNS server is shut down by Close.
+func (s *Server) StartDNS(domain string) (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	started := make(chan struct{})
+	dnsServer := &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(s.handleDNS),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	s.mu.Lock()
+	s.dnsServer = dnsServer
+	s.dnsDomain = dns.Fqdn(strings.ToLower(strings.Trim(domain, ".")))
+	s.mu.Unlock()
+	go dnsServer.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), nil
+}
+
+// DropDNSQueries makes the DNS server silently ignore the next count queries, forcing the agent to retransmit.
+func (s *Server) DropDNSQueries(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dnsDrops = count
+}
+
+func (s *Server) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dnsDrops > 0 {
+		s.dnsDrops--
+		return
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	reply.Authoritative = true
+	if len(r.Question) != 1 {
+		reply.Rcode = dns.RcodeFormatError
+	} else if !s.available {
+		reply.Rcode = dns.RcodeRefused
+	} else if answer, err := s.answerDNS(r.Question[0]); err != nil {
+		reply.Rcode = dns.RcodeNameError
+	} else {
+		reply.Answer = []dns.RR{answer}
+	}
+	w.WriteMsg(reply)
+}
+
+func (s *Server) answerDNS(question dns.Question) (dns.RR, error) {
+	name := strings.ToLower(question.Name)
+	if !strings.HasSuffix(name, "."+s.dnsDomain) {
+		return nil, fmt.Errorf("%s is outside of %s", name, s.dnsDomain)
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."+s.dnsDomain), ".")
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET}
+	switch {
+	case question.Qtype == dns.TypeA && len(labels) >= 4:
+		ack, err := s.receiveDNSChunk(labels)
+		return &dns.A{Hdr: header, A: ack}, err
+	case question.Qtype == dns.TypeTXT && len(labels) == 3 && labels[1] == "rx":
+		txt, err := s.sendDNSChunk(labels[0], labels[2])
+		return &dns.TXT{Hdr: header, Txt: txt}, err
+	}
+	return nil, fmt.Errorf("unsupported query %s", name)
+}
+
+// Stores a chunk from an A query named <id>.<type>.<seq>.<total>.<data labels>, processing the message once all
+// of its chunks have arrived.
+func (s *Server) receiveDNSChunk(labels []string) (net.IP, error) {
+	id, msgType := labels[0], labels[1]
+	seq, err := strconv.Atoi(labels[2])
+	if err != nil {
+		return nil, err
+	}
+	total, err := strconv.Atoi(labels[3])
+	if err != nil {
+		return nil, err
+	}
+	if seq < 0 || seq >= total {
+		return nil, fmt.Errorf("chunk %d out of range for message %s", seq, id)
+	}
+	chunk, err := dnsLabelEncoding.DecodeString(strings.ToUpper(strings.Join(labels[4:], "")))
+	if err != nil {
+		return nil, err
+	}
+	transfer, ok := s.dnsTransfers[id]
+	if !ok {
+		transfer = &dnsTransfer{chunks: make(map[int][]byte), total: total}
+		s.dnsTransfers[id] = transfer
+	}
+	if transfer.response != nil {
+		return dnsMessageAck, nil
+	}
+	transfer.chunks[seq] = chunk
+	if len(transfer.chunks) < transfer.total {
+		return dnsChunkAck, nil
+	}
+	var data []byte
+	for i := 0; i < transfer.total; i++ {
+		data = append(data, transfer.chunks[i]...)
+	}
+	transfer.response = s.processDNSMessage(msgType, data)
+	return dnsMessageAck, nil
+}
+
+func (s *Server) processDNSMessage(msgType string, data []byte) []byte {
+	var msg, response dnsMessage
+	err := json.Unmarshal(data, &msg)
+	if err == nil {
+		switch msgType {
+		case "be", "re":
+			_, response.Data, err = s.processBeacon(msg.Data)
+		case "pl":
+			response.Name = msg.Name
+			response.Data, err = s.processDownload(msg.Name, msg.Encoding)
+		case "up":
+			err = s.processUpload(Upload{Paw: msg.Paw, Host: msg.Host, Name: msg.Name}, msg.Data, msg.Encoding)
+		default:
+			err = fmt.Errorf("unsupported message type %s", msgType)
+		}
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		panic(fmt.Sprintf("c2test: cannot marshal DNS response: %s", err.Error()))
+	}
+	return encoded
+}
+
+// Returns the TXT strings for a chunk of the response to a completed message: the total number of chunks, then
+// the base64-encoded chunk.
+func (s *Server) sendDNSChunk(id string, seqLabel string) ([]string, error) {
+	transfer, ok := s.dnsTransfers[id]
+	if !ok || transfer.response == nil {
+		return nil, fmt.Errorf("no response ready for message %s", id)
+	}
+	seq, err := strconv.Atoi(seqLabel)
+	if err != nil {
+		return nil, err
+	}
+	total := (len(transfer.response) + dnsResponseChunkSize - 1) / dnsResponseChunkSize
+	if total == 0 {
+		total = 1
+	}
+	if seq < 0 || seq >= total {
+		return nil, fmt.Errorf("response chunk %d out of range for message %s", seq, id)
+	}
+	start := seq * dnsResponseChunkSize
+	end := start + dnsResponseChunkSize
+	if end > len(transfer.response) {
+		end = len(transfer.response)
+	}
+	return []string{strconv.Itoa(total), base64.StdEncoding.EncodeToString(transfer.response[start:end])}, nil
+}
@@ -0,0 +1,568 @@
+// Package c2test provides an in-process C2 server that speaks the same /beacon, /file/download and /file/upload
+// protocol as the HTTP contact, as well as the WebSocket, DNS, TCP and UDP contact protocols, so that agents can
+// be exercised end-to-end without a real C2 server.
+package c2test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/websocket"
+
+	"github.com/mitre/gocat/encoders"
+	"github.com/mitre/gocat/protocol"
+)
+
+const (
+	DefaultPaw            = "c2testpaw"
+	DefaultSleep          = 1
+	DefaultBeaconEncoders = "base64"
+	fileEncodingHeader    = "x-file-encoding"
+)
+
+// Upload records a file received on /file/upload.
+type Upload struct {
+	Paw  string
+	Host string
+	Name string
+	Data []byte
+}
+
+// Server is a scriptable mock C2 server. Instructions queued on the server are handed out on the next beacon,
+// and every beacon, result and upload received is recorded for later inspection.
+type Server struct {
+	httpServer *httptest.Server
+
+	mu             sync.Mutex
+	changed        *sync.Cond
+	paw            string
+	sleep          int
+	watchdog       int
+	available      bool
+	newContact     string
+	executorChange *protocol.ExecutorChange
+	beaconEncoders encoders.Chain
+	encoderConfig  map[string]interface{}
+	encoderChange  map[string][]string
+	clientCert     *protocol.ClientCertificate
+	p2pKey         string
+	beaconTiming   map[string]interface{}
+	cancelLinks    []string
+	wsConns        map[*websocket.Conn]string // connected WebSocket agents and their paws
+	wsWriteMu      sync.Mutex
+	dnsServer      *dns.Server
+	dnsDomain      string
+	dnsTransfers   map[string]*dnsTransfer // DNS messages by message ID
+	dnsDrops       int
+	tcpListener    net.Listener
+	tcpConns       map[net.Conn]string // connected TCP agents and their paws
+	udpTransport   *protocol.DatagramTransport
+	udpConn        *lossyPacketConn
+	udpPaws        map[string]string // paws of UDP agents by address
+	instructions   []string
+	payloads       map[string][]byte
+	beacons        []protocol.Profile
+	results        []protocol.Result
+	uploads        []Upload
+	downloads      []string
+}
+
+// NewServer starts a mock C2 server listening on a local port. The caller must call Close when finished.
+func NewServer() *Server {
+	return newServer(httptest.NewServer)
+}
+
+// NewTLSServer starts a mock C2 server that serves HTTPS with a self-signed certificate.
+func NewTLSServer() *Server {
+	return newServer(httptest.NewTLSServer)
+}
+
+// NewMutualTLSServer starts a mock C2 server that serves HTTPS and authenticates client certificates issued by
+// clientCAs according to clientAuth.
+func NewMutualTLSServer(clientCAs *x509.CertPool, clientAuth tls.ClientAuthType) *Server {
+	return newServer(func(handler http.Handler) *httptest.Server {
+		httpServer := httptest.NewUnstartedServer(handler)
+		httpServer.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: clientAuth}
+		httpServer.StartTLS()
+		return httpServer
+	})
+}
+
+func newServer(start func(handler http.Handler) *httptest.Server) *Server {
+	beaconEncoders, err := encoders.ParseChain(DefaultBeaconEncoders)
+	if err != nil {
+		panic(fmt.Sprintf("c2test: %s", err.Error()))
+	}
+	s := &Server{
+		beaconEncoders: beaconEncoders,
+		encoderConfig:  map[string]interface{}{},
+		paw:            DefaultPaw,
+		sleep:          DefaultSleep,
+		available:      true,
+		payloads:       make(map[string][]byte),
+		wsConns:        make(map[*websocket.Conn]string),
+		dnsTransfers:   make(map[string]*dnsTransfer),
+		tcpConns:       make(map[net.Conn]string),
+		udpPaws:        make(map[string]string),
+	}
+	s.changed = sync.NewCond(&s.mu)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/beacon", s.handleBeacon)
+	mux.HandleFunc("/file/download", s.handleDownload)
+	mux.HandleFunc("/file/upload", s.handleUpload)
+	mux.Handle("/websocket", websocket.Handler(s.handleWebSocket))
+	s.httpServer = start(mux)
+	return s
+}
+
+// URL returns the base address agents should use as their server.
+func (s *Server) URL() string {
+	return s.httpServer.URL
+}
+
+// Certificate returns the server's TLS certificate, or nil if the server does not use TLS.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.httpServer.Certificate()
+}
+
+func (s *Server) Close() {
+	s.httpServer.Close()
+	s.mu.Lock()
+	dnsServer := s.dnsServer
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+		for conn := range s.tcpConns {
+			conn.Close()
+		}
+	}
+	udpTransport := s.udpTransport
+	s.mu.Unlock()
+	if udpTransport != nil {
+		udpTransport.Close()
+	}
+	if dnsServer != nil {
+		dnsServer.Shutdown()
+	}
+}
+
+// SetPaw sets the paw assigned to agents that beacon without one.
+func (s *Server) SetPaw(paw string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paw = paw
+}
+
+// SetSleep sets the sleep and watchdog values returned in beacon responses.
+func (s *Server) SetSleep(sleep int, watchdog int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sleep = sleep
+	s.watchdog = watchdog
+}
+
+// SetAvailable toggles whether the server answers beacons. An unavailable server responds with HTTP 503.
+func (s *Server) SetAvailable(available bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.available = available
+}
+
+// SetNewContact asks the agent to switch to the given C2 channel on its next beacon.
+func (s *Server) SetNewContact(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.newContact = channel
+}
+
+// SetExecutorChange sends the given executor change on the next beacon.
+func (s *Server) SetExecutorChange(change protocol.ExecutorChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.executorChange = &change
+}
+
+// SetBeaconEncoders sets the data encoder chain the server uses for /beacon traffic, without telling the agent.
+func (s *Server) SetBeaconEncoders(encoderNames ...string) error {
+	chain, err := encoders.NewChain(encoderNames)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beaconEncoders = chain
+	return nil
+}
+
+// SetKey sets the C2 key used by keyed data encoders such as aes-gcm.
+func (s *Server) SetKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoderConfig = map[string]interface{}{"key": key}
+}
+
+// SetEncoderChange asks the agent to switch data encoder chains on its next beacon. The server switches its own
+// beacon chain once that beacon has been answered. Either list may be empty to leave that chain unchanged.
+func (s *Server) SetEncoderChange(beaconEncoders []string, fileEncoders []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoderChange = map[string][]string{
+		"beacon_encoders": beaconEncoders,
+		"file_encoders":   fileEncoders,
+	}
+}
+
+// SetClientCertificate delivers the given PEM-encoded TLS client certificate and key on the next beacon.
+func (s *Server) SetClientCertificate(certPem string, keyPem string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientCert = &protocol.ClientCertificate{Certificate: certPem, Key: keyPem}
+}
+
+// SetP2pKey delivers the given peer-to-peer group key on every subsequent beacon.
+func (s *Server) SetP2pKey(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.p2pKey = key
+}
+
+// SetBeaconTiming sends the given jitter percentage, backoff cap in seconds and beacon schedule on the next beacon.
+func (s *Server) SetBeaconTiming(jitter int, maxSleep int, schedule string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.beaconTiming = map[string]interface{}{
+		"jitter":    jitter,
+		"max_sleep": maxSleep,
+		"schedule":  schedule,
+	}
+}
+
+// CancelLinks asks the agent to cancel the queued or running instructions with the given IDs on the next beacon.
+func (s *Server) CancelLinks(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelLinks = append(s.cancelLinks, ids...)
+}
+
+// QueueInstruction adds an instruction to be delivered on the next beacon.
+func (s *Server) QueueInstruction(instruction protocol.Instruction) {
+	marshaled, err := json.Marshal(instruction)
+	if err != nil {
+		panic(fmt.Sprintf("c2test: cannot marshal instruction: %s", err.Error()))
+	}
+	s.QueueRawInstruction(string(marshaled))
+}
+
+// QueueRawInstruction adds an instruction in its marshaled JSON form, allowing malformed instructions to be sent.
+func (s *Server) QueueRawInstruction(marshaled string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instructions = append(s.instructions, marshaled)
+}
+
+// AddPayload makes the given payload available on /file/download.
+func (s *Server) AddPayload(name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads[name] = data
+}
+
+// Beacons returns the profiles of all beacons received so far, excluding result submissions.
+func (s *Server) Beacons() []protocol.Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Profile(nil), s.beacons...)
+}
+
+// Results returns all execution results received so far.
+func (s *Server) Results() []protocol.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Result(nil), s.results...)
+}
+
+// Uploads returns all files uploaded so far.
+func (s *Server) Uploads() []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Upload(nil), s.uploads...)
+}
+
+// Downloads returns the names of all payloads requested so far.
+func (s *Server) Downloads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.downloads...)
+}
+
+// WaitForBeacons blocks until at least count beacons have been received or the timeout expires.
+func (s *Server) WaitForBeacons(count int, timeout time.Duration) ([]protocol.Profile, error) {
+	err := s.waitFor(timeout, func() bool { return len(s.beacons) >= count })
+	if err != nil {
+		return s.Beacons(), fmt.Errorf("received %d of %d beacons: %s", len(s.Beacons()), count, err.Error())
+	}
+	return s.Beacons(), nil
+}
+
+// WaitForResult blocks until a result for the given link ID has been received or the timeout expires.
+func (s *Server) WaitForResult(id string, timeout time.Duration) (protocol.Result, error) {
+	var found protocol.Result
+	err := s.waitFor(timeout, func() bool {
+		for _, result := range s.results {
+			if result.ID == id {
+				found = result
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return found, fmt.Errorf("no result for link %s: %s", id, err.Error())
+	}
+	return found, nil
+}
+
+// WaitForUpload blocks until a file with the given name has been uploaded or the timeout expires.
+func (s *Server) WaitForUpload(name string, timeout time.Duration) (Upload, error) {
+	var found Upload
+	err := s.waitFor(timeout, func() bool {
+		for _, upload := range s.uploads {
+			if upload.Name == name {
+				found = upload
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return found, fmt.Errorf("no upload named %s: %s", name, err.Error())
+	}
+	return found, nil
+}
+
+// Waits until cond, evaluated with the server lock held, returns true.
+func (s *Server) waitFor(timeout time.Duration, cond func() bool) error {
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.changed.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !cond() {
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		s.changed.Wait()
+	}
+	return nil
+}
+
+func (s *Server) handleBeacon(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.available {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	_, encoded, err := s.processBeacon(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(encoded)
+}
+
+// Decodes and records a beacon or result submission, and returns the agent profile and the encoded beacon
+// response. Must be called with the server lock held.
+func (s *Server) processBeacon(body []byte) (protocol.Profile, []byte, error) {
+	var profile protocol.Profile
+	responseEncoders := s.beaconEncoders
+	decoded, err := responseEncoders.DecodeData(body, s.encoderConfig)
+	if err != nil {
+		return profile, nil, err
+	}
+	if err = json.Unmarshal(decoded, &profile); err != nil {
+		return profile, nil, err
+	}
+	var response map[string]interface{}
+	if len(profile.Results) > 0 {
+		s.results = append(s.results, profile.Results...)
+		response = s.newBeaconResponse(profile.Paw)
+	} else {
+		s.beacons = append(s.beacons, profile)
+		if response, err = s.takeBeaconResponse(profile.Paw); err != nil {
+			return profile, nil, err
+		}
+	}
+	s.changed.Broadcast()
+	encoded, err := encodeBeaconResponse(response, responseEncoders, s.encoderConfig)
+	return profile, encoded, err
+}
+
+func encodeBeaconResponse(response map[string]interface{}, chain encoders.Chain, config map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	return chain.EncodeData(data, config)
+}
+
+// Returns a beacon response without instructions or directives. Must be called with the server lock held.
+func (s *Server) newBeaconResponse(paw string) map[string]interface{} {
+	if len(paw) == 0 {
+		paw = s.paw
+	}
+	return map[string]interface{}{
+		"paw":          paw,
+		"sleep":        s.sleep,
+		"watchdog":     s.watchdog,
+		"instructions": "[]",
+	}
+}
+
+// Returns a beacon response carrying all queued instructions and directives, and clears them from the queue.
+// Must be called with the server lock held.
+func (s *Server) takeBeaconResponse(paw string) (map[string]interface{}, error) {
+	response := s.newBeaconResponse(paw)
+	instructions, err := json.Marshal(s.instructions)
+	if err != nil {
+		return nil, err
+	}
+	s.instructions = nil
+	response["instructions"] = string(instructions)
+	if len(s.newContact) > 0 {
+		response["new_contact"] = s.newContact
+		s.newContact = ""
+	}
+	if s.executorChange != nil {
+		response["executor_change"] = s.executorChange
+		s.executorChange = nil
+	}
+	if s.clientCert != nil {
+		response["client_certificate"] = s.clientCert
+		s.clientCert = nil
+	}
+	if len(s.p2pKey) > 0 {
+		response["p2p_key"] = s.p2pKey
+	}
+	if len(s.cancelLinks) > 0 {
+		response["cancel_link"] = s.cancelLinks
+		s.cancelLinks = nil
+	}
+	for field, value := range s.beaconTiming {
+		response[field] = value
+	}
+	s.beaconTiming = nil
+	if s.encoderChange != nil {
+		if err = s.applyEncoderChange(response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// Adds the pending encoder change to the beacon response and switches the server's own beacon chain.
+// Must be called with the server lock held.
+func (s *Server) applyEncoderChange(response map[string]interface{}) error {
+	for field, encoderNames := range s.encoderChange {
+		if len(encoderNames) > 0 {
+			response[field] = encoderNames
+		}
+	}
+	if beaconEncoders := s.encoderChange["beacon_encoders"]; len(beaconEncoders) > 0 {
+		chain, err := encoders.NewChain(beaconEncoders)
+		if err != nil {
+			return err
+		}
+		s.beaconEncoders = chain
+	}
+	s.encoderChange = nil
+	return nil
+}
+
+// Returns the file transfer encoder chain requested by the agent.
+func getFileEncoders(chainSpec string) (encoders.Chain, error) {
+	if len(chainSpec) == 0 {
+		chainSpec = "plain-text"
+	}
+	return encoders.ParseChain(chainSpec)
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get("file")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	encoded, err := s.processDownload(name, r.Header.Get(fileEncodingHeader))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	w.Header().Set("Filename", name)
+	w.Write(encoded)
+}
+
+// Records a payload request and returns the encoded payload. Must be called with the server lock held.
+func (s *Server) processDownload(name string, fileEncoding string) ([]byte, error) {
+	s.downloads = append(s.downloads, name)
+	s.changed.Broadcast()
+	data, ok := s.payloads[name]
+	if !ok {
+		return nil, fmt.Errorf("payload %s not found", name)
+	}
+	fileEncoders, err := getFileEncoders(fileEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return fileEncoders.EncodeData(data, s.encoderConfig)
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	encoded, err := ioutil.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload := Upload{Paw: r.Header.Get("X-Paw"), Host: r.Header.Get("X-Host"), Name: header.Filename}
+	if err = s.processUpload(upload, encoded, r.Header.Get(fileEncodingHeader)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// Decodes and records an uploaded file. Must be called with the server lock held.
+func (s *Server) processUpload(upload Upload, encoded []byte, fileEncoding string) error {
+	fileEncoders, err := getFileEncoders(fileEncoding)
+	if err != nil {
+		return err
+	}
+	if upload.Data, err = fileEncoders.DecodeData(encoded, s.encoderConfig); err != nil {
+		return err
+	}
+	s.uploads = append(s.uploads, upload)
+	s.changed.Broadcast()
+	return nil
+}
@@ -0,0 +1,97 @@
+package c2test
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// StartTCP starts listening for agents using the TCP contact on a local port, and returns the address agents
+// should use as their TCP address. The listener is shut down by Close.
+func (s *Server) StartTCP() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.tcpListener = listener
+	s.mu.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleTCP(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// DropTCPConnections closes every connection from agents using the TCP contact, forcing them to reconnect.
+func (s *Server) DropTCPConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.tcpConns {
+		conn.Close()
+	}
+}
+
+// Answers frames from a single TCP agent until the connection closes.
+func (s *Server) handleTCP(conn net.Conn) {
+	s.mu.Lock()
+	s.tcpConns[conn] = ""
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.tcpConns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if err = protocol.WriteFrame(conn, s.processTCPFrame(conn, frame)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) processTCPFrame(conn net.Conn, frame protocol.Frame) protocol.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := protocol.Frame{Type: frame.Type, ID: frame.ID}
+	if !s.available {
+		return errorFrame(response, fmt.Errorf("unavailable"))
+	}
+	var err error
+	switch frame.Type {
+	case protocol.FrameBeacon, protocol.FrameResults:
+		var profile protocol.Profile
+		if profile, response.Data, err = s.processBeacon(frame.Data); err == nil && len(profile.Paw) > 0 {
+			s.tcpConns[conn] = profile.Paw
+		}
+	case protocol.FramePayload:
+		response.Name = frame.Name
+		response.Data, err = s.processDownload(frame.Name, frame.Encoding)
+	case protocol.FrameUpload:
+		err = s.processUpload(Upload{Paw: s.tcpConns[conn], Name: frame.Name}, frame.Data, frame.Encoding)
+	case protocol.FrameKeepalive:
+	default:
+		err = fmt.Errorf("unsupported frame type %d", frame.Type)
+	}
+	if err != nil {
+		return errorFrame(response, err)
+	}
+	return response
+}
+
+func errorFrame(response protocol.Frame, err error) protocol.Frame {
+	response.Status = protocol.FrameError
+	response.Name = ""
+	response.Data = []byte(err.Error())
+	return response
+}
@@ -0,0 +1,116 @@
+package c2test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// Packet connection that drops a share of the datagrams it receives, to exercise the UDP reliability layer.
+type lossyPacketConn struct {
+	net.PacketConn
+	mu       sync.Mutex
+	dropEach int
+	received int
+}
+
+func (c *lossyPacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return n, addr, err
+		}
+		c.mu.Lock()
+		c.received++
+		drop := c.dropEach > 0 && c.received%c.dropEach == 0
+		c.mu.Unlock()
+		if !drop {
+			return n, addr, err
+		}
+	}
+}
+
+// StartUDP starts listening for agents using the UDP contact on a local port with the given datagram MTU and
+// window, and returns the address agents should use as their UDP address. The listener is shut down by Close.
+func (s *Server) StartUDP(mtu int, window int) (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	lossyConn := &lossyPacketConn{PacketConn: conn}
+	transport, err := protocol.NewDatagramTransport(lossyConn, mtu, window)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	s.mu.Lock()
+	s.udpTransport = transport
+	s.udpConn = lossyConn
+	s.mu.Unlock()
+	go func() {
+		for {
+			msg, err := transport.Receive()
+			if err != nil {
+				return
+			}
+			go s.handleUDP(transport, msg)
+		}
+	}()
+	return conn.LocalAddr().String(), nil
+}
+
+// SetUDPLoss makes the UDP listener drop every dropEach-th datagram it receives. Zero disables dropping.
+func (s *Server) SetUDPLoss(dropEach int) {
+	s.mu.Lock()
+	conn := s.udpConn
+	s.mu.Unlock()
+	if conn != nil {
+		conn.mu.Lock()
+		conn.dropEach = dropEach
+		conn.mu.Unlock()
+	}
+}
+
+func (s *Server) handleUDP(transport *protocol.DatagramTransport, msg protocol.DatagramMessage) {
+	frame, err := protocol.ReadFrame(bytes.NewReader(msg.Data))
+	if err != nil {
+		return
+	}
+	response := s.processUDPFrame(msg.Addr, frame)
+	var buf bytes.Buffer
+	if err = protocol.WriteFrame(&buf, response); err != nil {
+		return
+	}
+	transport.Send(msg.Addr, msg.ID, buf.Bytes())
+}
+
+func (s *Server) processUDPFrame(addr net.Addr, frame protocol.Frame) protocol.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := protocol.Frame{Type: frame.Type, ID: frame.ID}
+	if !s.available {
+		return errorFrame(response, fmt.Errorf("unavailable"))
+	}
+	var err error
+	switch frame.Type {
+	case protocol.FrameBeacon, protocol.FrameResults:
+		var profile protocol.Profile
+		if profile, response.Data, err = s.processBeacon(frame.Data); err == nil && len(profile.Paw) > 0 {
+			s.udpPaws[addr.String()] = profile.Paw
+		}
+	case protocol.FramePayload:
+		response.Name = frame.Name
+		response.Data, err = s.processDownload(frame.Name, frame.Encoding)
+	case protocol.FrameUpload:
+		err = s.processUpload(Upload{Paw: s.udpPaws[addr.String()], Name: frame.Name}, frame.Data, frame.Encoding)
+	default:
+		err = fmt.Errorf("unsupported frame type %d", frame.Type)
+	}
+	if err != nil {
+		return errorFrame(response, err)
+	}
+	return response
+}
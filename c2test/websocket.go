@@ -0,0 +1,105 @@
+package c2test
+
+import (
+	"fmt"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// Message exchanged with agents using the WebSocket contact.
+type wsMessage struct {
+	ID       uint64 `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Push sends all queued instructions and directives to every agent connected over WebSocket right away,
+// instead of waiting for their next beacon. Returns the number of agents pushed to.
+func (s *Server) Push() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.wsConns) == 0 {
+		return 0, nil
+	}
+	responseEncoders := s.beaconEncoders
+	response, err := s.takeBeaconResponse("")
+	if err != nil {
+		return 0, err
+	}
+	pushed := 0
+	for conn, paw := range s.wsConns {
+		response["paw"] = s.newBeaconResponse(paw)["paw"]
+		encoded, err := encodeBeaconResponse(response, responseEncoders, s.encoderConfig)
+		if err != nil {
+			return pushed, err
+		}
+		if err = s.sendWebSocket(conn, wsMessage{Type: "push", Data: encoded}); err != nil {
+			return pushed, err
+		}
+		pushed++
+	}
+	return pushed, nil
+}
+
+// Answers requests from a single WebSocket agent until the connection closes.
+func (s *Server) handleWebSocket(conn *websocket.Conn) {
+	s.mu.Lock()
+	s.wsConns[conn] = ""
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.wsConns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		if err := s.sendWebSocket(conn, s.processWebSocketMessage(conn, msg)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) processWebSocketMessage(conn *websocket.Conn, msg wsMessage) wsMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	response := wsMessage{ID: msg.ID, Type: msg.Type}
+	if !s.available {
+		response.Error = "unavailable"
+		return response
+	}
+	var err error
+	switch msg.Type {
+	case "beacon", "results":
+		var profile protocol.Profile
+		if profile, response.Data, err = s.processBeacon(msg.Data); err == nil && len(profile.Paw) > 0 {
+			s.wsConns[conn] = profile.Paw
+		}
+	case "payload":
+		response.Name = msg.Name
+		response.Data, err = s.processDownload(msg.Name, msg.Encoding)
+	case "upload":
+		err = s.processUpload(Upload{Paw: s.wsConns[conn], Name: msg.Name}, msg.Data, msg.Encoding)
+	case "keepalive":
+	default:
+		err = fmt.Errorf("unsupported message type %s", msg.Type)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response
+}
+
+func (s *Server) sendWebSocket(conn *websocket.Conn, msg wsMessage) error {
+	s.wsWriteMu.Lock()
+	defer s.wsWriteMu.Unlock()
+	return websocket.JSON.Send(conn, msg)
+}
@@ -0,0 +1,352 @@
+// Package config holds the agent configuration, which can be embedded in the agent at link time as a versioned,
+// signed and compressed blob.
+//
+// The blob is the base64 encoding of
+//
+//	version (1 byte) | Ed25519 signature (64 bytes) | gzip-compressed JSON of Config
+//
+// where the signature covers the version byte and the compressed JSON, and must verify against the public key
+// linked into configPublicKey.
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const blobVersion byte = 1
+
+// Upper bound on the decompressed configuration, to guard against decompression bombs.
+const maxConfigSize = 16 * 1024 * 1024
+
+/*
+These values can be overridden during linking.
+*/
+var (
+	embeddedConfig  = "" // base64-encoded configuration blob
+	configPublicKey = "" // base64-encoded Ed25519 public key the blob is signed with
+)
+
+// Config is the agent's typed configuration.
+type Config struct {
+	Servers      []Server            `json:"servers,omitempty"` // C2 servers in order of preference
+	Group        string              `json:"group,omitempty"`
+	Paw          string              `json:"paw,omitempty"`
+	Contacts     map[string]string   `json:"contacts,omitempty"` // contact settings, e.g. c2Name, c2Key and tlsPins
+	Peers        map[string][]string `json:"peers,omitempty"`    // peer proxy receiver addresses by proxy protocol
+	ListenP2P    bool                `json:"listen_p2p,omitempty"`
+	Sleep        int                 `json:"sleep,omitempty"`     // seconds between beacons until the server sets a sleep
+	Jitter       int                 `json:"jitter,omitempty"`    // percentage by which sleeps are randomly varied
+	MaxSleep     int                 `json:"max_sleep,omitempty"` // cap in seconds on the backoff after failed beacons
+	Schedule     string              `json:"schedule,omitempty"`  // times the agent beacons, e.g. Mon-Fri 08:00-18:00 UTC
+	Tunnel       Tunnel              `json:"tunnel"`
+	Scope        Scope               `json:"scope"`
+	MaxJobs      int                 `json:"max_jobs,omitempty"`       // instructions that run at the same time
+	JobQueueSize int                 `json:"job_queue_size,omitempty"` // instructions that wait for a free job slot
+	KillDate     string              `json:"kill_date,omitempty"`      // RFC 3339 time after which the agent exits
+	MaxRuntime   string              `json:"max_runtime,omitempty"`    // duration after which the agent exits, e.g. 72h
+	Delay        int                 `json:"delay,omitempty"`          // seconds to wait before the first beacon
+	OriginLinkID string              `json:"origin_link_id,omitempty"`
+
+	set map[string]bool // keys present in the decoded JSON, so that settings set to zero values are told apart
+}
+
+// Server is a C2 server endpoint. Contact and Proxy override the c2Name and httpProxyGateway contact settings.
+type Server struct {
+	Address string `json:"address"`
+	Contact string `json:"contact,omitempty"`
+	Proxy   string `json:"proxy,omitempty"`
+}
+
+// Tunnel holds the settings of the C2 comms tunnel.
+type Tunnel struct {
+	Protocol string `json:"protocol,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Scope is the engagement scope the agent enforces on instructions. Empty lists impose no restriction.
+type Scope struct {
+	AllowedHosts    []string `json:"allowed_hosts,omitempty"`    // hostnames, IPs or CIDRs the agent may run on
+	BlockedCommands []string `json:"blocked_commands,omitempty"` // regular expressions of commands that are refused
+	BlockedPaths    []string `json:"blocked_paths,omitempty"`    // paths that may not be uploaded or deleted
+}
+
+// Embedded returns the configuration linked into the agent, or nil if there is none.
+func Embedded() (*Config, error) {
+	if len(embeddedConfig) == 0 {
+		return nil, nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(configPublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("Embedded configuration requires a valid Ed25519 public key.")
+	}
+	return Decode(embeddedConfig, ed25519.PublicKey(publicKey))
+}
+
+// Decode verifies and parses a configuration blob.
+func Decode(blob string, publicKey ed25519.PublicKey) (*Config, error) {
+	data, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := 1 + ed25519.SignatureSize
+	if len(data) < headerSize {
+		return nil, errors.New("Configuration blob too short.")
+	}
+	if data[0] != blobVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported configuration blob version %d", data[0]))
+	}
+	signed := append([]byte{data[0]}, data[headerSize:]...)
+	if !ed25519.Verify(publicKey, signed, data[1:headerSize]) {
+		return nil, errors.New("Configuration blob signature is invalid.")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data[headerSize:]))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	marshaled, err := ioutil.ReadAll(io.LimitReader(reader, maxConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(marshaled) > maxConfigSize {
+		return nil, errors.New("Configuration exceeds the maximum size.")
+	}
+	return parseConfig(marshaled, false)
+}
+
+// Parses the JSON of a configuration and records which settings it contains. Unknown fields are rejected if strict
+// is set.
+func parseConfig(marshaled []byte, strict bool) (*Config, error) {
+	decoder := json.NewDecoder(bytes.NewReader(marshaled))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	var config Config
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(marshaled, &fields); err != nil {
+		return nil, err
+	}
+	config.set = make(map[string]bool)
+	for key, value := range fields {
+		config.set[key] = true
+		if key != "tunnel" && key != "scope" {
+			continue
+		}
+		var nestedFields map[string]json.RawMessage
+		if err := json.Unmarshal(value, &nestedFields); err != nil {
+			return nil, err
+		}
+		for nestedKey := range nestedFields {
+			config.set[key+"."+nestedKey] = true
+		}
+	}
+	return &config, nil
+}
+
+// Returns true if the setting with the given JSON key, e.g. sleep or scope.allowed_hosts, was present in the
+// decoded configuration. Settings of configurations that were not decoded count as set if they are not zero.
+func (c *Config) isSet(key string, nonZero bool) bool {
+	if c.set == nil {
+		return nonZero
+	}
+	return c.set[key]
+}
+
+// Returns the settings that are omitted from the JSON when they have zero values, by JSON key.
+func (c *Config) omittableSettings() map[string]interface{} {
+	return map[string]interface{}{
+		"group":                  c.Group,
+		"paw":                    c.Paw,
+		"listen_p2p":             c.ListenP2P,
+		"sleep":                  c.Sleep,
+		"jitter":                 c.Jitter,
+		"max_sleep":              c.MaxSleep,
+		"schedule":               c.Schedule,
+		"max_jobs":               c.MaxJobs,
+		"job_queue_size":         c.JobQueueSize,
+		"kill_date":              c.KillDate,
+		"max_runtime":            c.MaxRuntime,
+		"delay":                  c.Delay,
+		"origin_link_id":         c.OriginLinkID,
+		"tunnel.protocol":        c.Tunnel.Protocol,
+		"tunnel.addr":            c.Tunnel.Addr,
+		"tunnel.username":        c.Tunnel.Username,
+		"tunnel.password":        c.Tunnel.Password,
+		"scope.allowed_hosts":    c.Scope.AllowedHosts,
+		"scope.blocked_commands": c.Scope.BlockedCommands,
+		"scope.blocked_paths":    c.Scope.BlockedPaths,
+	}
+}
+
+// Marshals the configuration, keeping the settings of a decoded configuration that were explicitly set to zero
+// values.
+func (c *Config) marshal() ([]byte, error) {
+	marshaled, err := json.Marshal(c)
+	if err != nil || len(c.set) == 0 {
+		return marshaled, err
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(marshaled, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range c.omittableSettings() {
+		if !c.set[key] {
+			continue
+		}
+		if path := strings.SplitN(key, ".", 2); len(path) == 2 {
+			if nested, ok := fields[path[0]].(map[string]interface{}); ok {
+				nested[path[1]] = value
+			}
+		} else if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Encode compresses and signs the configuration into a blob that can be linked into the agent.
+func Encode(config *Config, privateKey ed25519.PrivateKey) (string, error) {
+	marshaled, err := config.marshal()
+	if err != nil {
+		return "", err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err = writer.Write(marshaled); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	signed := append([]byte{blobVersion}, compressed.Bytes()...)
+	signature := ed25519.Sign(privateKey, signed)
+	blob := append([]byte{blobVersion}, signature...)
+	blob = append(blob, compressed.Bytes()...)
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// Merge overrides the settings of the configuration with the settings that are set in other, including settings
+// that a decoded configuration sets to zero values. Contact settings and peers are merged key by key, and servers
+// are only overridden by a non-empty list.
+func (c *Config) Merge(other *Config) {
+	if len(other.Servers) > 0 {
+		c.Servers = other.Servers
+	}
+	if other.isSet("group", len(other.Group) > 0) {
+		c.Group = other.Group
+	}
+	if other.isSet("paw", len(other.Paw) > 0) {
+		c.Paw = other.Paw
+	}
+	for name, value := range other.Contacts {
+		if c.Contacts == nil {
+			c.Contacts = make(map[string]string)
+		}
+		c.Contacts[name] = value
+	}
+	for protocol, addresses := range other.Peers {
+		if c.Peers == nil {
+			c.Peers = make(map[string][]string)
+		}
+		c.Peers[protocol] = addresses
+	}
+	if other.isSet("listen_p2p", other.ListenP2P) {
+		c.ListenP2P = other.ListenP2P
+	}
+	if other.isSet("sleep", other.Sleep > 0) {
+		c.Sleep = other.Sleep
+	}
+	if other.isSet("jitter", other.Jitter > 0) {
+		c.Jitter = other.Jitter
+	}
+	if other.isSet("max_sleep", other.MaxSleep > 0) {
+		c.MaxSleep = other.MaxSleep
+	}
+	if other.isSet("schedule", len(other.Schedule) > 0) {
+		c.Schedule = other.Schedule
+	}
+	if other.set == nil {
+		if len(other.Tunnel.Protocol) > 0 {
+			c.Tunnel = other.Tunnel
+		}
+	} else {
+		c.mergeTunnel(other)
+	}
+	if other.isSet("scope.allowed_hosts", len(other.Scope.AllowedHosts) > 0) {
+		c.Scope.AllowedHosts = other.Scope.AllowedHosts
+	}
+	if other.isSet("scope.blocked_commands", len(other.Scope.BlockedCommands) > 0) {
+		c.Scope.BlockedCommands = other.Scope.BlockedCommands
+	}
+	if other.isSet("scope.blocked_paths", len(other.Scope.BlockedPaths) > 0) {
+		c.Scope.BlockedPaths = other.Scope.BlockedPaths
+	}
+	if other.isSet("max_jobs", other.MaxJobs > 0) {
+		c.MaxJobs = other.MaxJobs
+	}
+	if other.isSet("job_queue_size", other.JobQueueSize > 0) {
+		c.JobQueueSize = other.JobQueueSize
+	}
+	if other.isSet("kill_date", len(other.KillDate) > 0) {
+		c.KillDate = other.KillDate
+	}
+	if other.isSet("max_runtime", len(other.MaxRuntime) > 0) {
+		c.MaxRuntime = other.MaxRuntime
+	}
+	if other.isSet("delay", other.Delay > 0) {
+		c.Delay = other.Delay
+	}
+	if other.isSet("origin_link_id", len(other.OriginLinkID) > 0) {
+		c.OriginLinkID = other.OriginLinkID
+	}
+}
+
+// Merges the tunnel settings of a decoded configuration field by field.
+func (c *Config) mergeTunnel(other *Config) {
+	if other.set["tunnel.protocol"] {
+		c.Tunnel.Protocol = other.Tunnel.Protocol
+	}
+	if other.set["tunnel.addr"] {
+		c.Tunnel.Addr = other.Tunnel.Addr
+	}
+	if other.set["tunnel.username"] {
+		c.Tunnel.Username = other.Tunnel.Username
+	}
+	if other.set["tunnel.password"] {
+		c.Tunnel.Password = other.Tunnel.Password
+	}
+}
+
+// GetContactConfig returns a copy of the contact settings.
+func (c *Config) GetContactConfig() map[string]string {
+	return Server{}.ApplyTo(c.Contacts)
+}
+
+// ApplyTo returns a copy of the given contact settings with the server's contact and proxy applied.
+func (s Server) ApplyTo(contactConfig map[string]string) map[string]string {
+	serverConfig := make(map[string]string, len(contactConfig))
+	for name, value := range contactConfig {
+		serverConfig[name] = value
+	}
+	if len(s.Contact) > 0 {
+		serverConfig["c2Name"] = s.Contact
+	}
+	if len(s.Proxy) > 0 {
+		serverConfig["httpProxyGateway"] = s.Proxy
+	}
+	return serverConfig
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func newTestKeys(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey, privateKey
+}
+
+func newTestBlob(t *testing.T, privateKey ed25519.PrivateKey) string {
+	blob, err := Encode(&Config{
+		Servers:  []Server{{Address: "https://c2.example:443", Contact: "HTTP"}},
+		Group:    "blue",
+		Contacts: map[string]string{"c2Key": "secret"},
+		Scope:    Scope{AllowedHosts: []string{"10.0.0.0/8"}},
+	}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	publicKey, privateKey := newTestKeys(t)
+	config, err := Decode(newTestBlob(t, privateKey), publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 1 || config.Servers[0].Address != "https://c2.example:443" || config.Group != "blue" ||
+		config.Contacts["c2Key"] != "secret" || config.Scope.AllowedHosts[0] != "10.0.0.0/8" {
+		t.Errorf("unexpected decoded config: %+v", config)
+	}
+}
+
+func TestDecodeRejectsTamperedBlob(t *testing.T) {
+	publicKey, privateKey := newTestKeys(t)
+	data, err := base64.StdEncoding.DecodeString(newTestBlob(t, privateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit in the version, the signature and the compressed config in turn.
+	for _, offset := range []int{0, 1, 1 + ed25519.SignatureSize, len(data) - 1} {
+		tampered := append([]byte{}, data...)
+		tampered[offset] ^= 1
+		if _, err = Decode(base64.StdEncoding.EncodeToString(tampered), publicKey); err == nil {
+			t.Errorf("blob tampered at offset %d accepted", offset)
+		}
+	}
+	if _, err = Decode(base64.StdEncoding.EncodeToString(data[:ed25519.SignatureSize]), publicKey); err == nil {
+		t.Error("truncated blob accepted")
+	}
+}
+
+func TestDecodeRejectsOtherKey(t *testing.T) {
+	_, privateKey := newTestKeys(t)
+	otherPublicKey, _ := newTestKeys(t)
+	if _, err := Decode(newTestBlob(t, privateKey), otherPublicKey); err == nil {
+		t.Error("blob signed with another key accepted")
+	}
+}
+
+func TestMergeOverridesSetValues(t *testing.T) {
+	config := &Config{
+		Group:    "red",
+		Sleep:    60,
+		Contacts: map[string]string{"c2Name": "HTTP", "c2Key": "linked"},
+		Peers:    map[string][]string{"HTTP": {"http://peer:61889"}},
+	}
+	config.Merge(&Config{
+		Group:    "blue",
+		Contacts: map[string]string{"c2Key": "embedded"},
+		Peers:    map[string][]string{"TCP": {"peer:61890"}},
+	})
+	if config.Group != "blue" || config.Sleep != 60 {
+		t.Errorf("unexpected group %s and sleep %d", config.Group, config.Sleep)
+	}
+	if config.Contacts["c2Name"] != "HTTP" || config.Contacts["c2Key"] != "embedded" {
+		t.Errorf("contact settings not merged key by key: %v", config.Contacts)
+	}
+	if len(config.Peers) != 2 {
+		t.Errorf("peers not merged by protocol: %v", config.Peers)
+	}
+}
+
+func TestEncodeKeepsSettingsSetToZeroValues(t *testing.T) {
+	publicKey, privateKey := newTestKeys(t)
+	config, err := parseConfig([]byte(`{"group": "blue", "listen_p2p": false, "jitter": 0, "tunnel": {"addr": ""}}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := Encode(config, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(blob, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"group", "listen_p2p", "jitter", "tunnel.addr"} {
+		if !decoded.isSet(key, false) {
+			t.Errorf("setting %s lost in the blob", key)
+		}
+	}
+	if decoded.isSet("sleep", true) || decoded.isSet("tunnel.protocol", true) {
+		t.Error("settings missing from the config were added to the blob")
+	}
+}
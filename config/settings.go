@@ -0,0 +1,309 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables that override settings, e.g. SANDCAT_SERVER or SANDCAT_TLS_PINS.
+const envPrefix = "SANDCAT_"
+
+// Contact settings that can be set by name. The names match the keys of Config.Contacts.
+var contactSettings = []string{
+	"c2Key",
+	"httpProxyGateway",
+	"beaconEncoders",
+	"fileEncoders",
+	"tlsStrict",
+	"tlsPins",
+	"tlsCaCert",
+	"tlsCaFile",
+	"tlsClientCert",
+	"tlsClientKey",
+	"tlsClientCertFile",
+	"tlsClientKeyFile",
+	"dnsDomain",
+	"dnsServer",
+	"tcpAddr",
+	"udpAddr",
+	"udpMtu",
+	"udpWindow",
+}
+
+// Other settings that can be set by name. The names match the agent's command-line flags.
+var agentSettings = []string{
+	"server",
+	"servers",
+	"paw",
+	"group",
+	"c2",
+	"delay",
+	"sleep",
+	"jitter",
+	"maxSleep",
+	"schedule",
+	"killDate",
+	"maxRuntime",
+	"maxJobs",
+	"jobQueueSize",
+	"allowedHosts",
+	"blockedCommands",
+	"blockedPaths",
+	"listenP2P",
+	"originLinkID",
+	"tunnelProtocol",
+	"tunnelAddr",
+	"tunnelUser",
+	"tunnelPassword",
+}
+
+// Contact settings that are masked when the configuration is printed.
+var secretContactSettings = []string{"c2Key", "tlsClientKey"}
+
+// LoadFile reads a JSON configuration file, or a YAML one if its name ends in .yaml or .yml. YAML files use the same
+// keys as JSON ones. Unknown fields are rejected, so that typos do not go unnoticed.
+func LoadFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	extension := strings.ToLower(filepath.Ext(path))
+	if extension == ".yaml" || extension == ".yml" {
+		data, err = yamlToJSON(data)
+	}
+	var config *Config
+	if err == nil {
+		config, err = parseConfig(data, true)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing config file %s: %s", path, err.Error()))
+	}
+	return config, nil
+}
+
+// Converts a YAML document to JSON, so that it can be parsed like a JSON configuration.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return []byte("{}"), nil
+	}
+	converted, err := convertYAMLValue(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// Replaces the maps of a decoded YAML value, which can have keys of any type, with maps with string keys.
+func convertYAMLValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			name, ok := key.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("key %v is not a string", key))
+			}
+			var err error
+			if converted[name], err = convertYAMLValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, item := range value {
+			var err error
+			if converted[i], err = convertYAMLValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	default:
+		return value, nil
+	}
+}
+
+// Set changes the setting with the given name, which is the name of the matching command-line flag.
+func (c *Config) Set(name string, value string) error {
+	var err error
+	switch name {
+	case "server":
+		c.Servers = []Server{{Address: strings.TrimRight(value, "/")}}
+	case "servers":
+		c.Servers, err = ParseServers(value)
+	case "paw":
+		c.Paw = value
+	case "group":
+		c.Group = value
+	case "c2":
+		c.setContact("c2Name", value)
+	case "delay":
+		c.Delay, err = strconv.Atoi(value)
+	case "sleep":
+		if c.Sleep, err = strconv.Atoi(value); err == nil && c.Sleep < 0 {
+			err = errors.New("sleep must not be negative")
+		}
+	case "jitter":
+		if c.Jitter, err = strconv.Atoi(value); err == nil && (c.Jitter < 0 || c.Jitter > 100) {
+			err = errors.New("jitter must be a percentage between 0 and 100")
+		}
+	case "maxSleep":
+		if c.MaxSleep, err = strconv.Atoi(value); err == nil && c.MaxSleep < 0 {
+			err = errors.New("max sleep must not be negative")
+		}
+	case "schedule":
+		c.Schedule = value
+	case "killDate":
+		c.KillDate = value
+		if len(value) > 0 {
+			_, err = time.Parse(time.RFC3339, value)
+		}
+	case "maxJobs":
+		c.MaxJobs, err = strconv.Atoi(value)
+	case "jobQueueSize":
+		c.JobQueueSize, err = strconv.Atoi(value)
+	case "allowedHosts":
+		c.Scope.AllowedHosts = splitList(value)
+	case "blockedCommands":
+		c.Scope.BlockedCommands = splitList(value)
+	case "blockedPaths":
+		c.Scope.BlockedPaths = splitList(value)
+	case "maxRuntime":
+		c.MaxRuntime = value
+		if len(value) > 0 {
+			_, err = time.ParseDuration(value)
+		}
+	case "listenP2P":
+		c.ListenP2P, err = strconv.ParseBool(value)
+	case "originLinkID":
+		c.OriginLinkID = value
+	case "tunnelProtocol":
+		c.Tunnel.Protocol = value
+	case "tunnelAddr":
+		c.Tunnel.Addr = value
+	case "tunnelUser":
+		c.Tunnel.Username = value
+	case "tunnelPassword":
+		c.Tunnel.Password = value
+	default:
+		if !containsString(contactSettings, name) {
+			return errors.New(fmt.Sprintf("Unknown setting %s", name))
+		}
+		c.setContact(name, value)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid value %s for setting %s: %s", value, name, err.Error()))
+	}
+	return nil
+}
+
+// ParseServers parses a comma-separated list of C2 servers in order of preference. Each server takes the form
+// address[|contact[|proxy]], e.g. https://primary:443|HTTP,tcp-relay:7020|TCP.
+func ParseServers(value string) ([]Server, error) {
+	var servers []Server
+	for _, entry := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(entry), "|")
+		if len(fields) > 3 || len(fields[0]) == 0 {
+			return nil, errors.New(fmt.Sprintf("malformed server %s", entry))
+		}
+		server := Server{Address: strings.TrimRight(fields[0], "/")}
+		if len(fields) > 1 {
+			server.Contact = fields[1]
+		}
+		if len(fields) > 2 {
+			server.Proxy = fields[2]
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// ApplyEnvironment changes the settings for which a SANDCAT_* environment variable is set.
+func (c *Config) ApplyEnvironment() error {
+	for _, name := range append(append([]string{}, agentSettings...), contactSettings...) {
+		if value, ok := os.LookupEnv(EnvName(name)); ok {
+			if err := c.Set(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnvName returns the name of the environment variable for the given setting, e.g. SANDCAT_TLS_CLIENT_CERT_FILE
+// for tlsClientCertFile. Words start at each upper case letter that follows a lower case letter, or follows digits
+// that do, so that c2Key maps to SANDCAT_C2_KEY while listenP2P maps to SANDCAT_LISTEN_P2P.
+func EnvName(name string) string {
+	var envName strings.Builder
+	envName.WriteString(envPrefix)
+	var previous rune
+	afterLower := false // whether the previous letter, ignoring digits, is lower case
+	for i, r := range name {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous) && afterLower) {
+			envName.WriteRune('_')
+		}
+		if !unicode.IsDigit(r) {
+			afterLower = unicode.IsLower(r)
+		}
+		envName.WriteRune(unicode.ToUpper(r))
+		previous = r
+	}
+	return envName.String()
+}
+
+// Redacted returns a copy of the configuration with passwords and keys masked, for display.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Contacts = make(map[string]string, len(c.Contacts))
+	for name, value := range c.Contacts {
+		if len(value) > 0 && containsString(secretContactSettings, name) {
+			value = "********"
+		}
+		redacted.Contacts[name] = value
+	}
+	if len(redacted.Tunnel.Password) > 0 {
+		redacted.Tunnel.Password = "********"
+	}
+	return &redacted
+}
+
+func (c *Config) setContact(name string, value string) {
+	if c.Contacts == nil {
+		c.Contacts = make(map[string]string)
+	}
+	c.Contacts[name] = value
+}
+
+func containsString(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a comma-separated list, dropping empty elements.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); len(element) > 0 {
+			list = append(list, element)
+		}
+	}
+	return list
+}
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	expected := map[string]string{
+		"server":            "SANDCAT_SERVER",
+		"c2":                "SANDCAT_C2",
+		"c2Key":             "SANDCAT_C2_KEY",
+		"listenP2P":         "SANDCAT_LISTEN_P2P",
+		"originLinkID":      "SANDCAT_ORIGIN_LINK_ID",
+		"tlsClientCertFile": "SANDCAT_TLS_CLIENT_CERT_FILE",
+		"udpMtu":            "SANDCAT_UDP_MTU",
+	}
+	for name, envName := range expected {
+		if actual := EnvName(name); actual != envName {
+			t.Errorf("expected %s for %s, got %s", envName, name, actual)
+		}
+	}
+}
+
+// Every setting must map to its own environment variable.
+func TestEnvNamesAreDistinct(t *testing.T) {
+	seen := make(map[string]string)
+	for _, name := range append(append([]string{}, agentSettings...), contactSettings...) {
+		envName := EnvName(name)
+		if other, ok := seen[envName]; ok {
+			t.Errorf("%s and %s both map to %s", name, other, envName)
+		}
+		seen[envName] = name
+	}
+}
+
+func writeTestConfigFile(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sandcat.json")
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// Sets the environment variable for the test and returns a function that restores it.
+func setTestEnv(t *testing.T, name string, value string) func() {
+	previous, wasSet := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if wasSet {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestFileAndEnvironmentPrecedence(t *testing.T) {
+	path, cleanup := writeTestConfigFile(t, `{"group": "file", "sleep": 30, "contacts": {"c2Key": "filekey", "tlsPins": "filepins"}}`)
+	defer cleanup()
+	defer setTestEnv(t, "SANDCAT_SLEEP", "45")()
+	defer setTestEnv(t, "SANDCAT_C2_KEY", "envkey")()
+
+	config := &Config{
+		Group:    "linked",
+		Paw:      "linkedpaw",
+		Sleep:    60,
+		Contacts: map[string]string{"c2Name": "HTTP", "c2Key": "linkedkey"},
+	}
+	fileConfig, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Merge(fileConfig)
+	if err = config.ApplyEnvironment(); err != nil {
+		t.Fatal(err)
+	}
+	if err = config.Set("group", "flag"); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Group != "flag" {
+		t.Errorf("flag did not take precedence, group is %s", config.Group)
+	}
+	if config.Sleep != 45 || config.Contacts["c2Key"] != "envkey" {
+		t.Errorf("environment did not take precedence, sleep is %d and c2Key %s", config.Sleep, config.Contacts["c2Key"])
+	}
+	if config.Contacts["tlsPins"] != "filepins" {
+		t.Errorf("file did not take precedence, tlsPins is %s", config.Contacts["tlsPins"])
+	}
+	if config.Paw != "linkedpaw" || config.Contacts["c2Name"] != "HTTP" {
+		t.Errorf("linked settings were lost: paw %s, c2Name %s", config.Paw, config.Contacts["c2Name"])
+	}
+}
+
+func TestLoadFileRejectsUnknownFields(t *testing.T) {
+	path, cleanup := writeTestConfigFile(t, `{"sleeep": 30}`)
+	defer cleanup()
+	if _, err := LoadFile(path); err == nil {
+		t.Error("config file with an unknown field accepted")
+	}
+}
+
+func TestSetValidatesValues(t *testing.T) {
+	invalid := map[string]string{
+		"jitter":     "101",
+		"maxSleep":   "-1",
+		"sleep":      "soon",
+		"killDate":   "tomorrow",
+		"maxRuntime": "a while",
+		"servers":    "|HTTP",
+		"unknown":    "value",
+	}
+	for name, value := range invalid {
+		if err := (&Config{}).Set(name, value); err == nil {
+			t.Errorf("invalid value %s for %s accepted", value, name)
+		}
+	}
+}
+
+func TestFileOverridesWithZeroValues(t *testing.T) {
+	path, cleanup := writeTestConfigFile(t, `{"listen_p2p": false, "sleep": 0, "jitter": 0, "delay": 0, "max_jobs": 0,
+		"kill_date": "", "scope": {"allowed_hosts": []}, "tunnel": {"password": ""}}`)
+	defer cleanup()
+	config := &Config{
+		Group:     "red",
+		ListenP2P: true,
+		Sleep:     60,
+		Jitter:    20,
+		Delay:     5,
+		MaxJobs:   4,
+		MaxSleep:  300,
+		KillDate:  "2030-01-01T00:00:00Z",
+		Scope:     Scope{AllowedHosts: []string{"10.0.0.0/8"}, BlockedPaths: []string{"/etc"}},
+		Tunnel:    Tunnel{Protocol: "SSH", Password: "secret"},
+	}
+	fileConfig, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Merge(fileConfig)
+
+	if config.ListenP2P || config.Sleep != 0 || config.Jitter != 0 || config.Delay != 0 || config.MaxJobs != 0 ||
+		len(config.KillDate) > 0 || len(config.Scope.AllowedHosts) > 0 || len(config.Tunnel.Password) > 0 {
+		t.Errorf("zero values in the file did not override the linked ones: %+v", config)
+	}
+	if config.Group != "red" || config.MaxSleep != 300 || len(config.Scope.BlockedPaths) != 1 || config.Tunnel.Protocol != "SSH" {
+		t.Errorf("settings missing from the file were overridden: %+v", config)
+	}
+}
+
+func TestLoadYAMLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sandcat.yml")
+	yamlConfig := `
+servers:
+  - address: https://primary:443
+  - address: tcp-relay:7020
+    contact: TCP
+group: blue
+listen_p2p: false
+sleep: 30
+contacts:
+  c2Key: yamlkey
+  tlsStrict: "true"
+peers:
+  HTTP: [http://peer:61889]
+scope:
+  blocked_commands: ["rm -rf /"]
+`
+	if err = ioutil.WriteFile(path, []byte(yamlConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 2 || config.Servers[1].Contact != "TCP" || config.Group != "blue" || config.Sleep != 30 ||
+		config.Contacts["c2Key"] != "yamlkey" || config.Contacts["tlsStrict"] != "true" ||
+		config.Peers["HTTP"][0] != "http://peer:61889" || config.Scope.BlockedCommands[0] != "rm -rf /" {
+		t.Errorf("unexpected config from YAML: %+v", config)
+	}
+	if !config.isSet("listen_p2p", false) || config.isSet("jitter", true) {
+		t.Error("settings in the YAML file not recorded")
+	}
+
+	if err = ioutil.WriteFile(path, []byte("sleeep: 30\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadFile(path); err == nil {
+		t.Error("YAML file with an unknown field accepted")
+	}
+}
@@ -2,8 +2,7 @@ package contact
 
 import (
 	"bytes"
-	"crypto/tls"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,10 +12,15 @@ import (
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"time"
 
 	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
 )
 
+// How long a beacon or result submission may take, including reading the response.
+const apiRequestTimeout = 60 * time.Second
+
 var (
 	apiBeacon = "/beacon"
 	userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36"
@@ -27,14 +31,15 @@ type API struct {
 	name string
 	client *http.Client
 	upstreamDestAddr string
+	encoding *dataEncoding
 }
 
 func init() {
-	CommunicationChannels["HTTP"] = &API{ name: "HTTP" }
+	registerContact("HTTP", func() Contact { return &API{name: "HTTP"} })
 }
 
 //GetInstructions sends a beacon and returns response.
-func (a *API) GetBeaconBytes(profile map[string]interface{}) []byte {
+func (a *API) GetBeaconBytes(profile protocol.Profile) []byte {
 	data, err := json.Marshal(profile)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
@@ -46,11 +51,10 @@ func (a *API) GetBeaconBytes(profile map[string]interface{}) []byte {
 }
 
 // Return the file bytes for the requested payload.
-func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string) {
+func (a *API) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
     var payloadBytes []byte
     var filename string
-    platform := profile["platform"]
-    if platform != nil {
+    if len(profile.Platform) > 0 {
 		address := fmt.Sprintf("%s/file/download", a.upstreamDestAddr)
 		req, err := http.NewRequest("POST", address, nil)
 		if err != nil {
@@ -58,8 +62,9 @@ func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([
 			return nil, ""
 		}
 		req.Header.Set("file", payload)
-		req.Header.Set("platform", platform.(string))
-		req.Header.Set("paw", profile["paw"].(string))
+		req.Header.Set("platform", profile.Platform)
+		req.Header.Set("paw", profile.Paw)
+		req.Header.Set(fileEncodingHeader, a.encoding.file.String())
 		resp, err := a.client.Do(req)
 		if err != nil {
 			output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request: %s", err.Error()))
@@ -72,7 +77,11 @@ func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([
 				output.VerbosePrint(fmt.Sprintf("[-] Error reading HTTP response: %s", err.Error()))
 				return nil, ""
 			}
-			payloadBytes = buf
+			payloadBytes, err = a.encoding.decodeFile(buf)
+			if err != nil {
+				output.VerbosePrint(fmt.Sprintf("[-] Error decoding payload: %s", err.Error()))
+				return nil, ""
+			}
 			if name_header, ok := resp.Header["Filename"]; ok {
 				filename = filepath.Join(name_header[0])
 			} else {
@@ -84,9 +93,20 @@ func (a *API) GetPayloadBytes(profile map[string]interface{}, payload string) ([
 }
 
 //C2RequirementsMet determines if sandcat can use the selected comm channel
-func (a *API) C2RequirementsMet(profile map[string]interface{}, c2Config map[string]string) (bool, map[string]string) {
+func (a *API) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
 	output.VerbosePrint(fmt.Sprintf("Beacon API=%s", apiBeacon))
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	encoding, err := getDataEncoding(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up data encoders: %s", err.Error()))
+		return false, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := buildTLSConfig(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish TLS requirements: %s", err.Error()))
+		return false, nil
+	}
+	transport.TLSClientConfig = tlsConfig
 
 	// Handle proxy gateway configuration.
 	if proxyUrlStr, ok := c2Config["httpProxyGateway"]; ok && len(proxyUrlStr) > 0 {
@@ -95,10 +115,15 @@ func (a *API) C2RequirementsMet(profile map[string]interface{}, c2Config map[str
 			output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish HTTP proxy requirements: %s", err.Error()))
 			return false, nil
 		}
-		http.DefaultTransport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+		transport.Proxy = http.ProxyURL(proxyUrl)
 	}
-	a.client = &http.Client{Transport: http.DefaultTransport}
+	a.encoding = encoding
+	a.client = &http.Client{Transport: transport}
 
+	// Report the client certificate identity so that it is included in the agent profile.
+	if len(tlsConfig.Certificates) > 0 {
+		return true, map[string]string{"clientCertIdentity": getCertificateIdentity(tlsConfig.Certificates[0])}
+	}
 	return true, nil
 }
 
@@ -107,16 +132,10 @@ func (a *API) SetUpstreamDestAddr(upstreamDestAddr string) {
 }
 
 // SendExecutionResults will send the execution results to the upstream destination.
-func (a *API) SendExecutionResults(profile map[string]interface{}, result map[string]interface{}) {
+func (a *API) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
 	address := fmt.Sprintf("%s%s", a.upstreamDestAddr, apiBeacon)
-	profileCopy := make(map[string]interface{})
-	for k,v := range profile {
-		profileCopy[k] = v
-	}
-	results := make([]map[string]interface{}, 1)
-	results[0] = result
-	profileCopy["results"] = results
-	data, err := json.Marshal(profileCopy)
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
 	} else {
@@ -124,16 +143,27 @@ func (a *API) SendExecutionResults(profile map[string]interface{}, result map[st
 	}
 }
 
+// Close closes the idle connections to the server.
+func (a *API) Close() {
+	if a.client != nil {
+		a.client.CloseIdleConnections()
+	}
+}
+
 func (a *API) GetName() string {
 	return a.name
 }
 
-func (a *API) UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error {
+func (a *API) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
 	uploadUrl := a.upstreamDestAddr + "/file/upload"
 
 	// Set up the form
+	encodedData, err := a.encoding.encodeFile(data)
+	if err != nil {
+		return err
+	}
 	requestBody := bytes.Buffer{}
-	contentType, err := createUploadForm(&requestBody, data, uploadName)
+	contentType, err := createUploadForm(&requestBody, encodedData, uploadName)
 	if err != nil {
 		return nil
 	}
@@ -141,10 +171,11 @@ func (a *API) UploadFileBytes(profile map[string]interface{}, uploadName string,
 	// Set up the request
 	headers := map[string]string{
 		"Content-Type": contentType,
-		"X-Request-Id": fmt.Sprintf("%s-%s", profile["host"].(string), profile["paw"].(string)),
+		"X-Request-Id": fmt.Sprintf("%s-%s", profile.Host, profile.Paw),
 		"User-Agent": userAgent,
-		"X-Paw": profile["paw"].(string),
-		"X-Host": profile["host"].(string),
+		"X-Paw": profile.Paw,
+		"X-Host": profile.Host,
+		fileEncodingHeader: a.encoding.file.String(),
 	}
 	req, err := createUploadRequest(uploadUrl, &requestBody, headers)
 	if err != nil {
@@ -162,7 +193,6 @@ func (a *API) UploadFileBytes(profile map[string]interface{}, uploadName string,
 	} else {
 		return errors.New(fmt.Sprintf("Non-successful HTTP response status code: %d", resp.StatusCode))
 	}
-	return nil
 }
 
 func createUploadForm(requestBody *bytes.Buffer, data []byte, uploadName string) (string, error) {
@@ -191,8 +221,14 @@ func createUploadRequest(uploadUrl string, requestBody *bytes.Buffer, headers ma
 }
 
 func (a *API) request(address string, data []byte) []byte {
-	encodedData := []byte(base64.StdEncoding.EncodeToString(data))
-	req, err := http.NewRequest("POST", address, bytes.NewBuffer(encodedData))
+	encodedData, err := a.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode HTTP request: %s", err.Error()))
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", address, bytes.NewBuffer(encodedData))
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to create HTTP request: %s", err.Error()))
 		return nil
@@ -202,12 +238,13 @@ func (a *API) request(address string, data []byte) []byte {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to perform HTTP request: %s", err.Error()))
 		return nil
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to read HTTP response: %s", err.Error()))
 		return nil
 	}
-	decodedBody, err := base64.StdEncoding.DecodeString(string(body))
+	decodedBody, err := a.encoding.decodeBeacon(body)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode HTTP response: %s", err.Error()))
 		return nil
@@ -1,5 +1,13 @@
 package contact
 
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mitre/gocat/protocol"
+)
+
 const (
 	ok = 200
 	created = 201
@@ -7,18 +15,70 @@ const (
 
 //Contact defines required functions for communicating with the server
 type Contact interface {
-	GetBeaconBytes(profile map[string]interface{}) []byte
-	GetPayloadBytes(profile map[string]interface{}, payload string) ([]byte, string)
-	C2RequirementsMet(profile map[string]interface{}, c2Config map[string]string) (bool, map[string]string)
-	SendExecutionResults(profile map[string]interface{}, result map[string]interface{})
+	GetBeaconBytes(profile protocol.Profile) []byte
+	GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string)
+	C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string)
+	SendExecutionResults(profile protocol.Profile, result protocol.Result)
 	GetName() string
 	SetUpstreamDestAddr(upstreamDestAddr string)
-	UploadFileBytes(profile map[string]interface{}, uploadName string, data []byte) error
+	UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error
+}
+
+// PushContact is implemented by contacts over which the C2 server can push beacon responses between beacons.
+type PushContact interface {
+	Contact
+	WaitForPushedBeacon(timeout time.Duration) []byte // returns nil if nothing was pushed before the timeout
 }
 
 //CommunicationChannels contains the contact implementations
 var CommunicationChannels = map[string]Contact{}
 
+// Creates unconfigured instances of the contacts in CommunicationChannels, by the same names.
+var contactFactories = map[string]func() Contact{}
+
+// Implemented by contacts that keep a connection to the server open between requests.
+type closableContact interface {
+	Contact
+	Close()
+}
+
+// Registers the contact under the given name, along with a factory for separate instances of it.
+func registerContact(name string, factory func() Contact) {
+	CommunicationChannels[name] = factory()
+	contactFactories[name] = factory
+}
+
+// ProbeBeacon sends a beacon over a separate instance of the named contact, configured with the given settings and
+// upstream destination, and returns the response. The contact in CommunicationChannels is left untouched, so that
+// a server can be probed while the agent keeps using it. The probe is bounded by the contact's request timeout.
+func ProbeBeacon(name string, c2Config map[string]string, upstreamDestAddr string, profile protocol.Profile) ([]byte, error) {
+	factory, ok := contactFactories[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s channel not available", name))
+	}
+	coms := factory()
+	if closable, ok := coms.(closableContact); ok {
+		defer closable.Close()
+	}
+	coms.SetUpstreamDestAddr(upstreamDestAddr)
+	if valid, _ := coms.C2RequirementsMet(profile, c2Config); !valid {
+		return nil, errors.New(fmt.Sprintf("%s channel available, but requirements not met.", name))
+	}
+	response := coms.GetBeaconBytes(profile)
+	if response == nil {
+		return nil, errors.New(fmt.Sprintf("No beacon response from %s", upstreamDestAddr))
+	}
+	return response, nil
+}
+
+// CloseConnection closes the connection that the contact keeps open to the server, if any. The contact reconnects
+// on its next request.
+func CloseConnection(coms Contact) {
+	if closable, ok := coms.(closableContact); ok {
+		closable.Close()
+	}
+}
+
 func GetAvailableCommChannels() []string {
 	channels := make([]string, 0, len(CommunicationChannels))
 	for k := range CommunicationChannels {
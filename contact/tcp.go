@@ -0,0 +1,351 @@
+package contact
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+const (
+	tcpDefaultPort        = "7020" // distinct from the port of CALDERA's raw TCP contact, which speaks another protocol
+	tcpDialTimeout        = 10 * time.Second
+	tcpRequestTimeout     = 60 * time.Second
+	tcpKeepaliveInterval  = 30 * time.Second
+	tcpKeepaliveTimeout   = 10 * time.Second
+	tcpMinReconnectDelay  = 1 * time.Second
+	tcpMaxReconnectDelay  = 60 * time.Second
+	tcpMaxRequestAttempts = 2
+)
+
+var (
+	errTCPConnectionLost = errors.New("TCP connection closed before response was received.")
+	errTCPSendFailed     = errors.New("TCP connection failed while sending request.")
+)
+
+// TCP communicates with the C2 server over a persistent TCP connection using length-prefixed protocol.Frame
+// messages. Requests are multiplexed on the connection by frame ID and idle connections are kept alive with
+// keepalive frames. Lost connections are re-established on the next request, backing off exponentially while
+// the server cannot be reached.
+type TCP struct {
+	name             string
+	upstreamDestAddr string
+	configuredAddr   string // address from the C2 config, if any
+	serverAddr       string
+	encoding         *dataEncoding
+
+	mu             sync.Mutex // guards the connection, pending requests and reconnection state
+	conn           net.Conn
+	connClosed     chan struct{}
+	pending        map[uint32]chan protocol.Frame
+	nextID         uint32
+	reconnectDelay time.Duration
+	nextDial       time.Time
+	writeMu        sync.Mutex
+}
+
+func init() {
+	registerContact("TCP", func() Contact {
+		return &TCP{
+			name:    "TCP",
+			pending: make(map[uint32]chan protocol.Frame),
+		}
+	})
+}
+
+func (t *TCP) GetBeaconBytes(profile protocol.Profile) []byte {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
+		return nil
+	}
+	encoded, err := t.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode beacon: %s", err.Error()))
+		return nil
+	}
+	response, err := t.request(protocol.Frame{Type: protocol.FrameBeacon, Data: encoded}, tcpRequestTimeout)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] TCP beacon failed: %s", err.Error()))
+		return nil
+	}
+	decoded, err := t.encoding.decodeBeacon(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode beacon response: %s", err.Error()))
+		return nil
+	}
+	return decoded
+}
+
+func (t *TCP) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	request := protocol.Frame{Type: protocol.FramePayload, Name: payload, Encoding: t.encoding.file.String()}
+	response, err := t.request(request, tcpRequestTimeout)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request: %s", err.Error()))
+		return nil, ""
+	}
+	payloadBytes, err := t.encoding.decodeFile(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error decoding payload: %s", err.Error()))
+		return nil, ""
+	}
+	return payloadBytes, response.Name
+}
+
+func (t *TCP) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	encoding, err := getDataEncoding(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up data encoders: %s", err.Error()))
+		return false, nil
+	}
+	t.configuredAddr = c2Config["tcpAddr"]
+	serverAddr, err := getTCPAddr(t.configuredAddr, t.upstreamDestAddr)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not determine TCP server address: %s", err.Error()))
+		return false, nil
+	}
+	output.VerbosePrint(fmt.Sprintf("TCP server=%s", serverAddr))
+	t.encoding = encoding
+	t.closeConnection()
+	t.mu.Lock()
+	t.serverAddr = serverAddr
+	t.reconnectDelay = 0
+	t.nextDial = time.Time{}
+	t.mu.Unlock()
+	if _, err = t.getConnection(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] TCP connection to %s failed, will retry on next request: %s", serverAddr, err.Error()))
+	}
+	return true, nil
+}
+
+func (t *TCP) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return
+	}
+	encoded, err := t.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode results: %s", err.Error()))
+		return
+	}
+	if _, err = t.request(protocol.Frame{Type: protocol.FrameResults, Data: encoded}, tcpRequestTimeout); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to send results over TCP: %s", err.Error()))
+	}
+}
+
+func (t *TCP) GetName() string {
+	return t.name
+}
+
+// Unless a TCP address was configured explicitly, the server address follows the upstream destination's host.
+func (t *TCP) SetUpstreamDestAddr(upstreamDestAddr string) {
+	t.upstreamDestAddr = upstreamDestAddr
+	serverAddr, err := getTCPAddr(t.configuredAddr, upstreamDestAddr)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not determine TCP server address: %s", err.Error()))
+		return
+	}
+	t.mu.Lock()
+	changed := serverAddr != t.serverAddr
+	t.mu.Unlock()
+	if changed {
+		t.closeConnection()
+		t.mu.Lock()
+		t.serverAddr = serverAddr
+		t.reconnectDelay = 0
+		t.nextDial = time.Time{}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TCP) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	encoded, err := t.encoding.encodeFile(data)
+	if err != nil {
+		return err
+	}
+	request := protocol.Frame{Type: protocol.FrameUpload, Name: uploadName, Encoding: t.encoding.file.String(), Data: encoded}
+	_, err = t.request(request, tcpRequestTimeout)
+	return err
+}
+
+// Sends the frame and waits for the server's response with the same ID. A request that could not be written is
+// retried once on a fresh connection. Requests that were sent are not retried, since the server may have already
+// processed them.
+func (t *TCP) request(frame protocol.Frame, timeout time.Duration) (protocol.Frame, error) {
+	var response protocol.Frame
+	var err error
+	for attempt := 1; attempt <= tcpMaxRequestAttempts; attempt++ {
+		response, err = t.requestOnce(frame, timeout)
+		if err != errTCPSendFailed {
+			break
+		}
+	}
+	if err != nil {
+		return response, err
+	}
+	return response, response.Err()
+}
+
+func (t *TCP) requestOnce(frame protocol.Frame, timeout time.Duration) (protocol.Frame, error) {
+	conn, err := t.getConnection()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	responseChan := make(chan protocol.Frame, 1)
+	t.mu.Lock()
+	t.nextID++
+	frame.ID = t.nextID
+	t.pending[frame.ID] = responseChan
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, frame.ID)
+		t.mu.Unlock()
+	}()
+
+	// A server that stops reading must not block the request, or other writers, past its timeout.
+	t.writeMu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	err = protocol.WriteFrame(conn, frame)
+	conn.SetWriteDeadline(time.Time{})
+	t.writeMu.Unlock()
+	if err != nil {
+		t.disconnect(conn, err)
+		return protocol.Frame{}, errTCPSendFailed
+	}
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return response, errTCPConnectionLost
+		}
+		return response, nil
+	case <-time.After(timeout):
+		err = errors.New(fmt.Sprintf("Timed out waiting for response to frame type %d", frame.Type))
+		t.disconnect(conn, err)
+		return protocol.Frame{}, err
+	}
+}
+
+// Returns the current connection, establishing a new one if needed. While the server cannot be reached, dial
+// attempts are spaced out with exponential backoff.
+func (t *TCP) getConnection() (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	if wait := time.Until(t.nextDial); wait > 0 {
+		return nil, errors.New(fmt.Sprintf("Waiting %s before reconnecting to %s", wait.Round(time.Millisecond), t.serverAddr))
+	}
+	dialer := &net.Dialer{Timeout: tcpDialTimeout, KeepAlive: tcpKeepaliveInterval}
+	conn, err := dialer.Dial("tcp", t.serverAddr)
+	if err != nil {
+		if t.reconnectDelay == 0 {
+			t.reconnectDelay = tcpMinReconnectDelay
+		} else if t.reconnectDelay *= 2; t.reconnectDelay > tcpMaxReconnectDelay {
+			t.reconnectDelay = tcpMaxReconnectDelay
+		}
+		t.nextDial = time.Now().Add(t.reconnectDelay)
+		return nil, err
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] TCP connection established to %s", t.serverAddr))
+	t.reconnectDelay = 0
+	t.conn = conn
+	t.connClosed = make(chan struct{})
+	go t.receive(conn)
+	go t.keepAlive(conn, t.connClosed)
+	return conn, nil
+}
+
+// Reads frames from the connection until it fails, dispatching responses to waiting requests.
+func (t *TCP) receive(conn net.Conn) {
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			t.disconnect(conn, err)
+			return
+		}
+		t.mu.Lock()
+		responseChan, ok := t.pending[frame.ID]
+		delete(t.pending, frame.ID)
+		t.mu.Unlock()
+		if ok {
+			responseChan <- frame
+		}
+	}
+}
+
+// Periodically sends keepalive frames so that idle connections are not dropped by intermediate devices, and so
+// that dead connections are noticed before the next beacon.
+func (t *TCP) keepAlive(conn net.Conn, closed chan struct{}) {
+	ticker := time.NewTicker(tcpKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			if _, err := t.requestOnce(protocol.Frame{Type: protocol.FrameKeepalive}, tcpKeepaliveTimeout); err != nil {
+				output.VerbosePrint(fmt.Sprintf("[-] TCP keepalive failed: %s", err.Error()))
+				return
+			}
+		}
+	}
+}
+
+// Closes the given connection if it is still the current one and fails any requests waiting on it.
+func (t *TCP) disconnect(conn net.Conn, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != conn {
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[!] TCP connection lost: %s", err.Error()))
+	t.conn.Close()
+	t.conn = nil
+	close(t.connClosed)
+	for id, responseChan := range t.pending {
+		close(responseChan)
+		delete(t.pending, id)
+	}
+}
+
+// Close closes the connection to the server, if any. The next request reconnects.
+func (t *TCP) Close() {
+	t.closeConnection()
+}
+
+func (t *TCP) closeConnection() {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+	if conn != nil {
+		t.disconnect(conn, errors.New("connection reset"))
+	}
+}
+
+// Returns the configured TCP address, or the upstream destination's host on the default TCP port.
+func getTCPAddr(configuredAddr string, upstreamDestAddr string) (string, error) {
+	if len(configuredAddr) > 0 {
+		if _, _, err := net.SplitHostPort(configuredAddr); err != nil {
+			return net.JoinHostPort(configuredAddr, tcpDefaultPort), nil
+		}
+		return configuredAddr, nil
+	}
+	upstreamUrl, err := url.Parse(upstreamDestAddr)
+	if err != nil {
+		return "", err
+	}
+	if len(upstreamUrl.Hostname()) == 0 {
+		return "", errors.New(fmt.Sprintf("No host found in upstream address %s", upstreamDestAddr))
+	}
+	return net.JoinHostPort(upstreamUrl.Hostname(), tcpDefaultPort), nil
+}
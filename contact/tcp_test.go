@@ -0,0 +1,162 @@
+package contact
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Starts a mock C2 server with a TCP listener and returns it along with a TCP contact connected to it.
+func newTestTCPContact(t *testing.T) (*c2test.Server, *TCP) {
+	server := c2test.NewServer()
+	tcpAddr, err := server.StartTCP()
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	contact := &TCP{name: "TCP", pending: make(map[uint32]chan protocol.Frame)}
+	contact.SetUpstreamDestAddr(server.URL())
+	if valid, _ := contact.C2RequirementsMet(protocol.Profile{}, map[string]string{"tcpAddr": tcpAddr}); !valid {
+		server.Close()
+		t.Fatal("TCP contact requirements not met")
+	}
+	return server, contact
+}
+
+func TestTCPReconnectsAfterConnectionLoss(t *testing.T) {
+	server, contact := newTestTCPContact(t)
+	defer server.Close()
+	profile := protocol.Profile{Paw: "tcppaw", Platform: "linux"}
+	if contact.GetBeaconBytes(profile) == nil {
+		t.Fatal("first beacon failed")
+	}
+
+	// Once the dropped connection is noticed, the next request reconnects.
+	server.DropTCPConnections()
+	waitForTCPDisconnect(t, contact)
+	if contact.GetBeaconBytes(profile) == nil {
+		t.Fatal("beacon after dropped connection failed")
+	}
+	server.RequireBeacons(t, 2, time.Second)
+
+	server.AddPayload("payload.bin", []byte("payload"))
+	if payload, name := contact.GetPayloadBytes(profile, "payload.bin"); string(payload) != "payload" || name != "payload.bin" {
+		t.Errorf("unexpected payload %q named %s", payload, name)
+	}
+}
+
+func TestTCPBacksOffWhileServerUnreachable(t *testing.T) {
+	server, contact := newTestTCPContact(t)
+	server.Close()
+	profile := protocol.Profile{Paw: "tcppaw", Platform: "linux"}
+	for i := 0; i < 2; i++ {
+		if contact.GetBeaconBytes(profile) != nil {
+			t.Fatal("beacon to closed server succeeded")
+		}
+	}
+	contact.mu.Lock()
+	defer contact.mu.Unlock()
+	if contact.reconnectDelay < tcpMinReconnectDelay || !contact.nextDial.After(time.Now()) {
+		t.Errorf("no reconnect backoff after failed dials: delay %s", contact.reconnectDelay)
+	}
+}
+
+func waitForTCPDisconnect(t *testing.T, contact *TCP) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		contact.mu.Lock()
+		conn := contact.conn
+		contact.mu.Unlock()
+		if conn == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dropped connection not noticed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Local TCP listener that counts the connections it accepts.
+type testTCPListener struct {
+	mu       sync.Mutex
+	accepted int
+	addr     string
+}
+
+// Accepts TCP connections on a local port, handling each with the given function. The returned function closes the
+// listener.
+func startTestTCPListener(t *testing.T, handle func(net.Conn)) (*testTCPListener, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &testTCPListener{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			l.mu.Lock()
+			l.accepted++
+			l.mu.Unlock()
+			go handle(conn)
+		}
+	}()
+	return l, func() { listener.Close() }
+}
+
+func (l *testTCPListener) acceptedCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.accepted
+}
+
+func TestTCPDoesNotRetrySentRequests(t *testing.T) {
+	frames := make(chan protocol.Frame, 2)
+	listener, stop := startTestTCPListener(t, func(conn net.Conn) {
+		defer conn.Close()
+		if frame, err := protocol.ReadFrame(conn); err == nil {
+			frames <- frame
+		}
+	})
+	defer stop()
+	contact := &TCP{name: "TCP", pending: make(map[uint32]chan protocol.Frame), serverAddr: listener.addr}
+	defer contact.Close()
+
+	if _, err := contact.request(protocol.Frame{Type: protocol.FrameResults}, time.Second); err != errTCPConnectionLost {
+		t.Errorf("expected lost connection, got %v", err)
+	}
+	if len(frames) != 1 || listener.acceptedCount() != 1 {
+		t.Errorf("request sent %d times over %d connections", len(frames), listener.acceptedCount())
+	}
+}
+
+func TestTCPRetriesRequestsThatCannotBeWritten(t *testing.T) {
+	// The server never reads, so large requests cannot be written before their deadline.
+	held := make(chan net.Conn, 2)
+	listener, stop := startTestTCPListener(t, func(conn net.Conn) { held <- conn })
+	defer stop()
+	contact := &TCP{name: "TCP", pending: make(map[uint32]chan protocol.Frame), serverAddr: listener.addr}
+	defer contact.Close()
+
+	start := time.Now()
+	upload := protocol.Frame{Type: protocol.FrameUpload, Name: "upload.bin", Data: make([]byte, 32*1024*1024)}
+	if _, err := contact.request(upload, 200*time.Millisecond); err != errTCPSendFailed {
+		t.Errorf("expected failed send, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("blocked writes took %s to fail", elapsed)
+	}
+	if accepted := listener.acceptedCount(); accepted != tcpMaxRequestAttempts {
+		t.Errorf("expected %d attempts, got %d", tcpMaxRequestAttempts, accepted)
+	}
+	for len(held) > 0 {
+		(<-held).Close()
+	}
+}
@@ -0,0 +1,181 @@
+package contact
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const spkiPinPrefix = "sha256/"
+
+// Builds the TLS client configuration requested in the C2 config:
+//
+//	tlsStrict: "true" to verify the server certificate chain and hostname.
+//	tlsCaCert: base64-encoded PEM bundle of CA certificates to trust instead of the system roots. Implies tlsStrict.
+//	tlsCaFile: path to a PEM bundle of CA certificates to trust instead of the system roots. Implies tlsStrict.
+//	tlsPins: comma-separated base64 SHA-256 hashes of trusted SubjectPublicKeyInfo, optionally prefixed with "sha256/".
+//
+// Without any of these, server certificates are not verified.
+// A client certificate for mutual TLS is loaded as described in loadClientCertificate.
+func buildTLSConfig(c2Config map[string]string) (*tls.Config, error) {
+	strict := false
+	if strictStr, ok := c2Config["tlsStrict"]; ok && len(strictStr) > 0 {
+		parsed, err := strconv.ParseBool(strictStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid tlsStrict value %s", strictStr))
+		}
+		strict = parsed
+	}
+	rootCAs, err := loadCACertPool(c2Config["tlsCaCert"], c2Config["tlsCaFile"])
+	if err != nil {
+		return nil, err
+	}
+	pins, err := parseSPKIPins(c2Config["tlsPins"])
+	if err != nil {
+		return nil, err
+	}
+	clientCert, err := loadClientCertificate(c2Config)
+	if err != nil {
+		return nil, err
+	}
+	verifyChain := strict || rootCAs != nil
+	tlsConfig := &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: !verifyChain,
+	}
+	if clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+	if len(pins) > 0 {
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return checkSPKIPins(pins, rawCerts, verifiedChains)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Returns a pool with the CA certificates from the base64-encoded PEM bundle and the PEM file, or nil if neither
+// was provided.
+func loadCACertPool(encodedPem string, pemFile string) (*x509.CertPool, error) {
+	if len(encodedPem) == 0 && len(pemFile) == 0 {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if len(encodedPem) > 0 {
+		pemBytes, err := base64.StdEncoding.DecodeString(encodedPem)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not decode bundled CA certificate: %s", err.Error()))
+		}
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, errors.New("No valid certificates found in bundled CA certificate.")
+		}
+	}
+	if len(pemFile) > 0 {
+		pemBytes, err := ioutil.ReadFile(pemFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read CA certificate file: %s", err.Error()))
+		}
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return nil, errors.New(fmt.Sprintf("No valid certificates found in %s", pemFile))
+		}
+	}
+	return pool, nil
+}
+
+// Parses a comma-separated list of SPKI pins into their raw SHA-256 hashes.
+func parseSPKIPins(pinList string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(pinList, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), spkiPinPrefix)
+		if len(pin) == 0 {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, errors.New(fmt.Sprintf("Invalid SPKI pin %s", pin))
+		}
+		pins = append(pins, string(hash))
+	}
+	return pins, nil
+}
+
+// Accepts the connection if a pinned public key appears in the server's certificates. When the chain was not
+// verified, only the leaf certificate is considered, since it is the only one the server proved possession of.
+func checkSPKIPins(pins []string, rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	var candidates []*x509.Certificate
+	if len(verifiedChains) > 0 {
+		for _, chain := range verifiedChains {
+			candidates = append(candidates, chain...)
+		}
+	} else if len(rawCerts) > 0 {
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		candidates = append(candidates, leaf)
+	}
+	for _, cert := range candidates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if string(hash[:]) == pin {
+				return nil
+			}
+		}
+	}
+	return errors.New("Server certificate does not match any pinned public key.")
+}
+
+// Loads the client certificate and key for mutual TLS from the C2 config, or returns nil if none was provided.
+//
+//	tlsClientCertFile, tlsClientKeyFile: paths to the PEM certificate and key. Take precedence if set.
+//	tlsClientCert, tlsClientKey: base64-encoded PEM certificate and key.
+func loadClientCertificate(c2Config map[string]string) (*tls.Certificate, error) {
+	if certFile, keyFile := c2Config["tlsClientCertFile"], c2Config["tlsClientKeyFile"]; len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not load client certificate: %s", err.Error()))
+		}
+		return &cert, nil
+	}
+	encodedCert, encodedKey := c2Config["tlsClientCert"], c2Config["tlsClientKey"]
+	if len(encodedCert) == 0 && len(encodedKey) == 0 {
+		return nil, nil
+	}
+	certPem, err := base64.StdEncoding.DecodeString(encodedCert)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not decode client certificate: %s", err.Error()))
+	}
+	keyPem, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not decode client key: %s", err.Error()))
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not load client certificate: %s", err.Error()))
+	}
+	return &cert, nil
+}
+
+// Returns the subject of the given client certificate, used to report the agent's TLS identity.
+func getCertificateIdentity(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.Subject.String()
+}
+
+// Returns the SPKI pin for the given certificate, in the format accepted by tlsPins.
+func GetSPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return spkiPinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
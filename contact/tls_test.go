@@ -0,0 +1,303 @@
+package contact
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// Certificate and key issued for a test, in both parsed and PEM form.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+// Issues a certificate for the given subject, signed by the issuer or self-signed if the issuer is nil. CA
+// certificates can sign others, and leaf certificates are valid for 127.0.0.1.
+func newTestCertificate(t *testing.T, commonName string, isCA bool, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	parent, parentKey := template, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPem, c.keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Starts an HTTPS server presenting the given certificate. If clientCA is set, the server requires client
+// certificates issued by it.
+func startTestTLSServer(t *testing.T, serverCert *testCertificate, clientCA *testCertificate) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// Rejected handshakes are expected.
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = pool
+	}
+	server.StartTLS()
+	return server
+}
+
+// Builds the TLS config from the C2 config and requests the URL with it.
+func requestWithTLSConfig(t *testing.T, url string, c2Config map[string]string) error {
+	tlsConfig, err := buildTLSConfig(c2Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestBuildTLSConfigVerifiesSPKIPins(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", true, nil)
+	serverCert := newTestCertificate(t, "test server", false, ca)
+	server := startTestTLSServer(t, serverCert, nil)
+	defer server.Close()
+	otherPin := GetSPKIPin(newTestCertificate(t, "other server", false, nil).cert)
+
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsPins": GetSPKIPin(serverCert.cert)}); err != nil {
+		t.Errorf("server with a pinned key rejected: %s", err.Error())
+	}
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsPins": otherPin + "," + GetSPKIPin(serverCert.cert)}); err != nil {
+		t.Errorf("server with a key in the pin list rejected: %s", err.Error())
+	}
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsPins": otherPin}); err == nil {
+		t.Error("server without a pinned key accepted")
+	}
+	// Without chain verification, a pinned CA key does not vouch for the server's certificate.
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsPins": GetSPKIPin(ca.cert)}); err == nil {
+		t.Error("unverified server accepted with a pinned CA key")
+	}
+	caPem := base64.StdEncoding.EncodeToString(ca.certPem)
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsPins": GetSPKIPin(ca.cert), "tlsCaCert": caPem}); err != nil {
+		t.Errorf("server verified by a pinned CA rejected: %s", err.Error())
+	}
+}
+
+func TestBuildTLSConfigTrustsCustomCA(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", true, nil)
+	server := startTestTLSServer(t, newTestCertificate(t, "test server", false, ca), nil)
+	defer server.Close()
+	caFile := writeTestFile(t, ca.certPem)
+	defer os.Remove(caFile)
+
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsCaCert": base64.StdEncoding.EncodeToString(ca.certPem)}); err != nil {
+		t.Errorf("server issued by the bundled CA rejected: %s", err.Error())
+	}
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsCaFile": caFile}); err != nil {
+		t.Errorf("server issued by the CA file rejected: %s", err.Error())
+	}
+	otherCA := newTestCertificate(t, "other ca", true, nil)
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsCaCert": base64.StdEncoding.EncodeToString(otherCA.certPem)}); err == nil {
+		t.Error("server issued by an untrusted CA accepted")
+	}
+	// The certificate is only valid for 127.0.0.1.
+	localhostURL := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := requestWithTLSConfig(t, localhostURL, map[string]string{"tlsCaFile": caFile}); err == nil {
+		t.Error("server accepted under a name its certificate does not cover")
+	}
+}
+
+func TestBuildTLSConfigStrictMode(t *testing.T) {
+	server := startTestTLSServer(t, newTestCertificate(t, "test server", false, nil), nil)
+	defer server.Close()
+
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{}); err != nil {
+		t.Errorf("self-signed server rejected without verification: %s", err.Error())
+	}
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsStrict": "false"}); err != nil {
+		t.Errorf("self-signed server rejected with strict mode disabled: %s", err.Error())
+	}
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsStrict": "true"}); err == nil {
+		t.Error("self-signed server accepted in strict mode")
+	}
+}
+
+func TestBuildTLSConfigRejectsInvalidSettings(t *testing.T) {
+	for _, c2Config := range []map[string]string{
+		{"tlsStrict": "sometimes"},
+		{"tlsCaCert": "not base64"},
+		{"tlsCaCert": base64.StdEncoding.EncodeToString([]byte("not pem"))},
+		{"tlsCaFile": "/nonexistent/ca.pem"},
+		{"tlsPins": "sha256/not base64"},
+		{"tlsPins": "sha256/" + base64.StdEncoding.EncodeToString([]byte("short"))},
+	} {
+		if _, err := buildTLSConfig(c2Config); err == nil {
+			t.Errorf("invalid settings %v accepted", c2Config)
+		}
+	}
+}
+
+func TestBuildTLSConfigPresentsClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "test ca", true, nil)
+	server := startTestTLSServer(t, newTestCertificate(t, "test server", false, ca), ca)
+	defer server.Close()
+	clientCert := newTestCertificate(t, "test agent", false, ca)
+	certFile, keyFile := writeTestFile(t, clientCert.certPem), writeTestFile(t, clientCert.keyPem)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	caPem := base64.StdEncoding.EncodeToString(ca.certPem)
+
+	if err := requestWithTLSConfig(t, server.URL, map[string]string{"tlsCaCert": caPem}); err == nil {
+		t.Error("request without a client certificate accepted")
+	}
+	encoded := map[string]string{
+		"tlsCaCert":     caPem,
+		"tlsClientCert": base64.StdEncoding.EncodeToString(clientCert.certPem),
+		"tlsClientKey":  base64.StdEncoding.EncodeToString(clientCert.keyPem),
+	}
+	if err := requestWithTLSConfig(t, server.URL, encoded); err != nil {
+		t.Errorf("bundled client certificate rejected: %s", err.Error())
+	}
+	// Certificate files take precedence over bundled certificates.
+	files := map[string]string{
+		"tlsCaCert":         caPem,
+		"tlsClientCert":     "not base64",
+		"tlsClientCertFile": certFile,
+		"tlsClientKeyFile":  keyFile,
+	}
+	if err := requestWithTLSConfig(t, server.URL, files); err != nil {
+		t.Errorf("client certificate file rejected: %s", err.Error())
+	}
+	otherCert := newTestCertificate(t, "other agent", false, nil)
+	other := map[string]string{
+		"tlsCaCert":     caPem,
+		"tlsClientCert": base64.StdEncoding.EncodeToString(otherCert.certPem),
+		"tlsClientKey":  base64.StdEncoding.EncodeToString(otherCert.keyPem),
+	}
+	if err := requestWithTLSConfig(t, server.URL, other); err == nil {
+		t.Error("client certificate from an untrusted CA accepted")
+	}
+}
+
+func TestBuildTLSConfigRejectsInvalidClientCertificates(t *testing.T) {
+	clientCert := newTestCertificate(t, "test agent", false, nil)
+	otherCert := newTestCertificate(t, "other agent", false, nil)
+	for _, c2Config := range []map[string]string{
+		{"tlsClientCert": base64.StdEncoding.EncodeToString(clientCert.certPem)},
+		{"tlsClientCert": "not base64", "tlsClientKey": base64.StdEncoding.EncodeToString(clientCert.keyPem)},
+		{"tlsClientCert": base64.StdEncoding.EncodeToString(clientCert.certPem), "tlsClientKey": base64.StdEncoding.EncodeToString(otherCert.keyPem)},
+		{"tlsClientCertFile": "/nonexistent/cert.pem", "tlsClientKeyFile": "/nonexistent/key.pem"},
+	} {
+		if _, err := buildTLSConfig(c2Config); err == nil {
+			t.Errorf("invalid client certificate settings %v accepted", c2Config)
+		}
+	}
+}
+
+func TestAPIReportsClientCertificateIdentity(t *testing.T) {
+	clientCert := newTestCertificate(t, "test agent", false, nil)
+	c2Config := map[string]string{
+		"tlsClientCert": base64.StdEncoding.EncodeToString(clientCert.certPem),
+		"tlsClientKey":  base64.StdEncoding.EncodeToString(clientCert.keyPem),
+	}
+	valid, config := (&API{}).C2RequirementsMet(protocol.Profile{}, c2Config)
+	if !valid || config["clientCertIdentity"] != "CN=test agent" {
+		t.Errorf("client certificate identity not reported: %v, %v", valid, config)
+	}
+	if _, config = (&API{}).C2RequirementsMet(protocol.Profile{}, map[string]string{}); len(config["clientCertIdentity"]) > 0 {
+		t.Errorf("identity reported without a client certificate: %v", config)
+	}
+}
+
+func TestAPIKeepsEncodersWhenTLSSettingsAreInvalid(t *testing.T) {
+	api := &API{}
+	if valid, _ := api.C2RequirementsMet(protocol.Profile{}, map[string]string{}); !valid {
+		t.Fatal("default settings rejected")
+	}
+	encoding, client := api.encoding, api.client
+	c2Config := map[string]string{"beaconEncoders": "plain-text", "tlsStrict": "sometimes"}
+	if valid, _ := api.C2RequirementsMet(protocol.Profile{}, c2Config); valid {
+		t.Fatal("invalid TLS settings accepted")
+	}
+	if api.encoding != encoding || api.client != client {
+		t.Error("failed reconfiguration replaced the encoders or the transport")
+	}
+}
+
+func writeTestFile(t *testing.T, data []byte) string {
+	file, err := ioutil.TempFile("", "sandcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
@@ -0,0 +1,330 @@
+package contact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+const (
+	udpDefaultPort    = "7021" // distinct from the port of CALDERA's raw UDP contact, which speaks another protocol
+	udpRequestTimeout = 60 * time.Second
+)
+
+// UDP communicates with the C2 server using protocol.Frame messages carried over a protocol.DatagramTransport,
+// which fragments messages into datagrams and acknowledges, retransmits and reassembles them. The server answers
+// each request with a message carrying the same ID, and responses from other addresses are ignored. The datagram MTU
+// and the number of unacknowledged fragments in flight are taken from the udpMtu and udpWindow C2 config settings.
+type UDP struct {
+	name             string
+	upstreamDestAddr string
+	configuredAddr   string // address from the C2 config, if any
+	encoding         *dataEncoding
+	mtu              int
+	window           int
+
+	mu         sync.Mutex // guards the transport, server address, pending requests and nextID
+	transport  *protocol.DatagramTransport
+	serverAddr *net.UDPAddr
+	pending    map[uint32]*udpRequest
+	nextID     uint32
+}
+
+// A request waiting for the server's response.
+type udpRequest struct {
+	serverAddr *net.UDPAddr // address the request was sent to, which the response must come from
+	response   chan protocol.Frame
+}
+
+func init() {
+	registerContact("UDP", func() Contact {
+		return &UDP{
+			name:    "UDP",
+			pending: make(map[uint32]*udpRequest),
+		}
+	})
+}
+
+func (u *UDP) GetBeaconBytes(profile protocol.Profile) []byte {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
+		return nil
+	}
+	encoded, err := u.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode beacon: %s", err.Error()))
+		return nil
+	}
+	response, err := u.request(protocol.Frame{Type: protocol.FrameBeacon, Data: encoded})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] UDP beacon failed: %s", err.Error()))
+		return nil
+	}
+	decoded, err := u.encoding.decodeBeacon(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode beacon response: %s", err.Error()))
+		return nil
+	}
+	return decoded
+}
+
+func (u *UDP) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	response, err := u.request(protocol.Frame{Type: protocol.FramePayload, Name: payload, Encoding: u.encoding.file.String()})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request: %s", err.Error()))
+		return nil, ""
+	}
+	payloadBytes, err := u.encoding.decodeFile(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error decoding payload: %s", err.Error()))
+		return nil, ""
+	}
+	return payloadBytes, response.Name
+}
+
+func (u *UDP) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	encoding, err := getDataEncoding(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up data encoders: %s", err.Error()))
+		return false, nil
+	}
+	mtu, err := getPositiveSetting(c2Config, "udpMtu", protocol.DefaultDatagramMTU)
+	if err == nil && mtu > protocol.MaxDatagramMTU {
+		err = errors.New(fmt.Sprintf("udpMtu must be at most %d, got %d", protocol.MaxDatagramMTU, mtu))
+	}
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - invalid UDP MTU: %s", err.Error()))
+		return false, nil
+	}
+	window, err := getPositiveSetting(c2Config, "udpWindow", protocol.DefaultDatagramWindow)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - invalid UDP window: %s", err.Error()))
+		return false, nil
+	}
+	u.configuredAddr = c2Config["udpAddr"]
+	serverAddr, err := getUDPAddr(u.configuredAddr, u.upstreamDestAddr)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not determine UDP server address: %s", err.Error()))
+		return false, nil
+	}
+	output.VerbosePrint(fmt.Sprintf("UDP server=%s, MTU=%d, window=%d", serverAddr.String(), mtu, window))
+	u.closeTransport()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.encoding = encoding
+	u.mtu = mtu
+	u.window = window
+	u.serverAddr = serverAddr
+	return true, nil
+}
+
+func (u *UDP) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return
+	}
+	encoded, err := u.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode results: %s", err.Error()))
+		return
+	}
+	if _, err = u.request(protocol.Frame{Type: protocol.FrameResults, Data: encoded}); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to send results over UDP: %s", err.Error()))
+	}
+}
+
+func (u *UDP) GetName() string {
+	return u.name
+}
+
+// Unless a UDP address was configured explicitly, the server address follows the upstream destination's host.
+func (u *UDP) SetUpstreamDestAddr(upstreamDestAddr string) {
+	u.upstreamDestAddr = upstreamDestAddr
+	serverAddr, err := getUDPAddr(u.configuredAddr, upstreamDestAddr)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not determine UDP server address: %s", err.Error()))
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.serverAddr = serverAddr
+}
+
+func (u *UDP) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	encoded, err := u.encoding.encodeFile(data)
+	if err != nil {
+		return err
+	}
+	_, err = u.request(protocol.Frame{Type: protocol.FrameUpload, Name: uploadName, Encoding: u.encoding.file.String(), Data: encoded})
+	return err
+}
+
+// Sends the frame to the server and waits for the response message with the same ID.
+func (u *UDP) request(frame protocol.Frame) (protocol.Frame, error) {
+	transport, serverAddr, err := u.getTransport()
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	pendingRequest := &udpRequest{serverAddr: serverAddr, response: make(chan protocol.Frame, 1)}
+	u.mu.Lock()
+	u.nextID++
+	frame.ID = u.nextID
+	u.pending[frame.ID] = pendingRequest
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		delete(u.pending, frame.ID)
+		u.mu.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	if err = protocol.WriteFrame(&buf, frame); err != nil {
+		return protocol.Frame{}, err
+	}
+	if err = transport.Send(serverAddr, frame.ID, buf.Bytes()); err != nil {
+		return protocol.Frame{}, err
+	}
+	select {
+	case response, ok := <-pendingRequest.response:
+		if !ok {
+			return response, errors.New("UDP transport closed before response was received.")
+		}
+		return response, response.Err()
+	case <-time.After(udpRequestTimeout):
+		return protocol.Frame{}, errors.New(fmt.Sprintf("Timed out waiting for response to frame type %d", frame.Type))
+	}
+}
+
+// Returns the current transport and server address, opening a new socket if the transport is not running.
+func (u *UDP) getTransport() (*protocol.DatagramTransport, *net.UDPAddr, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.transport != nil {
+		return u.transport, u.serverAddr, nil
+	}
+	conn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, err := protocol.NewDatagramTransport(conn, u.mtu, u.window)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	u.transport = transport
+	go u.receive(transport)
+	return transport, u.serverAddr, nil
+}
+
+// Receives messages until the transport fails, dispatching responses to waiting requests.
+func (u *UDP) receive(transport *protocol.DatagramTransport) {
+	for {
+		msg, err := transport.Receive()
+		if err != nil {
+			u.stopTransport(transport, err)
+			return
+		}
+		frame, err := protocol.ReadFrame(bytes.NewReader(msg.Data))
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[-] Received malformed UDP message: %s", err.Error()))
+			continue
+		}
+		u.mu.Lock()
+		pendingRequest, ok := u.pending[frame.ID]
+		if ok && !isUDPAddr(msg.Addr, pendingRequest.serverAddr) {
+			output.VerbosePrint(fmt.Sprintf("[-] Ignoring UDP response from unexpected address %s", msg.Addr.String()))
+			ok = false
+		}
+		if ok {
+			delete(u.pending, frame.ID)
+		}
+		u.mu.Unlock()
+		if ok {
+			pendingRequest.response <- frame
+		}
+	}
+}
+
+// Closes the given transport if it is still the current one and fails any requests waiting on it.
+func (u *UDP) stopTransport(transport *protocol.DatagramTransport, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.transport != transport {
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[!] UDP transport stopped: %s", err.Error()))
+	u.transport.Close()
+	u.transport = nil
+	for id, pendingRequest := range u.pending {
+		close(pendingRequest.response)
+		delete(u.pending, id)
+	}
+}
+
+// Close stops the transport to the server, if any. The next request starts a new one.
+func (u *UDP) Close() {
+	u.closeTransport()
+}
+
+func (u *UDP) closeTransport() {
+	u.mu.Lock()
+	transport := u.transport
+	u.mu.Unlock()
+	if transport != nil {
+		u.stopTransport(transport, errors.New("transport reset"))
+	}
+}
+
+// Returns the configured UDP address, or the upstream destination's host on the default UDP port.
+func getUDPAddr(configuredAddr string, upstreamDestAddr string) (*net.UDPAddr, error) {
+	addr := configuredAddr
+	if len(addr) > 0 {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, udpDefaultPort)
+		}
+	} else {
+		upstreamUrl, err := url.Parse(upstreamDestAddr)
+		if err != nil {
+			return nil, err
+		}
+		if len(upstreamUrl.Hostname()) == 0 {
+			return nil, errors.New(fmt.Sprintf("No host found in upstream address %s", upstreamDestAddr))
+		}
+		addr = net.JoinHostPort(upstreamUrl.Hostname(), udpDefaultPort)
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
+
+// Returns true if addr is the given UDP address.
+func isUDPAddr(addr net.Addr, udpAddr *net.UDPAddr) bool {
+	other, ok := addr.(*net.UDPAddr)
+	return ok && other.IP.Equal(udpAddr.IP) && other.Port == udpAddr.Port
+}
+
+// Returns the positive integer setting from the C2 config, or the default if it is not set.
+func getPositiveSetting(c2Config map[string]string, key string, defaultValue int) (int, error) {
+	setting, ok := c2Config[key]
+	if !ok || len(setting) == 0 {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(setting)
+	if err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, errors.New(fmt.Sprintf("%s must be positive, got %d", key, value))
+	}
+	return value, nil
+}
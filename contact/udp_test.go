@@ -0,0 +1,107 @@
+package contact
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/protocol"
+)
+
+func newTestUDPContact(t *testing.T, udpAddr string, mtu int) *UDP {
+	contact := &UDP{name: "UDP", pending: make(map[uint32]*udpRequest)}
+	contact.SetUpstreamDestAddr("http://127.0.0.1:8888")
+	c2Config := map[string]string{"udpAddr": udpAddr, "udpMtu": strconv.Itoa(mtu)}
+	if valid, _ := contact.C2RequirementsMet(protocol.Profile{}, c2Config); !valid {
+		t.Fatal("UDP contact requirements not met")
+	}
+	return contact
+}
+
+// Returns a datagram transport on a local port along with its address.
+func newTestDatagramTransport(t *testing.T) (*protocol.DatagramTransport, string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := protocol.NewDatagramTransport(conn, protocol.DefaultDatagramMTU, protocol.DefaultDatagramWindow)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return transport, conn.LocalAddr().String()
+}
+
+func sendTestFrame(transport *protocol.DatagramTransport, addr net.Addr, frame protocol.Frame) error {
+	var buf bytes.Buffer
+	if err := protocol.WriteFrame(&buf, frame); err != nil {
+		return err
+	}
+	return transport.Send(addr, frame.ID, buf.Bytes())
+}
+
+func TestUDPTransfersOverLossyNetwork(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	udpAddr, err := server.StartUDP(200, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetUDPLoss(3)
+	contact := newTestUDPContact(t, udpAddr, 200)
+	defer contact.closeTransport()
+	data := bytes.Repeat([]byte("udp"), 500)
+
+	if err = contact.UploadFileBytes(protocol.Profile{Paw: "udppaw"}, "upload.bin", data); err != nil {
+		t.Fatal(err)
+	}
+	if upload := server.RequireUpload(t, "upload.bin", time.Second); !bytes.Equal(upload.Data, data) {
+		t.Errorf("upload was not reassembled: got %d bytes", len(upload.Data))
+	}
+	server.AddPayload("payload.bin", data)
+	if payload, _ := contact.GetPayloadBytes(protocol.Profile{Paw: "udppaw"}, "payload.bin"); !bytes.Equal(payload, data) {
+		t.Errorf("payload was not reassembled: got %d bytes", len(payload))
+	}
+}
+
+func TestUDPIgnoresResponsesFromOtherAddresses(t *testing.T) {
+	server, serverAddr := newTestDatagramTransport(t)
+	defer server.Close()
+	spoofer, _ := newTestDatagramTransport(t)
+	defer spoofer.Close()
+	contact := newTestUDPContact(t, serverAddr, protocol.DefaultDatagramMTU)
+	defer contact.closeTransport()
+
+	go func() {
+		request, err := server.Receive()
+		if err != nil {
+			return
+		}
+		frame, err := protocol.ReadFrame(bytes.NewReader(request.Data))
+		if err != nil {
+			return
+		}
+		// The spoofed response arrives first and must not be taken for the server's.
+		if sendTestFrame(spoofer, request.Addr, protocol.Frame{Type: frame.Type, ID: frame.ID, Name: "spoofed", Data: []byte("spoofed")}) != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		sendTestFrame(server, request.Addr, protocol.Frame{Type: frame.Type, ID: frame.ID, Name: "payload.bin", Data: []byte("payload")})
+	}()
+	payload, name := contact.GetPayloadBytes(protocol.Profile{Paw: "udppaw"}, "payload.bin")
+	if string(payload) != "payload" || name != "payload.bin" {
+		t.Errorf("expected the server's payload, got %q named %s", payload, name)
+	}
+}
+
+func TestUDPRejectsOversizedMTU(t *testing.T) {
+	contact := &UDP{name: "UDP", pending: make(map[uint32]*udpRequest)}
+	contact.SetUpstreamDestAddr("http://127.0.0.1:8888")
+	c2Config := map[string]string{"udpMtu": strconv.Itoa(protocol.MaxDatagramMTU + 1)}
+	if valid, _ := contact.C2RequirementsMet(protocol.Profile{}, c2Config); valid {
+		t.Error("MTU above the maximum datagram size accepted")
+	}
+}
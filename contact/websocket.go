@@ -0,0 +1,424 @@
+package contact
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// WebSocket message types
+const (
+	wsBeacon       = "beacon"
+	wsResults      = "results"
+	wsPayload      = "payload"
+	wsUpload       = "upload"
+	wsPushedBeacon = "push"
+	wsKeepalive    = "keepalive"
+
+	wsDialTimeout       = 10 * time.Second
+	wsRequestTimeout    = 60 * time.Second
+	wsWriteTimeout      = 30 * time.Second
+	wsKeepaliveInterval = 30 * time.Second
+	wsKeepaliveTimeout  = 10 * time.Second
+	wsReadTimeout       = wsKeepaliveInterval + wsRequestTimeout // no message from the server for this long means the connection is dead
+)
+
+var apiWebSocket = "/websocket"
+
+// WebSocket communicates with the C2 server over a single persistent WebSocket connection. Beacons, results and
+// file transfers are multiplexed on the connection by message ID, and the server can push beacon responses at any
+// time. If the WebSocket upgrade fails, requests fall back to HTTP polling until a connection can be established.
+// Requests only fall back once it is certain that the server did not receive them over the WebSocket, so that
+// results and uploads are not submitted twice. Idle connections are kept alive with keepalive messages, and a
+// connection is closed once a request times out or nothing is received for too long. The connection is dialed
+// directly, so an HTTP proxy gateway only applies to the HTTP fallback.
+type WebSocket struct {
+	name             string
+	upstreamDestAddr string
+	encoding         *dataEncoding
+	tlsConfig        *tls.Config
+	fallback         *API
+
+	mu         sync.Mutex // guards encoding, conn, connClosed, dialing, resets, pending and nextID
+	conn       *websocket.Conn
+	connClosed chan struct{}
+	dialing    bool   // true while a connection is being established
+	resets     uint64 // incremented whenever the connection is reset, so that a dial in progress is discarded
+	pending    map[uint64]chan websocketMessage
+	nextID     uint64
+	writeMu    sync.Mutex
+
+	pushMu     sync.Mutex
+	pushQueue  [][]byte
+	pushSignal chan struct{}
+}
+
+// Message exchanged over the WebSocket connection. Data is encoded with the contact's beacon encoders for beacons
+// and results, and with its file encoders for payloads and uploads.
+type websocketMessage struct {
+	ID       uint64 `json:"id"`
+	Type     string `json:"type"`
+	Name     string `json:"name,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func init() {
+	registerContact("WebSocket", func() Contact {
+		return &WebSocket{
+			name:       "WebSocket",
+			fallback:   &API{name: "HTTP"},
+			pending:    make(map[uint64]chan websocketMessage),
+			pushSignal: make(chan struct{}, 1),
+		}
+	})
+}
+
+func (w *WebSocket) GetBeaconBytes(profile protocol.Profile) []byte {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
+		return nil
+	}
+	encoded, err := w.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode beacon: %s", err.Error()))
+		return nil
+	}
+	response, sent, err := w.request(websocketMessage{Type: wsBeacon, Data: encoded}, wsRequestTimeout)
+	if err != nil && !sent {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket beacon failed, falling back to HTTP: %s", err.Error()))
+		return w.fallback.GetBeaconBytes(profile)
+	} else if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket beacon failed: %s", err.Error()))
+		return nil
+	}
+	decoded, err := w.encoding.decodeBeacon(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode beacon response: %s", err.Error()))
+		return nil
+	}
+	return decoded
+}
+
+func (w *WebSocket) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	response, sent, err := w.request(websocketMessage{Type: wsPayload, Name: payload, Encoding: w.encoding.file.String()}, wsRequestTimeout)
+	if err != nil && !sent {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket payload request failed, falling back to HTTP: %s", err.Error()))
+		return w.fallback.GetPayloadBytes(profile, payload)
+	} else if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket payload request failed: %s", err.Error()))
+		return nil, ""
+	}
+	payloadBytes, err := w.encoding.decodeFile(response.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error decoding payload: %s", err.Error()))
+		return nil, ""
+	}
+	return payloadBytes, response.Name
+}
+
+func (w *WebSocket) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	encoding, err := getDataEncoding(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not set up data encoders: %s", err.Error()))
+		return false, nil
+	}
+	tlsConfig, err := buildTLSConfig(c2Config)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Error - could not establish TLS requirements: %s", err.Error()))
+		return false, nil
+	}
+	valid, config := w.fallback.C2RequirementsMet(profile, c2Config)
+	if !valid {
+		return false, nil
+	}
+	w.tlsConfig = tlsConfig
+	w.closeConnection()
+	// The receivers of earlier connections keep the encoding they were started with.
+	w.mu.Lock()
+	w.encoding = encoding
+	w.mu.Unlock()
+	if _, err = w.getConnection(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] WebSocket upgrade failed, using HTTP polling until it succeeds: %s", err.Error()))
+	}
+	return true, config
+}
+
+func (w *WebSocket) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return
+	}
+	encoded, err := w.encoding.encodeBeacon(data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to encode results: %s", err.Error()))
+		return
+	}
+	if _, sent, err := w.request(websocketMessage{Type: wsResults, Data: encoded}, wsRequestTimeout); err != nil && !sent {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket result submission failed, falling back to HTTP: %s", err.Error()))
+		profile.Results = nil
+		w.fallback.SendExecutionResults(profile, result)
+	} else if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket result submission failed: %s", err.Error()))
+	}
+}
+
+func (w *WebSocket) GetName() string {
+	return w.name
+}
+
+func (w *WebSocket) SetUpstreamDestAddr(upstreamDestAddr string) {
+	if upstreamDestAddr != w.upstreamDestAddr {
+		w.closeConnection()
+	}
+	w.upstreamDestAddr = upstreamDestAddr
+	w.fallback.SetUpstreamDestAddr(upstreamDestAddr)
+}
+
+func (w *WebSocket) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	encoded, err := w.encoding.encodeFile(data)
+	if err != nil {
+		return err
+	}
+	_, sent, err := w.request(websocketMessage{Type: wsUpload, Name: uploadName, Data: encoded, Encoding: w.encoding.file.String()}, wsRequestTimeout)
+	if err != nil && !sent {
+		output.VerbosePrint(fmt.Sprintf("[-] WebSocket upload failed, falling back to HTTP: %s", err.Error()))
+		return w.fallback.UploadFileBytes(profile, uploadName, data)
+	}
+	return err
+}
+
+// Blocks until the server pushes a beacon response or the timeout expires. Returns nil on timeout.
+func (w *WebSocket) WaitForPushedBeacon(timeout time.Duration) []byte {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.pushMu.Lock()
+		if len(w.pushQueue) > 0 {
+			pushed := w.pushQueue[0]
+			w.pushQueue = w.pushQueue[1:]
+			w.pushMu.Unlock()
+			return pushed
+		}
+		w.pushMu.Unlock()
+		select {
+		case <-w.pushSignal:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// Sends the message and waits for the server's response with the same ID. Returns whether the message was written
+// to the connection, in which case the server may have acted on it even if an error is returned. The connection is
+// closed if the write or the response times out, so that the next request starts over on a new connection.
+func (w *WebSocket) request(msg websocketMessage, timeout time.Duration) (websocketMessage, bool, error) {
+	conn, err := w.getConnection()
+	if err != nil {
+		return websocketMessage{}, false, err
+	}
+	responseChan := make(chan websocketMessage, 1)
+	w.mu.Lock()
+	w.nextID++
+	msg.ID = w.nextID
+	w.pending[msg.ID] = responseChan
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		delete(w.pending, msg.ID)
+		w.mu.Unlock()
+	}()
+
+	w.writeMu.Lock()
+	if err = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err == nil {
+		err = websocket.JSON.Send(conn, msg)
+	}
+	w.writeMu.Unlock()
+	if err != nil {
+		// A failed write may still have delivered part of the frame, which the server cannot parse.
+		w.disconnect(conn, err)
+		return websocketMessage{}, false, err
+	}
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return response, true, errors.New("WebSocket connection closed before response was received.")
+		}
+		if len(response.Error) > 0 {
+			return response, true, errors.New(response.Error)
+		}
+		return response, true, nil
+	case <-time.After(timeout):
+		err = errors.New(fmt.Sprintf("Timed out waiting for %s response", msg.Type))
+		w.disconnect(conn, err)
+		return websocketMessage{}, true, err
+	}
+}
+
+// Returns the current connection, establishing a new one if needed. Requests made while another request is
+// establishing the connection fail immediately instead of waiting for the dial.
+func (w *WebSocket) getConnection() (*websocket.Conn, error) {
+	w.mu.Lock()
+	if w.conn != nil {
+		defer w.mu.Unlock()
+		return w.conn, nil
+	}
+	if w.dialing {
+		w.mu.Unlock()
+		return nil, errors.New("WebSocket connection is being established.")
+	}
+	w.dialing = true
+	resets := w.resets
+	w.mu.Unlock()
+
+	conn, location, err := w.dial()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dialing = false
+	if err != nil {
+		return nil, err
+	}
+	if w.resets != resets {
+		conn.Close()
+		return nil, errors.New("WebSocket connection was reset while it was being established.")
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] WebSocket connection established to %s", location))
+	w.conn = conn
+	w.connClosed = make(chan struct{})
+	go w.receive(conn, w.encoding)
+	go w.keepAlive(conn, w.connClosed)
+	return conn, nil
+}
+
+// Dials the WebSocket endpoint of the upstream destination. Returns the connection and the endpoint address.
+func (w *WebSocket) dial() (*websocket.Conn, string, error) {
+	config, err := websocket.NewConfig(getWebSocketAddr(w.upstreamDestAddr), w.upstreamDestAddr)
+	if err != nil {
+		return nil, "", err
+	}
+	config.TlsConfig = w.tlsConfig
+	config.Dialer = &net.Dialer{Timeout: wsDialTimeout}
+	config.Header.Set("User-Agent", userAgent)
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, config.Location.String(), nil
+}
+
+// Reads messages from the connection until it fails, dispatching responses to waiting requests and queueing
+// pushed beacon responses, which are decoded with the encoding in use when the connection was established.
+func (w *WebSocket) receive(conn *websocket.Conn, encoding *dataEncoding) {
+	for {
+		var msg websocketMessage
+		if err := conn.SetReadDeadline(time.Now().Add(wsReadTimeout)); err != nil {
+			w.disconnect(conn, err)
+			return
+		}
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			w.disconnect(conn, err)
+			return
+		}
+		if msg.Type == wsPushedBeacon {
+			w.queuePushedBeacon(msg, encoding)
+			continue
+		}
+		w.mu.Lock()
+		responseChan, ok := w.pending[msg.ID]
+		delete(w.pending, msg.ID)
+		w.mu.Unlock()
+		if ok {
+			responseChan <- msg
+		}
+	}
+}
+
+// Periodically sends keepalive messages so that idle connections are not dropped by intermediate devices, and so
+// that dead connections are noticed before the next beacon.
+func (w *WebSocket) keepAlive(conn *websocket.Conn, closed chan struct{}) {
+	ticker := time.NewTicker(wsKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+			// Any response, even an error, shows that the connection is alive.
+			if response, _, err := w.request(websocketMessage{Type: wsKeepalive}, wsKeepaliveTimeout); err != nil && len(response.Error) == 0 {
+				output.VerbosePrint(fmt.Sprintf("[-] WebSocket keepalive failed: %s", err.Error()))
+				return
+			}
+		}
+	}
+}
+
+func (w *WebSocket) queuePushedBeacon(msg websocketMessage, encoding *dataEncoding) {
+	decoded, err := encoding.decodeBeacon(msg.Data)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to decode pushed beacon: %s", err.Error()))
+		return
+	}
+	output.VerbosePrint("[*] Received pushed beacon over WebSocket")
+	w.pushMu.Lock()
+	w.pushQueue = append(w.pushQueue, decoded)
+	w.pushMu.Unlock()
+	select {
+	case w.pushSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Closes the given connection if it is still the current one and fails any requests waiting on it.
+func (w *WebSocket) disconnect(conn *websocket.Conn, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != conn {
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[!] WebSocket connection lost: %s", err.Error()))
+	w.conn.Close()
+	w.conn = nil
+	close(w.connClosed)
+	for id, responseChan := range w.pending {
+		close(responseChan)
+		delete(w.pending, id)
+	}
+}
+
+// Close closes the WebSocket connection, if any, and the idle connections of the HTTP fallback.
+func (w *WebSocket) Close() {
+	w.closeConnection()
+	w.fallback.Close()
+}
+
+func (w *WebSocket) closeConnection() {
+	w.mu.Lock()
+	conn := w.conn
+	w.resets++
+	w.mu.Unlock()
+	if conn != nil {
+		w.disconnect(conn, errors.New("connection reset"))
+	}
+}
+
+// Converts the http(s) upstream address into the ws(s) WebSocket endpoint.
+func getWebSocketAddr(upstreamDestAddr string) string {
+	if strings.HasPrefix(upstreamDestAddr, "https://") {
+		return "wss://" + strings.TrimPrefix(upstreamDestAddr, "https://") + apiWebSocket
+	}
+	return "ws://" + strings.TrimPrefix(upstreamDestAddr, "http://") + apiWebSocket
+}
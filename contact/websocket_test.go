@@ -0,0 +1,142 @@
+package contact
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Returns a WebSocket contact set up to talk to the given upstream address.
+func newTestWebSocketContact(t *testing.T, upstreamDestAddr string) *WebSocket {
+	contact := &WebSocket{
+		name:       "WebSocket",
+		fallback:   &API{name: "HTTP"},
+		pending:    make(map[uint64]chan websocketMessage),
+		pushSignal: make(chan struct{}, 1),
+	}
+	contact.SetUpstreamDestAddr(upstreamDestAddr)
+	if valid, _ := contact.C2RequirementsMet(protocol.Profile{}, map[string]string{}); !valid {
+		t.Fatal("WebSocket contact requirements not met")
+	}
+	return contact
+}
+
+func (w *WebSocket) isConnected() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn != nil
+}
+
+func TestWebSocketBeaconAndPushedBeacon(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	contact := newTestWebSocketContact(t, server.URL())
+	defer contact.Close()
+	profile := protocol.Profile{Paw: "wspaw", Platform: "linux"}
+	if contact.GetBeaconBytes(profile) == nil {
+		t.Fatal("beacon failed")
+	}
+	server.RequireBeacons(t, 1, time.Second)
+
+	server.QueueInstruction(c2test.NewInstruction("link-pushed", "sh", "echo pushed"))
+	if pushed, err := server.Push(); err != nil || pushed != 1 {
+		t.Fatalf("push reached %d agents: %v", pushed, err)
+	}
+	pushedBeacon, err := protocol.ParseBeacon(contact.WaitForPushedBeacon(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pushedBeacon.Instructions) != 1 || pushedBeacon.Instructions[0].ID != "link-pushed" {
+		t.Errorf("unexpected instructions in pushed beacon: %+v", pushedBeacon.Instructions)
+	}
+}
+
+func TestWebSocketReconfiguresWhilePushing(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	contact := newTestWebSocketContact(t, server.URL())
+	defer contact.Close()
+	profile := protocol.Profile{Paw: "wspaw", Platform: "linux"}
+
+	done := make(chan struct{})
+	pushing := make(chan struct{})
+	go func() {
+		defer close(pushing)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.Push()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if contact.GetBeaconBytes(profile) == nil {
+			t.Fatal("beacon failed")
+		}
+		if valid, _ := contact.C2RequirementsMet(profile, map[string]string{}); !valid {
+			t.Fatal("WebSocket contact requirements not met")
+		}
+	}
+	close(done)
+	<-pushing
+	if contact.WaitForPushedBeacon(time.Second) == nil {
+		t.Error("no beacon pushed while the contact was reconfigured")
+	}
+}
+
+func TestWebSocketFallsBackToHTTPWithoutUpgrade(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	serverUrl, err := url.Parse(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", httputil.NewSingleHostReverseProxy(serverUrl))
+	mux.HandleFunc(apiWebSocket, http.NotFound)
+	httpOnly := httptest.NewServer(mux)
+	defer httpOnly.Close()
+
+	contact := newTestWebSocketContact(t, httpOnly.URL)
+	defer contact.Close()
+	if contact.GetBeaconBytes(protocol.Profile{Paw: "wspaw", Platform: "linux"}) == nil {
+		t.Fatal("beacon over the HTTP fallback failed")
+	}
+	server.RequireBeacons(t, 1, time.Second)
+}
+
+func TestWebSocketClosesConnectionOnRequestTimeout(t *testing.T) {
+	// The server reads requests but never answers them.
+	silent := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		var msg websocketMessage
+		for websocket.JSON.Receive(conn, &msg) == nil {
+		}
+	}))
+	defer silent.Close()
+	contact := newTestWebSocketContact(t, silent.URL)
+	defer contact.Close()
+	if !contact.isConnected() {
+		t.Fatal("WebSocket connection not established")
+	}
+
+	_, sent, err := contact.request(websocketMessage{Type: wsBeacon}, 100*time.Millisecond)
+	if err == nil || !sent {
+		t.Fatalf("expected a timeout after sending, got sent=%v, err=%v", sent, err)
+	}
+	if contact.isConnected() {
+		t.Error("connection kept open after a request timed out")
+	}
+	if _, err = contact.getConnection(); err != nil {
+		t.Errorf("no new connection after a request timed out: %s", err.Error())
+	}
+}
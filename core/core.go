@@ -1,104 +1,231 @@
 package core
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
-	"reflect"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/mitre/gocat/agent"
+	"github.com/mitre/gocat/config"
 	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/execute"
 	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
 
 	_ "github.com/mitre/gocat/execute/donut"     // necessary to initialize all submodules
 	_ "github.com/mitre/gocat/execute/shellcode" // necessary to initialize all submodules
 	_ "github.com/mitre/gocat/execute/shells"    // necessary to initialize all submodules
 )
 
-// Initializes and returns sandcat agent.
-func initializeCore(server string, tunnelConfig *contact.TunnelConfig, group string, contactConfig map[string]string, p2pReceiversOn bool, initialDelay int, verbose bool, paw string, originLinkID string) (*agent.Agent, error) {
-	output.SetVerbose(verbose)
-	output.VerbosePrint("Starting sandcat in verbose mode.")
-	return agent.AgentFactory(server, tunnelConfig, group, contactConfig, p2pReceiversOn, initialDelay, paw, originLinkID)
+// Seconds to sleep after a failed beacon, unless the configuration sets a sleep.
+const defaultSleep = 15
+
+// How long the agent may overrun its kill date, e.g. while blocked on an instruction or an unreachable server, before
+// it is forced to terminate.
+const killDateGracePeriod = time.Minute
+
+// How long forced termination waits for the deadman instructions and cleanup before the agent exits regardless.
+const forcedTerminationTimeout = time.Minute
+
+// Initializes and returns sandcat agent, along with the contact settings it uses. The initial delay ends at the kill
+// date at the latest.
+func initializeCore(agentConfig *config.Config, killDate time.Time) (*agent.Agent, map[string]string, error) {
+	if len(agentConfig.Servers) == 0 {
+		return nil, nil, errors.New("No C2 server configured.")
+	}
+	server := agentConfig.Servers[0]
+	tunnelConfig, err := contact.BuildTunnelConfig(agentConfig.Tunnel.Protocol, agentConfig.Tunnel.Addr, server.Address, agentConfig.Tunnel.Username, agentConfig.Tunnel.Password)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Error building tunnel config: %s", err.Error()))
+	}
+	contactConfig := agentConfig.GetContactConfig()
+	delay := int(capSleepAtKillDate(float64(agentConfig.Delay), killDate))
+	sandcatAgent, err := agent.AgentFactory(agentConfig.Servers, tunnelConfig, agentConfig.Group, contactConfig, agentConfig.Peers, agentConfig.ListenP2P, delay, agentConfig.Paw, agentConfig.OriginLinkID, agentConfig.MaxJobs, agentConfig.JobQueueSize)
+	return sandcatAgent, contactConfig, err
 }
 
 //Core is the main function as wrapped by sandcat.go
-func Core(server string, tunnelConfig *contact.TunnelConfig, group string, delay int, contactConfig map[string]string, p2pReceiversOn bool, verbose bool, paw string, originLinkID string) {
-	sandcatAgent, err := initializeCore(server, tunnelConfig, group, contactConfig, p2pReceiversOn, delay, verbose, paw, originLinkID)
+func Core(agentConfig *config.Config, verbose bool) {
+	output.SetVerbose(verbose)
+	output.VerbosePrint("Starting sandcat in verbose mode.")
+	killDate, err := getKillDate(agentConfig, time.Now())
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Invalid kill date or max runtime: %s", err.Error()))
+		return
+	}
+	if killDateReached(killDate) {
+		output.VerbosePrint("[!] Kill date reached. Exiting.")
+		return
+	}
+	scope := agentConfig.Scope
+	if err = execute.SetScope(scope.AllowedHosts, scope.BlockedCommands, scope.BlockedPaths); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Invalid engagement scope: %s", err.Error()))
+		return
+	}
+	policy, err := newSleepPolicy(agentConfig)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Invalid beacon timing: %s", err.Error()))
+		return
+	}
+	sandcatAgent, contactConfig, err := initializeCore(agentConfig, killDate)
 	if err != nil {
 		output.VerbosePrint(fmt.Sprintf("[-] Error when initializing agent: %s", err.Error()))
 		output.VerbosePrint("[-] Exiting.")
 	} else {
+		var termination sync.Once
+		terminated := make(chan struct{})
+		terminate := func() {
+			termination.Do(func() {
+				sandcatAgent.Terminate()
+				close(terminated)
+			})
+		}
+		if !killDate.IsZero() {
+			// Running instructions are cancelled at the kill date rather than awaited.
+			cancelled := make(chan struct{})
+			jobCancellation := time.AfterFunc(time.Until(killDate), func() {
+				defer close(cancelled)
+				output.VerbosePrint("[!] Kill date reached. Cancelling running instructions.")
+				sandcatAgent.CancelAllInstructions()
+			})
+			defer func() {
+				if !jobCancellation.Stop() {
+					<-cancelled
+				}
+			}()
+			forcedTermination := time.AfterFunc(time.Until(killDate)+killDateGracePeriod, func() {
+				output.VerbosePrint("[!] Agent still running after kill date. Forcing termination.")
+				// Termination may already be under way and hang, so it is only awaited for a bounded time.
+				go terminate()
+				select {
+				case <-terminated:
+				case <-time.After(forcedTerminationTimeout):
+					output.VerbosePrint("[!] Termination did not finish in time. Exiting.")
+				}
+				os.Exit(0)
+			})
+			defer forcedTermination.Stop()
+		}
+		sandcatAgent.SetKillDate(killDate)
 		sandcatAgent.Display()
-		runAgent(sandcatAgent, contactConfig)
-		sandcatAgent.Terminate()
+		runAgent(sandcatAgent, contactConfig, policy, killDate)
+		terminate()
 	}
 }
 
 // Establish contact with C2 and run instructions.
-func runAgent(sandcatAgent *agent.Agent, c2Config map[string]string) {
+func runAgent(sandcatAgent *agent.Agent, c2Config map[string]string, policy *sleepPolicy, killDate time.Time) {
 	// Start main execution loop.
 	watchdog := 0
 	checkin := time.Now()
 	lastDiscovery := time.Now()
 	var sleepDuration float64
+	var pushedBeacon *protocol.Beacon
 
-	for evaluateWatchdog(checkin, watchdog) {
-		// Send beacon and get response.
-		beacon := sandcatAgent.Beacon()
+	for evaluateWatchdog(checkin, watchdog) && !killDateReached(killDate) {
+		// Stay quiet outside the beacon schedule. Time spent waiting does not count towards the watchdog. A beacon
+		// that the server pushed before is only processed once the schedule allows the agent to beacon again.
+		if quiet := policy.untilActive(time.Now()); quiet > 0 {
+			output.VerbosePrint(fmt.Sprintf("[*] Outside beacon schedule. Sleeping for %s", quiet.Round(time.Second)))
+			quietStart := time.Now()
+			sandcatAgent.SleepQuietly(capSleepAtKillDate(quiet.Seconds(), killDate))
+			checkin = checkin.Add(time.Since(quietStart))
+			continue
+		}
+
+		// Send beacon and get response, unless the server already pushed one. The primary C2 server is probed first
+		// if the agent failed over to another server or a peer.
+		beacon := pushedBeacon
+		if beacon == nil {
+			beacon = sandcatAgent.AttemptFailback()
+		}
+		if beacon == nil {
+			beacon = sandcatAgent.Beacon()
+		}
 
 		// Process beacon response.
-		if len(beacon) != 0 {
-			sandcatAgent.SetPaw(beacon["paw"].(string))
+		if beacon != nil {
+			sandcatAgent.SetPaw(beacon.Paw)
 			checkin = time.Now()
-			sleepDuration = float64(beacon["sleep"].(int))
-			watchdog = beacon["watchdog"].(int)
+			sleepDuration = policy.afterSuccess(float64(beacon.Sleep))
+			watchdog = beacon.Watchdog
 		} else {
 			// Failed beacon
 			if err := sandcatAgent.HandleBeaconFailure(); err != nil {
 				output.VerbosePrint(fmt.Sprintf("[!] Error handling failed beacon: %s", err.Error()))
 				return
 			}
-			sleepDuration = float64(15)
+			sleepDuration = policy.afterFailure()
 		}
 
 		// Check if we need to change contacts
-		if beacon["new_contact"] != nil {
-			newChannel := beacon["new_contact"].(string)
-			c2Config["c2Name"] = newChannel
+		if beacon != nil && len(beacon.NewContact) > 0 {
+			newChannel := beacon.NewContact
 			output.VerbosePrint(fmt.Sprintf("Received request to switch from C2 channel %s to %s", sandcatAgent.GetCurrentContactName(), newChannel))
-			if err := sandcatAgent.AttemptSelectComChannel(c2Config, newChannel); err != nil {
+			if err := sandcatAgent.ProcessContactChange(c2Config, newChannel); err != nil {
 				output.VerbosePrint(fmt.Sprintf("[!] Error switching communication channels: %s", err.Error()))
 			}
 		}
 
 		// Check if we need to update executors
-		if beacon["executor_change"] != nil {
-			if err := sandcatAgent.ProcessExecutorChange(beacon["executor_change"]); err != nil {
+		if beacon != nil && beacon.ExecutorChange != nil {
+			if err := sandcatAgent.ProcessExecutorChange(*beacon.ExecutorChange); err != nil {
 				output.VerbosePrint(fmt.Sprintf("[!] Error updating executor: %s", err.Error()))
 			}
 		}
 
+		// Check if we need to change data encoders
+		if beacon != nil && (len(beacon.BeaconEncoders) > 0 || len(beacon.FileEncoders) > 0) {
+			if err := sandcatAgent.ProcessEncoderChange(c2Config, beacon.BeaconEncoders, beacon.FileEncoders); err != nil {
+				output.VerbosePrint(fmt.Sprintf("[!] Error updating data encoders: %s", err.Error()))
+			}
+		}
+
+		// Check if we received a TLS client certificate
+		if beacon != nil && beacon.ClientCertificate != nil {
+			if err := sandcatAgent.ProcessClientCertificate(c2Config, *beacon.ClientCertificate); err != nil {
+				output.VerbosePrint(fmt.Sprintf("[!] Error updating TLS client certificate: %s", err.Error()))
+			}
+		}
+
+		// Check if the server changed the beacon timing
+		if beacon != nil && (beacon.Jitter != nil || beacon.MaxSleep != nil || beacon.Schedule != nil) {
+			policy.update(beacon)
+		}
+
+		// Check if we received a peer-to-peer group key
+		if beacon != nil && len(beacon.P2pKey) > 0 {
+			sandcatAgent.ProcessP2pKey(beacon.P2pKey)
+		}
+
+		// Check if the server asked to cancel running instructions
+		if beacon != nil && len(beacon.CancelLinks) > 0 {
+			sandcatAgent.CancelInstructions(beacon.CancelLinks)
+		}
+
 		// Handle instructions
-		if beacon["instructions"] != nil && len(beacon["instructions"].([]interface{})) > 0 {
+		if beacon != nil {
+			// Report instructions that failed validation instead of running them.
+			for _, rejected := range beacon.RejectedInstructions {
+				sandcatAgent.ReportRejectedInstruction(rejected)
+			}
+
 			// Run commands and send results.
-			instructions := reflect.ValueOf(beacon["instructions"])
-			for i := 0; i < instructions.Len(); i++ {
-				marshaledInstruction := instructions.Index(i).Elem().String()
-				var instruction map[string]interface{}
-				if err := json.Unmarshal([]byte(marshaledInstruction), &instruction); err != nil {
-					output.VerbosePrint(fmt.Sprintf("[-] Error unpacking command: %v", err.Error()))
+			for _, instruction := range beacon.Instructions {
+				// If instruction is deadman, save it for later. Otherwise, run the instruction.
+				if instruction.Deadman {
+					output.VerbosePrint(fmt.Sprintf("[*] Received deadman instruction %s", instruction.ID))
+					sandcatAgent.StoreDeadmanInstruction(instruction)
+				} else if killDateReached(killDate) {
+					output.VerbosePrint(fmt.Sprintf("[!] Kill date reached. Not running instruction %s", instruction.ID))
 				} else {
-					// If instruction is deadman, save it for later. Otherwise, run the instruction.
-					if instruction["deadman"].(bool) {
-						output.VerbosePrint(fmt.Sprintf("[*] Received deadman instruction %s", instruction["id"]))
-						sandcatAgent.StoreDeadmanInstruction(instruction)
-					} else {
-						output.VerbosePrint(fmt.Sprintf("[*] Running instruction %s", instruction["id"]))
-						go sandcatAgent.RunInstruction(instruction, true)
-						sandcatAgent.Sleep(instruction["sleep"].(float64))
-					}
+					output.VerbosePrint(fmt.Sprintf("[*] Running instruction %s", instruction.ID))
+					sandcatAgent.ScheduleInstruction(instruction)
+					sandcatAgent.Sleep(capSleepAtKillDate(instruction.Sleep, killDate))
 				}
 			}
 		}
@@ -108,7 +235,10 @@ func runAgent(sandcatAgent *agent.Agent, c2Config map[string]string) {
 			lastDiscovery = time.Now()
 		}
 
-		sandcatAgent.Sleep(sleepDuration)
+		pushedBeacon = sandcatAgent.SleepUntilNextBeacon(capSleepAtKillDate(policy.capAtQuietHours(sleepDuration, time.Now()), killDate))
+	}
+	if killDateReached(killDate) {
+		output.VerbosePrint("[!] Kill date reached.")
 	}
 }
 
@@ -117,6 +247,49 @@ func evaluateWatchdog(lastcheckin time.Time, watchdog int) bool {
 	return watchdog <= 0 || float64(time.Now().Sub(lastcheckin).Seconds()) <= float64(watchdog)
 }
 
+// Randomly varies the sleep by up to the given percentage in either direction.
+func applyJitter(sleepDuration float64, jitter int) float64 {
+	if jitter <= 0 {
+		return sleepDuration
+	}
+	return sleepDuration * (1 + float64(jitter)/100*(2*rand.Float64()-1))
+}
+
+// Returns the time at which the agent exits, which is the RFC 3339 kill date or the end of the maximum runtime
+// counted from start, whichever comes first. Returns the zero time if neither is set.
+func getKillDate(agentConfig *config.Config, start time.Time) (time.Time, error) {
+	var killDate time.Time
+	if len(agentConfig.KillDate) > 0 {
+		parsed, err := time.Parse(time.RFC3339, agentConfig.KillDate)
+		if err != nil {
+			return time.Time{}, err
+		}
+		killDate = parsed
+	}
+	if len(agentConfig.MaxRuntime) > 0 {
+		maxRuntime, err := time.ParseDuration(agentConfig.MaxRuntime)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if runtimeEnd := start.Add(maxRuntime); killDate.IsZero() || runtimeEnd.Before(killDate) {
+			killDate = runtimeEnd
+		}
+	}
+	return killDate, nil
+}
+
+func killDateReached(killDate time.Time) bool {
+	return !killDate.IsZero() && !time.Now().Before(killDate)
+}
+
+// Shortens the sleep so that the agent wakes up at the kill date.
+func capSleepAtKillDate(sleepDuration float64, killDate time.Time) float64 {
+	if killDate.IsZero() {
+		return sleepDuration
+	}
+	return math.Min(sleepDuration, math.Max(time.Until(killDate).Seconds(), 0))
+}
+
 func findPeers(last time.Time, sandcatAgent *agent.Agent) bool {
 	minDiscoveryInterval := 300
 	diff := float64(time.Now().Sub(last).Seconds())
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/c2test"
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/execute"
+	"github.com/mitre/gocat/protocol"
+)
+
+func newTestConfig(server *c2test.Server, maxRuntime string) *config.Config {
+	return &config.Config{
+		Servers: []config.Server{{Address: server.URL()}},
+		Group:   "red",
+		Contacts: map[string]string{
+			"c2Name":         "HTTP",
+			"beaconEncoders": "base64",
+			"fileEncoders":   "plain-text",
+		},
+		MaxRuntime: maxRuntime,
+	}
+}
+
+// Runs the agent against the mock server in the background. The returned channel is closed once the agent exits.
+func startCore(agentConfig *config.Config) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Core(agentConfig, false)
+	}()
+	return done
+}
+
+func TestCoreRunsInstructionAndSubmitsResult(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "c2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uploadPath := filepath.Join(dir, "loot.txt")
+	if err = ioutil.WriteFile(uploadPath, []byte("loot"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	instruction := c2test.NewInstruction("link-1", "sh", "echo hello")
+	instruction.Uploads = []string{uploadPath}
+	server.QueueInstruction(instruction)
+
+	done := startCore(newTestConfig(server, "5s"))
+
+	beacons := server.RequireBeacons(t, 1, 10*time.Second)
+	if beacons[0].Platform == "" || beacons[0].Contact != "HTTP" {
+		t.Errorf("unexpected profile in first beacon: %+v", beacons[0])
+	}
+	result := server.RequireResultStatus(t, "link-1", execute.SUCCESS_STATUS, 10*time.Second)
+	if strings.TrimSpace(string(result.Output)) != "hello" {
+		t.Errorf("expected output hello, got %q", string(result.Output))
+	}
+	if upload := server.RequireUpload(t, "loot.txt", 10*time.Second); string(upload.Data) != "loot" {
+		t.Errorf("expected uploaded data loot, got %q", string(upload.Data))
+	}
+	server.RequireBeacons(t, 2, 10*time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("agent did not exit after its maximum runtime")
+	}
+}
+
+func TestCoreReportsMalformedInstruction(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	server.QueueRawInstruction(`{"id": "link-bad", "executor": "sh", "command": "not base64!"}`)
+
+	done := startCore(newTestConfig(server, "3s"))
+
+	server.RequireResultStatus(t, "link-bad", execute.ERROR_STATUS, 10*time.Second)
+	<-done
+}
+
+func TestCoreSwitchesEncoders(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	server.SetEncoderChange([]string{"plain-text"}, []string{"base64"})
+	server.QueueInstruction(c2test.NewInstruction("link-1", "sh", "echo switched"))
+
+	done := startCore(newTestConfig(server, "4s"))
+
+	server.RequireResultStatus(t, "link-1", execute.SUCCESS_STATUS, 10*time.Second)
+	server.RequireBeacons(t, 2, 10*time.Second)
+	<-done
+}
+
+func TestCoreCancelsInstructionsAtKillDate(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	server.QueueInstruction(c2test.NewInstruction("link-long", "sh", "sleep 60"))
+
+	done := startCore(newTestConfig(server, "3s"))
+
+	// The instruction would outlast the test if the agent waited for it.
+	server.RequireResultStatus(t, "link-long", execute.CANCELLED_STATUS, 20*time.Second)
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("agent did not exit after its maximum runtime")
+	}
+}
+
+func TestCoreEnforcesScopeBeforePayloadsAndUploads(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "c2test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blockedPath := filepath.Join(dir, "secret.txt")
+	if err = ioutil.WriteFile(blockedPath, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server.AddPayload("tool.sh", []byte("echo tool"))
+	refused := c2test.NewInstruction("link-refused", "sh", "rm -rf /tmp/target")
+	refused.Payloads = []string{"tool.sh"}
+	server.QueueInstruction(refused)
+	// Uploads from blocked paths are refused even if the instruction fails before its command is checked.
+	undecodable := c2test.NewInstruction("link-undecodable", "sh", "")
+	undecodable.Command = "not base64!"
+	undecodable.Uploads = []string{blockedPath}
+	server.QueueInstruction(undecodable)
+
+	agentConfig := newTestConfig(server, "4s")
+	agentConfig.Scope = config.Scope{BlockedCommands: []string{"rm -rf"}, BlockedPaths: []string{dir}}
+	done := startCore(agentConfig)
+
+	server.RequireResultStatus(t, "link-refused", execute.OUT_OF_SCOPE_STATUS, 10*time.Second)
+	server.RequireResultStatus(t, "link-undecodable", execute.ERROR_STATUS, 10*time.Second)
+	<-done
+	if downloads := server.Downloads(); len(downloads) > 0 {
+		t.Errorf("payloads downloaded for a refused instruction: %v", downloads)
+	}
+	if uploads := server.Uploads(); len(uploads) > 0 {
+		t.Errorf("file uploaded from a blocked path: %s", uploads[0].Name)
+	}
+}
+
+func TestCoreRefusesInvalidTunnelConfig(t *testing.T) {
+	// The agent would otherwise bypass the requested tunnel or crash on the missing tunnel config.
+	agentConfig := &config.Config{Servers: []config.Server{{Address: "http://127.0.0.1:"}}}
+	agentConfig.Tunnel.Protocol = "SSH"
+	sandcatAgent, _, err := initializeCore(agentConfig, time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "tunnel config") || sandcatAgent != nil {
+		t.Errorf("invalid tunnel config accepted: %v", err)
+	}
+}
+
+func TestCoreCancelsInstructionOnRequest(t *testing.T) {
+	server := c2test.NewServer()
+	defer server.Close()
+	server.QueueInstruction(c2test.NewInstruction("link-long", "sh", "sleep 60"))
+
+	done := startCore(newTestConfig(server, "10s"))
+
+	// The running instruction is listed in the profile of the beacons sent while it runs.
+	deadline := time.Now().Add(10 * time.Second)
+	for running := false; !running; {
+		if time.Now().After(deadline) {
+			t.Fatal("running instruction not listed in a beacon")
+		}
+		for _, beacon := range server.Beacons() {
+			for _, link := range beacon.RunningLinks {
+				if link.ID == "link-long" && link.Status == protocol.LINK_RUNNING && link.Pid > 0 {
+					running = true
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	server.CancelLinks("link-long")
+
+	result := server.RequireResultStatus(t, "link-long", execute.CANCELLED_STATUS, 10*time.Second)
+	if result.Pid == execute.ERROR_PID {
+		t.Errorf("cancelled instruction reported without its pid: %+v", result)
+	}
+	beaconCount := len(server.Beacons())
+	for _, link := range server.RequireBeacons(t, beaconCount+1, 10*time.Second)[beaconCount].RunningLinks {
+		t.Errorf("cancelled instruction still listed as running: %+v", link)
+	}
+	<-done
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Cap in seconds on the backoff after failed beacons, unless the configuration sets one.
+const defaultMaxSleep = 900
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Working hours during which the agent beacons. Windows that end before they start run past midnight, and belong
+// to the day on which they start.
+type schedule struct {
+	days     [7]bool
+	start    time.Duration // offset of the window start from midnight
+	duration time.Duration
+	location *time.Location
+}
+
+// Parses a schedule of the form [days] HH:MM-HH:MM [timezone], e.g. "Mon-Fri 08:00-18:00 Europe/Berlin".
+// Days are a comma-separated list of day names or ranges and default to every day. The timezone defaults to local
+// time. Returns nil if the spec is empty.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	parsed := &schedule{location: time.Local}
+	timeIndex := 0
+	if !strings.Contains(fields[0], ":") {
+		if err := parsed.parseDays(fields[0]); err != nil {
+			return nil, err
+		}
+		timeIndex = 1
+	} else {
+		for day := range parsed.days {
+			parsed.days[day] = true
+		}
+	}
+	if timeIndex >= len(fields) || len(fields) > timeIndex+2 {
+		return nil, errors.New(fmt.Sprintf("malformed schedule %s", spec))
+	}
+	bounds := strings.Split(fields[timeIndex], "-")
+	if len(bounds) != 2 {
+		return nil, errors.New(fmt.Sprintf("malformed schedule hours %s", fields[timeIndex]))
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return nil, err
+	}
+	parsed.start = start
+	parsed.duration = end - start
+	if parsed.duration <= 0 {
+		parsed.duration += 24 * time.Hour
+	}
+	if len(fields) == timeIndex+2 {
+		if parsed.location, err = time.LoadLocation(fields[timeIndex+1]); err != nil {
+			return nil, err
+		}
+	}
+	return parsed, nil
+}
+
+func (s *schedule) parseDays(spec string) error {
+	for _, dayRange := range strings.Split(spec, ",") {
+		bounds := strings.Split(strings.ToLower(dayRange), "-")
+		first, firstOk := weekdays[bounds[0]]
+		last, lastOk := first, firstOk
+		if len(bounds) == 2 {
+			last, lastOk = weekdays[bounds[1]]
+		}
+		if len(bounds) > 2 || !firstOk || !lastOk {
+			return errors.New(fmt.Sprintf("malformed schedule days %s", dayRange))
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			s.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Parses a time of day of the form HH:MM into its offset from midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("malformed schedule time %s", value))
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Returns the start of the window on the day that is the given number of days after the day of t.
+func (s *schedule) windowStart(t time.Time, days int) time.Time {
+	hour, minute := int(s.start/time.Hour), int(s.start%time.Hour/time.Minute)
+	return time.Date(t.Year(), t.Month(), t.Day()+days, hour, minute, 0, 0, s.location)
+}
+
+// Returns how long the agent has to wait from now until the schedule allows it to beacon, or 0 if it is within
+// working hours.
+func (s *schedule) untilActive(now time.Time) time.Duration {
+	now = now.In(s.location)
+	for days := -1; days <= 7; days++ {
+		start := s.windowStart(now, days)
+		if !s.days[start.Weekday()] {
+			continue
+		}
+		if now.Before(start) {
+			return start.Sub(now)
+		}
+		if now.Before(start.Add(s.duration)) {
+			return 0
+		}
+	}
+	return 0
+}
+
+// Returns how long the agent can keep beaconing from now until working hours end, or 0 if it is outside working
+// hours. Windows that follow each other without a gap count as one.
+func (s *schedule) untilQuiet(now time.Time) time.Duration {
+	end := now
+	for i := 0; i <= 7 && s.untilActive(end) == 0; i++ {
+		next := end
+		for days := -1; days <= 0; days++ {
+			start := s.windowStart(end.In(s.location), days)
+			if s.days[start.Weekday()] && !end.Before(start) && end.Before(start.Add(s.duration)) {
+				next = start.Add(s.duration)
+			}
+		}
+		if !next.After(end) {
+			break
+		}
+		end = next
+	}
+	return end.Sub(now)
+}
+
+// Decides how long the agent sleeps between beacons.
+type sleepPolicy struct {
+	failureSleep float64 // seconds to sleep after the first failed beacon
+	jitter       int
+	maxSleep     float64
+	schedule     *schedule
+	failures     int // consecutive failed beacons
+}
+
+// Returns the sleep policy for the configured sleep, jitter, backoff cap and schedule. Settings from config files and
+// embedded configurations are not validated by config.Set, so out of range values are rejected here.
+func newSleepPolicy(agentConfig *config.Config) (*sleepPolicy, error) {
+	if agentConfig.Jitter < 0 || agentConfig.Jitter > 100 {
+		return nil, errors.New(fmt.Sprintf("jitter must be a percentage between 0 and 100, got %d", agentConfig.Jitter))
+	}
+	if agentConfig.Sleep < 0 || agentConfig.MaxSleep < 0 {
+		return nil, errors.New(fmt.Sprintf("sleep and max sleep must not be negative, got %d and %d", agentConfig.Sleep, agentConfig.MaxSleep))
+	}
+	policy := &sleepPolicy{
+		failureSleep: defaultSleep,
+		jitter:       agentConfig.Jitter,
+		maxSleep:     defaultMaxSleep,
+	}
+	if agentConfig.Sleep > 0 {
+		policy.failureSleep = float64(agentConfig.Sleep)
+	}
+	if agentConfig.MaxSleep > 0 {
+		policy.maxSleep = float64(agentConfig.MaxSleep)
+	}
+	parsedSchedule, err := parseSchedule(agentConfig.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	policy.schedule = parsedSchedule
+	return policy, nil
+}
+
+// Applies the beacon timing requested by the server. The jitter is clamped to [0, 100], so that sleeps never turn
+// negative.
+func (p *sleepPolicy) update(beacon *protocol.Beacon) {
+	if beacon.Jitter != nil {
+		p.jitter = int(math.Max(0, math.Min(100, float64(*beacon.Jitter))))
+	}
+	if beacon.MaxSleep != nil && *beacon.MaxSleep > 0 {
+		p.maxSleep = float64(*beacon.MaxSleep)
+	}
+	if beacon.Schedule != nil {
+		parsedSchedule, err := parseSchedule(*beacon.Schedule)
+		if err != nil {
+			output.VerbosePrint(fmt.Sprintf("[!] Error updating beacon schedule: %s", err.Error()))
+			return
+		}
+		p.schedule = parsedSchedule
+	}
+	output.VerbosePrint(fmt.Sprintf("[*] Beacon timing: jitter=%d%%, max sleep=%ds, schedule=%v", p.jitter, int(p.maxSleep), p.schedule != nil))
+}
+
+// Returns the jittered sleep after a successful beacon with the given sleep, and resets the backoff.
+func (p *sleepPolicy) afterSuccess(sleepDuration float64) float64 {
+	p.failures = 0
+	return applyJitter(sleepDuration, p.jitter)
+}
+
+// Returns the jittered sleep after a failed beacon, which doubles with each consecutive failure up to the cap.
+func (p *sleepPolicy) afterFailure() float64 {
+	p.failures++
+	backoff := p.failureSleep * math.Pow(2, float64(p.failures-1))
+	return applyJitter(math.Min(backoff, math.Max(p.maxSleep, p.failureSleep)), p.jitter)
+}
+
+// Caps the sleep between beacons so that it ends when working hours end, since beacons pushed by the server are
+// only accepted during working hours.
+func (p *sleepPolicy) capAtQuietHours(sleepDuration float64, now time.Time) float64 {
+	if p.schedule == nil {
+		return sleepDuration
+	}
+	return math.Min(sleepDuration, p.schedule.untilQuiet(now).Seconds())
+}
+
+// Returns how long the agent has to stay quiet before the schedule allows it to beacon.
+func (p *sleepPolicy) untilActive(now time.Time) time.Duration {
+	if p.schedule == nil {
+		return 0
+	}
+	return p.schedule.untilActive(now)
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/config"
+	"github.com/mitre/gocat/protocol"
+)
+
+func TestNewSleepPolicyValidatesTiming(t *testing.T) {
+	for _, agentConfig := range []*config.Config{{Jitter: 101}, {Jitter: -1}, {MaxSleep: -1}, {Sleep: -5}} {
+		if _, err := newSleepPolicy(agentConfig); err == nil {
+			t.Errorf("invalid timing accepted: jitter %d, sleep %d, max sleep %d", agentConfig.Jitter, agentConfig.Sleep, agentConfig.MaxSleep)
+		}
+	}
+	policy, err := newSleepPolicy(&config.Config{Sleep: 10, Jitter: 100, MaxSleep: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.failureSleep != 10 || policy.jitter != 100 || policy.maxSleep != 60 {
+		t.Errorf("unexpected policy %+v", policy)
+	}
+}
+
+func TestSleepPolicyUpdateClampsJitter(t *testing.T) {
+	policy, err := newSleepPolicy(&config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jitter, maxSleep := 250, -10
+	policy.update(&protocol.Beacon{Jitter: &jitter, MaxSleep: &maxSleep})
+	if policy.jitter != 100 || policy.maxSleep != defaultMaxSleep {
+		t.Errorf("unexpected jitter %d and max sleep %v", policy.jitter, policy.maxSleep)
+	}
+	for i := 0; i < 100; i++ {
+		if sleep := policy.afterSuccess(30); sleep < 0 || sleep > 60 {
+			t.Fatalf("jittered sleep %v out of range", sleep)
+		}
+	}
+	jitter = -20
+	policy.update(&protocol.Beacon{Jitter: &jitter})
+	if policy.jitter != 0 {
+		t.Errorf("negative jitter not clamped: %d", policy.jitter)
+	}
+}
+
+func TestScheduleUntilQuiet(t *testing.T) {
+	weekdays, err := parseSchedule("Mon-Fri 08:00-18:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overnight, err := parseSchedule("22:00-06:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allDay, err := parseSchedule("Sat,Sun 00:00-00:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2024-01-05 is a Friday.
+	for _, test := range []struct {
+		schedule *schedule
+		now      time.Time
+		expected time.Duration
+	}{
+		{weekdays, time.Date(2024, 1, 5, 17, 30, 0, 0, time.UTC), 30 * time.Minute},
+		{weekdays, time.Date(2024, 1, 5, 18, 0, 0, 0, time.UTC), 0},
+		{weekdays, time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), 0},
+		{overnight, time.Date(2024, 1, 5, 23, 0, 0, 0, time.UTC), 7 * time.Hour},
+		{overnight, time.Date(2024, 1, 5, 5, 0, 0, 0, time.UTC), time.Hour},
+		{allDay, time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), 36 * time.Hour},
+	} {
+		if untilQuiet := test.schedule.untilQuiet(test.now); untilQuiet != test.expected {
+			t.Errorf("%s: expected %s until quiet hours, got %s", test.now, test.expected, untilQuiet)
+		}
+	}
+}
+
+func TestSleepPolicyEndsSleepAtQuietHours(t *testing.T) {
+	policy, err := newSleepPolicy(&config.Config{Schedule: "08:00-18:00 UTC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sleep := policy.capAtQuietHours(3600, time.Date(2024, 1, 5, 17, 50, 0, 0, time.UTC)); sleep != 600 {
+		t.Errorf("sleep across the end of working hours not capped: %v", sleep)
+	}
+	if sleep := policy.capAtQuietHours(60, time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)); sleep != 60 {
+		t.Errorf("sleep within working hours capped: %v", sleep)
+	}
+	if sleep := policy.capAtQuietHours(60, time.Date(2024, 1, 5, 20, 0, 0, 0, time.UTC)); sleep != 0 {
+		t.Errorf("sleep outside working hours not ended: %v", sleep)
+	}
+	policy.schedule = nil
+	if sleep := policy.capAtQuietHours(3600, time.Date(2024, 1, 5, 17, 50, 0, 0, time.UTC)); sleep != 3600 {
+		t.Errorf("sleep capped without a schedule: %v", sleep)
+	}
+}
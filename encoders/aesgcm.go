@@ -0,0 +1,187 @@
+package encoders
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	aesGcmVersion byte = 1
+	aesGcmKeyInfo      = "gocat aes-gcm data encoder"
+	aesGcmKeySize      = 32
+	timestampSize      = 8
+)
+
+// Messages whose timestamp is further than this from the current time, or whose nonce was already seen, are rejected.
+var replayWindow = 10 * time.Minute
+
+// AesGcmEncoder encrypts and authenticates data using AES-256-GCM, keyed from the "key" config value.
+// Each message is laid out as version | nonce | ciphertext, where the ciphertext contains a timestamp
+// followed by the data. The output is binary, so chain it with a text encoder (e.g. "aes-gcm,base64") where needed.
+type AesGcmEncoder struct {
+	name       string
+	mu         sync.Mutex
+	seenNonces map[string]*nonceCache // nonces seen within the replay window, by key fingerprint
+}
+
+func init() {
+	DataEncoders["aes-gcm"] = &AesGcmEncoder{name: "aes-gcm", seenNonces: make(map[string]*nonceCache)}
+}
+
+func (e *AesGcmEncoder) GetName() string {
+	return e.name
+}
+
+func (e *AesGcmEncoder) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, _, err := getAesGcmCipher(config)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, timestampSize+len(data))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().Unix()))
+	copy(plaintext[timestampSize:], data)
+	header := []byte{aesGcmVersion}
+	return aead.Seal(append(header, nonce...), nonce, plaintext, header), nil
+}
+
+func (e *AesGcmEncoder) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	aead, fingerprint, err := getAesGcmCipher(config)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := 1 + aead.NonceSize()
+	if len(data) < headerSize+aead.Overhead() {
+		return nil, errors.New("Message too short.")
+	}
+	if data[0] != aesGcmVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported message version %d", data[0]))
+	}
+	nonce := data[1:headerSize]
+	plaintext, err := aead.Open(nil, nonce, data[headerSize:], data[:1])
+	if err != nil {
+		return nil, errors.New("Message authentication failed.")
+	}
+	if len(plaintext) < timestampSize {
+		return nil, errors.New("Message missing timestamp.")
+	}
+	timestamp := time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0)
+	if err = e.checkReplay(fingerprint, nonce, timestamp); err != nil {
+		return nil, err
+	}
+	return plaintext[timestampSize:], nil
+}
+
+// Rejects messages outside of the replay window and messages whose nonce was already seen with the same key.
+// Records the nonce of accepted messages.
+func (e *AesGcmEncoder) checkReplay(fingerprint string, nonce []byte, timestamp time.Time) error {
+	now := time.Now()
+	if age := now.Sub(timestamp); age > replayWindow || age < -replayWindow {
+		return errors.New(fmt.Sprintf("Message timestamp %s outside of replay window", timestamp.UTC().Format(time.RFC3339)))
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	cache, ok := e.seenNonces[fingerprint]
+	if !ok {
+		cache = newNonceCache(now)
+		e.seenNonces[fingerprint] = cache
+	}
+	if cache.rotate(now) {
+		// Forget the caches of keys that are no longer in use, e.g. replaced peer-to-peer group keys.
+		for otherFingerprint, otherCache := range e.seenNonces {
+			if otherCache.expired(now) {
+				delete(e.seenNonces, otherFingerprint)
+			}
+		}
+	}
+	if !cache.add(string(nonce)) {
+		return errors.New("Replayed message rejected.")
+	}
+	return nil
+}
+
+// Remembers the nonces seen with one key. Nonces are kept in generations that are rotated every replay window, so
+// that expiring them takes constant time. A message is accepted for up to a replay window either side of its
+// timestamp, so a nonce must be remembered for two replay windows, which three generations guarantee.
+type nonceCache struct {
+	generations [3]map[string]bool // newest first
+	rotatedAt   time.Time
+	usedAt      time.Time
+}
+
+func newNonceCache(now time.Time) *nonceCache {
+	cache := &nonceCache{rotatedAt: now, usedAt: now}
+	for i := range cache.generations {
+		cache.generations[i] = make(map[string]bool)
+	}
+	return cache
+}
+
+// Drops the generations that are older than three replay windows. Returns true if a generation was dropped.
+func (c *nonceCache) rotate(now time.Time) bool {
+	c.usedAt = now
+	rotated := false
+	for i := 0; i < len(c.generations) && now.Sub(c.rotatedAt) >= replayWindow; i++ {
+		copy(c.generations[1:], c.generations[:len(c.generations)-1])
+		c.generations[0] = make(map[string]bool)
+		c.rotatedAt = c.rotatedAt.Add(replayWindow)
+		rotated = true
+	}
+	if now.Sub(c.rotatedAt) >= replayWindow {
+		c.rotatedAt = now
+	}
+	return rotated
+}
+
+// Records the nonce. Returns false if it was already seen.
+func (c *nonceCache) add(nonce string) bool {
+	for _, generation := range c.generations {
+		if generation[nonce] {
+			return false
+		}
+	}
+	c.generations[0][nonce] = true
+	return true
+}
+
+// Returns true if the cache has not been used for longer than it remembers nonces.
+func (c *nonceCache) expired(now time.Time) bool {
+	return now.Sub(c.usedAt) > time.Duration(len(c.generations))*replayWindow
+}
+
+// Derives the AES-256 key from the "key" config value and returns the GCM cipher, along with a fingerprint of the
+// key that identifies it without revealing it.
+func getAesGcmCipher(config map[string]interface{}) (cipher.AEAD, string, error) {
+	keyStr, _ := config["key"].(string)
+	if len(keyStr) == 0 {
+		return nil, "", errors.New("aes-gcm data encoder requires a key.")
+	}
+	key := make([]byte, aesGcmKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(keyStr), nil, []byte(aesGcmKeyInfo)), key); err != nil {
+		return nil, "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, "", err
+	}
+	fingerprint := sha256.Sum256(key)
+	return aead, hex.EncodeToString(fingerprint[:]), nil
+}
@@ -0,0 +1,159 @@
+package encoders
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func newTestAesGcmEncoder() *AesGcmEncoder {
+	return &AesGcmEncoder{name: "aes-gcm", seenNonces: make(map[string]*nonceCache)}
+}
+
+// Seals data the way EncodeData does, but with the given timestamp and nonce.
+func sealWithNonce(t *testing.T, config map[string]interface{}, data []byte, timestamp time.Time, nonce []byte) []byte {
+	aead, _, err := getAesGcmCipher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, timestampSize+len(data))
+	binary.BigEndian.PutUint64(plaintext, uint64(timestamp.Unix()))
+	copy(plaintext[timestampSize:], data)
+	header := []byte{aesGcmVersion}
+	return aead.Seal(append(header, nonce...), nonce, plaintext, header)
+}
+
+// Seals data the way EncodeData does, but with the given timestamp.
+func sealWithTimestamp(t *testing.T, config map[string]interface{}, data []byte, timestamp time.Time) []byte {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return sealWithNonce(t, config, data, timestamp, nonce)
+}
+
+func TestAesGcmRoundTrip(t *testing.T) {
+	encoder := newTestAesGcmEncoder()
+	config := map[string]interface{}{"key": "secret"}
+	encoded, err := encoder.EncodeData([]byte("hello"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := encoder.DecodeData(encoded, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, []byte("hello")) {
+		t.Errorf("expected hello, got %q", decoded)
+	}
+}
+
+func TestAesGcmRejectsTamperingAndWrongKey(t *testing.T) {
+	encoder := newTestAesGcmEncoder()
+	config := map[string]interface{}{"key": "secret"}
+	encoded, err := encoder.EncodeData([]byte("hello"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = encoder.DecodeData(encoded, map[string]interface{}{"key": "other"}); err == nil {
+		t.Error("message decoded with the wrong key")
+	}
+	tampered := append([]byte(nil), encoded...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = encoder.DecodeData(tampered, config); err == nil {
+		t.Error("tampered message decoded")
+	}
+	if _, err = encoder.DecodeData(encoded[:10], config); err == nil {
+		t.Error("truncated message decoded")
+	}
+	if _, err = encoder.EncodeData([]byte("hello"), map[string]interface{}{}); err == nil {
+		t.Error("message encoded without a key")
+	}
+}
+
+func TestAesGcmRejectsReplay(t *testing.T) {
+	encoder := newTestAesGcmEncoder()
+	config := map[string]interface{}{"key": "secret"}
+	nonce := make([]byte, 12)
+	encoded := sealWithNonce(t, config, []byte("hello"), time.Now(), nonce)
+	if _, err := encoder.DecodeData(encoded, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.DecodeData(encoded, config); err == nil {
+		t.Error("replayed message decoded")
+	}
+
+	// The same nonce under another key is a different message.
+	otherConfig := map[string]interface{}{"key": "other"}
+	if _, err := encoder.DecodeData(sealWithNonce(t, otherConfig, []byte("hello"), time.Now(), nonce), otherConfig); err != nil {
+		t.Errorf("message with another key rejected: %s", err.Error())
+	}
+}
+
+func TestAesGcmRejectsStaleTimestamps(t *testing.T) {
+	encoder := newTestAesGcmEncoder()
+	config := map[string]interface{}{"key": "secret"}
+	for _, timestamp := range []time.Time{time.Now().Add(-replayWindow - time.Minute), time.Now().Add(replayWindow + time.Minute)} {
+		if _, err := encoder.DecodeData(sealWithTimestamp(t, config, []byte("hello"), timestamp), config); err == nil {
+			t.Errorf("message with timestamp %s decoded", timestamp)
+		}
+	}
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	start := time.Now()
+	cache := newNonceCache(start)
+	if !cache.add("nonce") {
+		t.Fatal("new nonce rejected")
+	}
+
+	// Nonces are remembered for at least two replay windows.
+	for _, elapsed := range []time.Duration{replayWindow, 2*replayWindow - time.Second} {
+		cache.rotate(start.Add(elapsed))
+		if cache.add("nonce") {
+			t.Fatalf("nonce forgotten after %s", elapsed)
+		}
+	}
+	cache.rotate(start.Add(3 * replayWindow))
+	if !cache.add("nonce") {
+		t.Error("nonce still remembered after three replay windows")
+	}
+
+	// Long idle periods drop every generation at once.
+	cache.rotate(start.Add(100 * replayWindow))
+	if !cache.add("nonce") || !cache.add("other") {
+		t.Error("nonces still remembered after idle period")
+	}
+	if cache.expired(start.Add(100 * replayWindow)) {
+		t.Error("cache in use reported as expired")
+	}
+	if !cache.expired(start.Add(104 * replayWindow)) {
+		t.Error("unused cache not reported as expired")
+	}
+}
+
+func TestAesGcmForgetsUnusedKeys(t *testing.T) {
+	encoder := newTestAesGcmEncoder()
+	for _, key := range []string{"old", "new"} {
+		config := map[string]interface{}{"key": key}
+		if _, err := encoder.DecodeData(sealWithTimestamp(t, config, []byte("hello"), time.Now()), config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, oldFingerprint, _ := getAesGcmCipher(map[string]interface{}{"key": "old"})
+	encoder.seenNonces[oldFingerprint].usedAt = time.Now().Add(-4 * replayWindow)
+	for _, cache := range encoder.seenNonces {
+		cache.rotatedAt = cache.rotatedAt.Add(-replayWindow)
+	}
+
+	// The next rotation of the key in use drops the cache of the unused key.
+	newConfig := map[string]interface{}{"key": "new"}
+	if _, err := encoder.DecodeData(sealWithTimestamp(t, newConfig, []byte("hello"), time.Now()), newConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := encoder.seenNonces[oldFingerprint]; ok || len(encoder.seenNonces) != 1 {
+		t.Errorf("expected only the cache of the key in use, got %d caches", len(encoder.seenNonces))
+	}
+}
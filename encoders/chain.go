@@ -0,0 +1,65 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Chain is an ordered list of data encoders. Encoding applies each encoder in order, and decoding applies them
+// in reverse order.
+type Chain []DataEncoder
+
+// NewChain looks up the given data encoders by name and returns them as a chain.
+func NewChain(encoderNames []string) (Chain, error) {
+	if len(encoderNames) == 0 {
+		return nil, errors.New("Empty data encoder chain.")
+	}
+	chain := make(Chain, 0, len(encoderNames))
+	for _, name := range encoderNames {
+		encoder, ok := DataEncoders[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Data encoder %s not available", name))
+		}
+		chain = append(chain, encoder)
+	}
+	return chain, nil
+}
+
+// ParseChain builds a chain from a comma-separated list of data encoder names, e.g. "plain-text,base64".
+func ParseChain(chainSpec string) (Chain, error) {
+	return NewChain(strings.Split(chainSpec, ","))
+}
+
+func (c Chain) Names() []string {
+	names := make([]string, 0, len(c))
+	for _, encoder := range c {
+		names = append(names, encoder.GetName())
+	}
+	return names
+}
+
+// String returns the comma-separated names of the chain's encoders, as accepted by ParseChain.
+func (c Chain) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+func (c Chain) EncodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var err error
+	for _, encoder := range c {
+		if data, err = encoder.EncodeData(data, config); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s encoding failed: %s", encoder.GetName(), err.Error()))
+		}
+	}
+	return data, nil
+}
+
+func (c Chain) DecodeData(data []byte, config map[string]interface{}) ([]byte, error) {
+	var err error
+	for i := len(c) - 1; i >= 0; i-- {
+		if data, err = c[i].DecodeData(data, config); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s decoding failed: %s", c[i].GetName(), err.Error()))
+		}
+	}
+	return data, nil
+}
@@ -1,18 +1,23 @@
 package execute
 
 import (
+	"context"
 	"encoding/base64"
 	"path/filepath"
 	"fmt"
 	"time"
 	"os"
 	"strings"
+
+	"github.com/mitre/gocat/protocol"
 )
 
 const (
 	SUCCESS_STATUS 	= "0"
 	ERROR_STATUS 	= "1"
 	TIMEOUT_STATUS 	= "124"
+	OUT_OF_SCOPE_STATUS = "126"
+	CANCELLED_STATUS = "130"
 	SUCCESS_PID 	= "0"
 	ERROR_PID       = "1"
 )
@@ -30,31 +35,57 @@ type Executor interface {
 }
 
 type InstructionInfo struct {
-	Profile map[string]interface{}
-	Instruction map[string]interface{}
+	Profile protocol.Profile
+	Instruction protocol.Instruction
 	OnDiskPayloads []string
 	InMemoryPayloads map[string][]byte
+	Context context.Context // cancels the instruction. May be nil.
+	ProcessStarted func(pid int) // called with the PID of the process running the instruction. May be nil.
+}
+
+// NotifyProcessStarted reports the PID of the process that runs the instruction.
+func (i InstructionInfo) NotifyProcessStarted(pid int) {
+	if i.ProcessStarted != nil {
+		i.ProcessStarted(pid)
+	}
+}
+
+// GetContext returns the context that cancels the instruction.
+func (i InstructionInfo) GetContext() context.Context {
+	if i.Context == nil {
+		return context.Background()
+	}
+	return i.Context
 }
 
-func AvailableExecutors() (values []string) {
+func AvailableExecutors() []string {
+	values := make([]string, 0, len(Executors))
 	for _, e := range Executors {
 		values = append(values, e.String())
 	}
-	return
+	return values
 }
 
 var Executors = map[string]Executor{}
 
 //RunCommand runs the actual command
 func RunCommand(info InstructionInfo) ([]byte, string, string, time.Time) {
-	encodedCommand := info.Instruction["command"].(string)
-	executor := info.Instruction["executor"].(string)
-	timeout := int(info.Instruction["timeout"].(float64))
+	encodedCommand := info.Instruction.Command
+	executorName := info.Instruction.Executor
+	timeout := info.Instruction.Timeout
 	onDiskPayloads := info.OnDiskPayloads
 	var status string
 	var result []byte
 	var pid string
 	var executionTimestamp time.Time
+	executor, ok := Executors[executorName]
+	if !ok {
+		result = []byte(fmt.Sprintf("Executor %s not available", executorName))
+		status = ERROR_STATUS
+		pid = ERROR_PID
+		executionTimestamp = time.Now().UTC()
+		return result, status, pid, executionTimestamp
+	}
 	decoded, err := base64.StdEncoding.DecodeString(encodedCommand)
 	if err != nil {
 		result = []byte(fmt.Sprintf("Error when decoding command: %s", err.Error()))
@@ -64,8 +95,18 @@ func RunCommand(info InstructionInfo) ([]byte, string, string, time.Time) {
 	} else {
 		command := string(decoded)
 		missingPaths := checkPayloadsAvailable(onDiskPayloads)
-		if len(missingPaths) == 0 {
-			result, status, pid, executionTimestamp = Executors[executor].Run(command, timeout, info)
+		if err := info.GetContext().Err(); err != nil {
+			result = []byte("Instruction cancelled before it started")
+			status = CANCELLED_STATUS
+			pid = ERROR_PID
+			executionTimestamp = time.Now().UTC()
+		} else if err := checkScope(command, info.Instruction); err != nil {
+			result = []byte(fmt.Sprintf("Instruction refused: %s", err.Error()))
+			status = OUT_OF_SCOPE_STATUS
+			pid = ERROR_PID
+			executionTimestamp = time.Now().UTC()
+		} else if len(missingPaths) == 0 {
+			result, status, pid, executionTimestamp = executor.Run(command, timeout, info)
 		} else {
 			result = []byte(fmt.Sprintf("Payload(s) not available: %s", strings.Join(missingPaths, ", ")))
 			status = ERROR_STATUS
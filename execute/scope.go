@@ -0,0 +1,163 @@
+package execute
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// Engagement scope enforced on every instruction. The zero value allows everything.
+var scope = struct {
+	allowedHosts    []string
+	allowedNetworks []*net.IPNet
+	blockedCommands []*regexp.Regexp
+	blockedPaths    []string
+}{}
+
+// SetScope restricts the instructions the agent runs. The agent only runs instructions on hosts whose hostname
+// matches one of allowedHosts (which may contain * wildcards), or which have an IP address within one of them (given
+// as IPs or CIDRs). Commands matching any of the blockedCommands regular expressions are refused, as are instructions
+// that upload or delete files at or below blockedPaths (which may contain * wildcards).
+func SetScope(allowedHosts []string, blockedCommands []string, blockedPaths []string) error {
+	scope.allowedHosts, scope.allowedNetworks = nil, nil
+	for _, host := range allowedHosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			scope.allowedNetworks = append(scope.allowedNetworks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if _, network, err := net.ParseCIDR(host); err == nil {
+			scope.allowedNetworks = append(scope.allowedNetworks, network)
+		} else {
+			scope.allowedHosts = append(scope.allowedHosts, strings.ToLower(host))
+		}
+	}
+	scope.blockedCommands = nil
+	for _, pattern := range blockedCommands {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid blocked command pattern %s: %s", pattern, err.Error()))
+		}
+		scope.blockedCommands = append(scope.blockedCommands, compiled)
+	}
+	scope.blockedPaths = nil
+	for _, path := range blockedPaths {
+		scope.blockedPaths = append(scope.blockedPaths, normalizePath(path))
+	}
+	return nil
+}
+
+// CheckHostScope returns an error if the agent is running on a host outside the allowed hosts.
+func CheckHostScope() error {
+	if len(scope.allowedHosts) == 0 && len(scope.allowedNetworks) == 0 {
+		return nil
+	}
+	hostname, err := os.Hostname()
+	if err == nil {
+		for _, pattern := range scope.allowedHosts {
+			if matched, _ := filepath.Match(pattern, strings.ToLower(hostname)); matched {
+				return nil
+			}
+		}
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, network := range scope.allowedNetworks {
+				if network.Contains(ipNet.IP) {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New(fmt.Sprintf("Host %s is outside the engagement scope", hostname))
+}
+
+// CheckCommandScope returns an error if the command matches a blocked command pattern.
+func CheckCommandScope(command string) error {
+	for _, pattern := range scope.blockedCommands {
+		if pattern.MatchString(command) {
+			return errors.New(fmt.Sprintf("Command matches blocked pattern %s", pattern.String()))
+		}
+	}
+	return nil
+}
+
+// CheckPathScope returns an error if the path is at or below a blocked path. Symbolic links in the path are resolved,
+// so that a link pointing into a blocked path is refused as well.
+func CheckPathScope(path string) error {
+	candidates := []string{normalizePath(path)}
+	if resolved, err := filepath.EvalSymlinks(candidates[0]); err == nil {
+		candidates = append(candidates, normalizePath(resolved))
+	}
+	for _, candidate := range candidates {
+		if blocked, ok := findBlockedPath(candidate); ok {
+			return errors.New(fmt.Sprintf("Path %s is within blocked path %s", path, blocked))
+		}
+	}
+	return nil
+}
+
+// Returns the blocked path that the normalized path is at or below, if any.
+func findBlockedPath(normalized string) (string, bool) {
+	for _, blocked := range scope.blockedPaths {
+		for candidate := normalized; ; candidate = filepath.Dir(candidate) {
+			if matched, _ := filepath.Match(blocked, candidate); matched || candidate == blocked {
+				return blocked, true
+			}
+			if filepath.Dir(candidate) == candidate {
+				break
+			}
+		}
+	}
+	return "", false
+}
+
+// CheckInstructionScope returns an error if the instruction is outside the engagement scope, so that it can be refused
+// before its payloads are downloaded. Only the host is checked if the command cannot be decoded, which RunCommand
+// reports.
+func CheckInstructionScope(instruction protocol.Instruction) error {
+	command, err := base64.StdEncoding.DecodeString(instruction.Command)
+	if err != nil {
+		return CheckHostScope()
+	}
+	return checkScope(string(command), instruction)
+}
+
+// Returns an error if the instruction is outside the engagement scope.
+func checkScope(command string, instruction protocol.Instruction) error {
+	if err := CheckHostScope(); err != nil {
+		return err
+	}
+	if err := CheckCommandScope(command); err != nil {
+		return err
+	}
+	for _, path := range instruction.Uploads {
+		if err := CheckPathScope(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the absolute, cleaned form of the path, lower-cased on Windows, where paths are case-insensitive.
+func normalizePath(path string) string {
+	if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
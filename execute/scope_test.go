@@ -0,0 +1,47 @@
+package execute
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPathScopeResolvesSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blockedDir := filepath.Join(dir, "blocked")
+	if err = os.Mkdir(blockedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(blockedDir, "secret.txt")
+	if err = ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileLink := filepath.Join(dir, "file-link")
+	dirLink := filepath.Join(dir, "dir-link")
+	if err = os.Symlink(secret, fileLink); err != nil {
+		t.Skipf("cannot create symbolic links: %s", err.Error())
+	}
+	if err = os.Symlink(blockedDir, dirLink); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetScope(nil, nil, []string{blockedDir}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetScope(nil, nil, nil)
+
+	for _, path := range []string{secret, fileLink, dirLink, filepath.Join(dirLink, "secret.txt"), filepath.Join(blockedDir, "missing.txt")} {
+		if err = CheckPathScope(path); err == nil {
+			t.Errorf("path %s within the blocked path accepted", path)
+		}
+	}
+	for _, path := range []string{dir, filepath.Join(dir, "missing.txt")} {
+		if err = CheckPathScope(path); err != nil {
+			t.Errorf("path %s outside the blocked path refused: %s", path, err.Error())
+		}
+	}
+}
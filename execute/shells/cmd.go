@@ -32,7 +32,7 @@ func (c *Cmd) Run(command string, timeout int, info execute.InstructionInfo) ([]
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 	commandLineComponents := append(append([]string{c.path}, c.execArgs...), command)
 	cmd.SysProcAttr.CmdLine = strings.Join(commandLineComponents, " ")
-	return runShellExecutor(cmd, timeout)
+	return runShellExecutor(cmd, timeout, info)
 }
 
 func (c *Cmd) String() string {
@@ -26,7 +26,7 @@ func init() {
 }
 
 func (p *Powershell) Run(command string, timeout int, info execute.InstructionInfo) ([]byte, string, string, time.Time) {
-	return runShellExecutor(*exec.Command(p.path, append(p.execArgs, command)...), timeout)
+	return runShellExecutor(*exec.Command(p.path, append(p.execArgs, command)...), timeout, info)
 }
 
 func (p *Powershell) String() string {
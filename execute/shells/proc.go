@@ -36,9 +36,14 @@ func (p *Proc) Run(command string, timeout int, info execute.InstructionInfo) ([
 	}
 	output.VerbosePrint(fmt.Sprintf("[*] Starting process %s with args %v", exePath, exeArgs))
 	if exePath == "del" || exePath == "rm" {
+		for _, toDelete := range exeArgs {
+			if err := execute.CheckPathScope(toDelete); err != nil {
+				return []byte(fmt.Sprintf("Instruction refused: %s", err.Error())), execute.OUT_OF_SCOPE_STATUS, execute.ERROR_PID, time.Now().UTC()
+			}
+		}
 		return p.deleteFiles(exeArgs)
 	}
-	return runShellExecutor(*exec.Command(exePath, append(exeArgs)...), timeout)
+	return runShellExecutor(*exec.Command(exePath, exeArgs...), timeout, info)
 }
 
 func (p *Proc) String() string {
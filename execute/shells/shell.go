@@ -22,7 +22,7 @@ func init() {
 }
 
 func (s *Sh) Run(command string, timeout int, info execute.InstructionInfo) ([]byte, string, string, time.Time) {
-	return runShellExecutor(*exec.Command(s.path, append(s.execArgs, command)...), timeout)
+	return runShellExecutor(*exec.Command(s.path, append(s.execArgs, command)...), timeout, info)
 }
 
 func (s *Sh) String() string {
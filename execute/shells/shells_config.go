@@ -2,8 +2,39 @@
 
 package shells
 
-import "syscall"
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
 
+// Starts commands in their own process group, so that everything they spawn can be killed together.
 func getPlatformSysProcAttrs() *syscall.SysProcAttr {
-	return &syscall.SysProcAttr{}
-}
\ No newline at end of file
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// A started command together with the processes it spawns, which share its process group.
+type processTree struct {
+	process *os.Process
+}
+
+func startProcessTree(cmd *exec.Cmd) (*processTree, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &processTree{process: cmd.Process}, nil
+}
+
+// Kills every process in the command's process group.
+func (t *processTree) kill() error {
+	if err := syscall.Kill(-t.process.Pid, syscall.SIGKILL); err != nil {
+		return t.process.Kill()
+	}
+	return nil
+}
+
+func (t *processTree) release() {}
@@ -0,0 +1,85 @@
+// +build !windows
+
+package shells
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/execute"
+)
+
+// Runs a shell that starts a long-lived grandchild, records its PID and waits for it, and returns the result of the
+// run along with the grandchild's PID.
+func runTestProcessTree(t *testing.T, timeout int, info execute.InstructionInfo) (string, int) {
+	dir, err := ioutil.TempDir("", "sandcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "grandchild.pid")
+	script := fmt.Sprintf("sleep 60 & echo $! > %s; wait", pidFile)
+	_, status, _, _ := runShellExecutor(*exec.Command("sh", "-c", script), timeout, info)
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, pid
+}
+
+// Returns true if the process exists and has not exited. Exited processes that were not reaped yet count as gone.
+func isProcessRunning(pid int) bool {
+	if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		return len(fields) > 0 && fields[0] != "Z"
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+func requireProcessGone(t *testing.T, pid int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for isProcessRunning(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild process %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTimeoutKillsProcessTree(t *testing.T) {
+	status, pid := runTestProcessTree(t, 1, execute.InstructionInfo{})
+	if status != execute.TIMEOUT_STATUS {
+		t.Errorf("expected timeout status, got %s", status)
+	}
+	requireProcessGone(t, pid)
+}
+
+func TestCancellationKillsProcessTree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	info := execute.InstructionInfo{
+		Context: ctx,
+		ProcessStarted: func(pid int) {
+			time.AfterFunc(500*time.Millisecond, cancel)
+		},
+	}
+	status, pid := runTestProcessTree(t, 60, info)
+	if status != execute.CANCELLED_STATUS {
+		t.Errorf("expected cancelled status, got %s", status)
+	}
+	requireProcessGone(t, pid)
+}
@@ -1,7 +1,114 @@
 package shells
 
-import "syscall"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/mitre/gocat/output"
+)
 
 func getPlatformSysProcAttrs() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{HideWindow: true}
-}
\ No newline at end of file
+}
+
+// A started command together with the processes it spawns, which are tracked by a job object.
+type processTree struct {
+	process *os.Process
+	job     windows.Handle // 0 if the command could not be assigned to a job object
+}
+
+// Starts the command suspended and only resumes it once it is assigned to a job object, so that none of the
+// processes it spawns escape the job.
+func startProcessTree(cmd *exec.Cmd) (*processTree, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	tree := &processTree{process: cmd.Process}
+	job, err := assignToJobObject(cmd.Process.Pid)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[!] Could not assign process %d to a job object: %s", cmd.Process.Pid, err.Error()))
+	} else {
+		tree.job = job
+	}
+	if err = resumeProcess(uint32(cmd.Process.Pid)); err != nil {
+		tree.kill()
+		cmd.Wait()
+		tree.release()
+		return nil, errors.New(fmt.Sprintf("Could not resume process %d: %s", cmd.Process.Pid, err.Error()))
+	}
+	return tree, nil
+}
+
+// Resumes the threads of a process that was created suspended.
+func resumeProcess(pid uint32) error {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(snapshot)
+	resumed := 0
+	entry := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	for err = windows.Thread32First(snapshot, &entry); err == nil; err = windows.Thread32Next(snapshot, &entry) {
+		if entry.OwnerProcessID != pid {
+			continue
+		}
+		thread, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, entry.ThreadID)
+		if err != nil {
+			return err
+		}
+		_, err = windows.ResumeThread(thread)
+		windows.CloseHandle(thread)
+		if err != nil {
+			return err
+		}
+		resumed++
+	}
+	if resumed == 0 {
+		return errors.New("no threads found")
+	}
+	return nil
+}
+
+func assignToJobObject(pid int) (windows.Handle, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err == nil {
+		err = windows.AssignProcessToJobObject(job, process)
+		windows.CloseHandle(process)
+	}
+	if err != nil {
+		windows.CloseHandle(job)
+		return 0, err
+	}
+	return job, nil
+}
+
+// Kills every process in the command's job object, or only the command's process if it has no job object.
+func (t *processTree) kill() error {
+	if t.job != 0 {
+		if err := windows.TerminateJobObject(t.job, 1); err == nil {
+			return nil
+		}
+	}
+	return t.process.Kill()
+}
+
+// Closes the job object. Processes that are still running keep running.
+func (t *processTree) release() {
+	if t.job != 0 {
+		windows.CloseHandle(t.job)
+	}
+}
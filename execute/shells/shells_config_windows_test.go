@@ -0,0 +1,94 @@
+package shells
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/mitre/gocat/execute"
+)
+
+const stillActive = 259
+
+// Runs PowerShell to start a long-lived grandchild, record its PID and wait for it, and returns the result of the
+// run along with the grandchild's PID.
+func runTestProcessTree(t *testing.T, timeout int, info execute.InstructionInfo) (string, int) {
+	dir, err := ioutil.TempDir("", "sandcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "grandchild.pid")
+	script := fmt.Sprintf("$p = Start-Process -PassThru -WindowStyle Hidden -FilePath ping.exe -ArgumentList '-n','60','127.0.0.1'; "+
+		"Set-Content -Path '%s' -Value $p.Id; Wait-Process -Id $p.Id", pidFile)
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	_, status, _, _ := runShellExecutor(*cmd, timeout, info)
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, pid
+}
+
+func isProcessRunning(pid int) bool {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(process)
+	var exitCode uint32
+	if err = windows.GetExitCodeProcess(process, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == stillActive
+}
+
+func requireProcessGone(t *testing.T, pid int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for isProcessRunning(pid) {
+		if time.Now().After(deadline) {
+			if process, err := os.FindProcess(pid); err == nil {
+				process.Kill()
+			}
+			t.Fatalf("grandchild process %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTimeoutKillsProcessTree(t *testing.T) {
+	status, pid := runTestProcessTree(t, 10, execute.InstructionInfo{})
+	if status != execute.TIMEOUT_STATUS {
+		t.Errorf("expected timeout status, got %s", status)
+	}
+	requireProcessGone(t, pid)
+}
+
+func TestCancellationKillsProcessTree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	info := execute.InstructionInfo{
+		Context: ctx,
+		ProcessStarted: func(pid int) {
+			time.AfterFunc(5*time.Second, cancel)
+		},
+	}
+	status, pid := runTestProcessTree(t, 60, info)
+	if status != execute.CANCELLED_STATUS {
+		t.Errorf("expected cancelled status, got %s", status)
+	}
+	requireProcessGone(t, pid)
+}
@@ -17,7 +17,9 @@ func checkExecutorInPath(path string) bool {
 	return err == nil
 }
 
-func runShellExecutor(cmd exec.Cmd, timeout int) ([]byte, string, string, time.Time) {
+// Runs the command until it exits, the timeout is reached or the instruction is cancelled. The command and every
+// process it spawned are killed in the latter two cases.
+func runShellExecutor(cmd exec.Cmd, timeout int, info execute.InstructionInfo) ([]byte, string, string, time.Time) {
 	done := make(chan error, 1)
 	status := execute.SUCCESS_STATUS
 	var stdoutBuf, stderrBuf bytes.Buffer
@@ -27,20 +29,27 @@ func runShellExecutor(cmd exec.Cmd, timeout int) ([]byte, string, string, time.T
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf
 	executionTimestamp := time.Now().UTC()
-	err := cmd.Start()
+	tree, err := startProcessTree(&cmd)
 	if err != nil {
 		return []byte(fmt.Sprintf("Encountered an error starting the process: %q", err.Error())), execute.ERROR_STATUS, execute.ERROR_PID, executionTimestamp
 	}
+	defer tree.release()
 	pid := strconv.Itoa(cmd.Process.Pid)
+	info.NotifyProcessStarted(cmd.Process.Pid)
 	go func() {
 		done <- cmd.Wait()
 	}()
 	select {
 	case <-time.After(time.Duration(timeout) * time.Second):
-		if err := cmd.Process.Kill(); err != nil {
+		if err := tree.kill(); err != nil {
 			return []byte("Timeout reached, but couldn't kill the process"), execute.ERROR_STATUS, pid, executionTimestamp
 		}
 		return []byte("Timeout reached, process killed"), execute.TIMEOUT_STATUS, pid, executionTimestamp
+	case <-info.GetContext().Done():
+		if err := tree.kill(); err != nil {
+			return []byte("Instruction cancelled, but couldn't kill the process"), execute.ERROR_STATUS, pid, executionTimestamp
+		}
+		return []byte("Instruction cancelled, process killed"), execute.CANCELLED_STATUS, pid, executionTimestamp
 	case err := <-done:
 		stdoutBytes := stdoutBuf.Bytes()
 		stderrBytes := stderrBuf.Bytes()
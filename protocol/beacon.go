@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Beacon is the C2 server's response to a beacon request. It is decoded from the wire format by ParseBeacon and
+// deliberately has no JSON tags: the server sends numbers as floats, nests the instructions as JSON strings and
+// omits required fields, so the wire format is kept separately in rawBeacon and validated before it is converted.
+type Beacon struct {
+	Paw            string
+	Sleep          int
+	Watchdog       int
+	NewContact     string
+	ExecutorChange *ExecutorChange
+
+	// Data encoder chains requested by the server, if any.
+	BeaconEncoders []string
+	FileEncoders   []string
+
+	// TLS client certificate delivered by the server, if any.
+	ClientCertificate *ClientCertificate
+
+	// Key for authenticating and encrypting peer-to-peer messages delivered by the server, if any.
+	P2pKey string
+
+	// Beacon timing requested by the server, if any. An empty schedule removes the agent's schedule.
+	Jitter   *int
+	MaxSleep *int
+	Schedule *string
+
+	// IDs of queued or running instructions that the server asks the agent to cancel.
+	CancelLinks []string
+
+	// Instructions that passed validation.
+	Instructions []Instruction
+
+	// Instructions that were received but failed validation.
+	RejectedInstructions []*InstructionError
+}
+
+// ExecutorChange is a server request to modify one of the agent's executors.
+type ExecutorChange struct {
+	Executor string `json:"executor"`
+	Action   string `json:"action"`
+	Value    string `json:"value"`
+}
+
+// ClientCertificate is a PEM-encoded TLS client certificate and private key for mutual TLS.
+type ClientCertificate struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
+
+// Wire format of the beacon response. Instructions are sent as a JSON-dumped list of JSON-dumped instructions.
+type rawBeacon struct {
+	Paw            *string         `json:"paw"`
+	Sleep          *float64        `json:"sleep"`
+	Watchdog       *float64        `json:"watchdog"`
+	Instructions   *string         `json:"instructions"`
+	NewContact     string          `json:"new_contact"`
+	ExecutorChange *ExecutorChange `json:"executor_change"`
+	BeaconEncoders []string        `json:"beacon_encoders"`
+	FileEncoders   []string        `json:"file_encoders"`
+
+	ClientCertificate *ClientCertificate `json:"client_certificate"`
+	P2pKey            string             `json:"p2p_key"`
+
+	Jitter   *float64 `json:"jitter"`
+	MaxSleep *float64 `json:"max_sleep"`
+	Schedule *string  `json:"schedule"`
+
+	CancelLinks json.RawMessage `json:"cancel_link"`
+}
+
+// ParseBeacon converts a beacon response from the C2 server into a Beacon.
+// Returns an error if the beacon itself is malformed. Individual malformed instructions do not cause an error,
+// and are instead listed in the RejectedInstructions field of the returned Beacon.
+func ParseBeacon(data []byte) (*Beacon, error) {
+	var raw rawBeacon
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Paw == nil {
+		return nil, errors.New("beacon missing paw")
+	}
+	if raw.Sleep == nil || *raw.Sleep < 0 {
+		return nil, errors.New("beacon missing valid sleep")
+	}
+	if raw.Watchdog == nil {
+		return nil, errors.New("beacon missing watchdog")
+	}
+	beacon := &Beacon{
+		Paw:            *raw.Paw,
+		Sleep:          int(*raw.Sleep),
+		Watchdog:       int(*raw.Watchdog),
+		NewContact:     raw.NewContact,
+		ExecutorChange: raw.ExecutorChange,
+		BeaconEncoders: raw.BeaconEncoders,
+		FileEncoders:   raw.FileEncoders,
+
+		ClientCertificate: raw.ClientCertificate,
+		P2pKey:            raw.P2pKey,
+
+		Jitter:   optionalInt(raw.Jitter),
+		MaxSleep: optionalInt(raw.MaxSleep),
+		Schedule: raw.Schedule,
+
+		CancelLinks: parseCancelLinks(raw.CancelLinks),
+	}
+	if raw.Instructions != nil && len(*raw.Instructions) > 0 {
+		var marshaledInstructions []json.RawMessage
+		if err := json.Unmarshal([]byte(*raw.Instructions), &marshaledInstructions); err != nil {
+			return nil, fmt.Errorf("malformed beacon instructions: %s", err.Error())
+		}
+		for _, marshaledInstruction := range marshaledInstructions {
+			var instructionStr string
+			if err := json.Unmarshal(marshaledInstruction, &instructionStr); err != nil {
+				beacon.RejectedInstructions = append(beacon.RejectedInstructions, &InstructionError{Err: err})
+				continue
+			}
+			instruction, err := ParseInstruction([]byte(instructionStr))
+			if err != nil {
+				beacon.RejectedInstructions = append(beacon.RejectedInstructions, err.(*InstructionError))
+				continue
+			}
+			beacon.Instructions = append(beacon.Instructions, instruction)
+		}
+	}
+	return beacon, nil
+}
+
+// Returns the link IDs in the list of links to cancel. Entries that are not link IDs are dropped rather than failing
+// the beacon, which would count against the server.
+func parseCancelLinks(data json.RawMessage) []string {
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil
+	}
+	var ids []string
+	for _, entry := range entries {
+		var id string
+		if err := json.Unmarshal(entry, &id); err == nil && len(id) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func optionalInt(value *float64) *int {
+	if value == nil {
+		return nil
+	}
+	converted := int(*value)
+	return &converted
+}
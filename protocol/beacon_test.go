@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Returns the wire form of a beacon's instructions: a JSON-dumped list of JSON-dumped instructions.
+func marshalTestInstructions(t *testing.T, instructions ...string) string {
+	data, err := json.Marshal(instructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted, err := json.Marshal(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(quoted)
+}
+
+func TestParseBeacon(t *testing.T) {
+	instructions := marshalTestInstructions(t,
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 60.0}`,
+		`{"id": "link-2", "command": "whoami", "executor": "sh"}`,
+		`not json`,
+	)
+	data := `{"paw": "testpaw", "sleep": 30.0, "watchdog": 0, "instructions": ` + instructions + `,
+		"jitter": 10, "cancel_link": ["link-3"], "unknown": {"nested": true}}`
+	beacon, err := ParseBeacon([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if beacon.Paw != "testpaw" || beacon.Sleep != 30 || beacon.Watchdog != 0 || beacon.Jitter == nil || *beacon.Jitter != 10 {
+		t.Errorf("unexpected beacon: %+v", beacon)
+	}
+	if beacon.MaxSleep != nil || beacon.Schedule != nil {
+		t.Errorf("absent timing fields set: %+v", beacon)
+	}
+	if len(beacon.CancelLinks) != 1 || beacon.CancelLinks[0] != "link-3" {
+		t.Errorf("unexpected links to cancel: %v", beacon.CancelLinks)
+	}
+	if len(beacon.Instructions) != 1 || beacon.Instructions[0].ID != "link-1" || beacon.Instructions[0].Timeout != 60 {
+		t.Errorf("unexpected instructions: %+v", beacon.Instructions)
+	}
+	if len(beacon.RejectedInstructions) != 2 || beacon.RejectedInstructions[0].ID != "link-2" || beacon.RejectedInstructions[1].ID != "" {
+		t.Errorf("unexpected rejected instructions: %+v", beacon.RejectedInstructions)
+	}
+}
+
+func TestParseBeaconRejectsMalformedBeacons(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`["testpaw"]`,
+		`{"sleep": 30, "watchdog": 0}`,
+		`{"paw": "testpaw", "watchdog": 0}`,
+		`{"paw": "testpaw", "sleep": 30}`,
+		`{"paw": 1, "sleep": 30, "watchdog": 0}`,
+		`{"paw": "testpaw", "sleep": "30", "watchdog": 0}`,
+		`{"paw": "testpaw", "sleep": -1, "watchdog": 0}`,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "instructions": []}`,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "instructions": "not json"}`,
+	} {
+		if beacon, err := ParseBeacon([]byte(data)); err == nil {
+			t.Errorf("%s not rejected: %+v", data, beacon)
+		}
+	}
+}
+
+func TestParseBeaconKeepsInstructionsWithOutOfRangeTiming(t *testing.T) {
+	instructions := marshalTestInstructions(t, `{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 60}`)
+	data := `{"paw": "testpaw", "sleep": 30, "watchdog": 0, "instructions": ` + instructions + `,
+		"jitter": 150, "max_sleep": -1}`
+	beacon, err := ParseBeacon([]byte(data))
+	if err != nil {
+		t.Fatalf("beacon with out-of-range timing rejected: %s", err.Error())
+	}
+	if len(beacon.Instructions) != 1 || beacon.Instructions[0].ID != "link-1" {
+		t.Errorf("unexpected instructions: %+v", beacon.Instructions)
+	}
+	if beacon.Jitter == nil || *beacon.Jitter != 150 || beacon.MaxSleep == nil || *beacon.MaxSleep != -1 {
+		t.Errorf("timing not passed on for the sleep policy to clamp: %+v", beacon)
+	}
+}
+
+func TestParseBeaconDropsMalformedLinksToCancel(t *testing.T) {
+	for data, expected := range map[string][]string{
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "cancel_link": "link-1"}`:                nil,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "cancel_link": {"id": "link-1"}}`:        nil,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "cancel_link": ["link-1", 2, "", null]}`: {"link-1"},
+	} {
+		beacon, err := ParseBeacon([]byte(data))
+		if err != nil {
+			t.Errorf("%s rejected: %s", data, err.Error())
+		} else if len(beacon.CancelLinks) != len(expected) || (len(expected) > 0 && beacon.CancelLinks[0] != expected[0]) {
+			t.Errorf("%s parsed with links to cancel %v", data, beacon.CancelLinks)
+		}
+	}
+}
+
+func TestParseBeaconWithoutInstructions(t *testing.T) {
+	for _, data := range []string{
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0}`,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "instructions": ""}`,
+		`{"paw": "testpaw", "sleep": 30, "watchdog": 0, "instructions": "[]"}`,
+	} {
+		beacon, err := ParseBeacon([]byte(data))
+		if err != nil {
+			t.Errorf("%s rejected: %s", data, err.Error())
+		} else if len(beacon.Instructions) > 0 || len(beacon.RejectedInstructions) > 0 {
+			t.Errorf("%s parsed with instructions: %+v", data, beacon)
+		}
+	}
+}
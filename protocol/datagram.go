@@ -0,0 +1,320 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Datagram kinds
+const (
+	datagramData uint8 = 1
+	datagramAck  uint8 = 2
+)
+
+const (
+	DefaultDatagramMTU    = 1200
+	DefaultDatagramWindow = 16
+	MaxDatagramMTU        = 65535         // largest datagram the transport reads
+	datagramHeaderSize    = 1 + 4 + 4 + 4 // kind, message ID, fragment index, fragment count
+	datagramRetransmit    = 500 * time.Millisecond
+	datagramMaxAttempts   = 10
+	datagramMaxFragments  = 1 << 16
+	datagramExpiry        = 2 * time.Minute
+	datagramQueueSize     = 16
+
+	// Bounds on partial messages held by the receiver, so that peers cannot exhaust its memory with fragments of
+	// messages they never complete. Fragments beyond these bounds are dropped without acknowledgement.
+	datagramMaxAssemblies    = 64
+	datagramMaxAssemblyBytes = 2 * MaxFrameSize
+)
+
+// DatagramMessage is a complete message reassembled by a DatagramTransport.
+type DatagramMessage struct {
+	Addr net.Addr
+	ID   uint32
+	Data []byte
+}
+
+// DatagramTransport sends and receives messages of any size over a packet connection. Messages are split into
+// fragments of at most MTU bytes, each of which the receiver acknowledges. The sender keeps up to a window of
+// unacknowledged fragments in flight and retransmits fragments that are not acknowledged in time. Each datagram
+// starts with its kind, the message ID, the fragment index and the fragment count.
+type DatagramTransport struct {
+	conn   net.PacketConn
+	mtu    int
+	window int
+
+	mu         sync.Mutex
+	sending    map[string]chan uint32 // acknowledgement channels of messages being sent
+	assembling map[string]*datagramAssembly
+	completed  map[string]time.Time // recently received messages, to drop retransmitted duplicates
+
+	assemblingBytes  int // total size of the fragments held in assembling
+	maxAssemblies    int
+	maxAssemblyBytes int
+
+	messages  chan DatagramMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+type datagramAssembly struct {
+	count     uint32
+	fragments map[uint32][]byte
+	size      int
+	updated   time.Time
+}
+
+// NewDatagramTransport starts reading from conn. The transport owns conn and closes it on Close.
+func NewDatagramTransport(conn net.PacketConn, mtu int, window int) (*DatagramTransport, error) {
+	if mtu <= datagramHeaderSize {
+		return nil, errors.New(fmt.Sprintf("MTU %d is too small, must be larger than %d", mtu, datagramHeaderSize))
+	}
+	if mtu > MaxDatagramMTU {
+		return nil, errors.New(fmt.Sprintf("MTU %d is too large, must be at most %d", mtu, MaxDatagramMTU))
+	}
+	if window < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid window size %d", window))
+	}
+	d := &DatagramTransport{
+		conn:       conn,
+		mtu:        mtu,
+		window:     window,
+		sending:    make(map[string]chan uint32),
+		assembling: make(map[string]*datagramAssembly),
+		completed:  make(map[string]time.Time),
+		messages:   make(chan DatagramMessage, datagramQueueSize),
+		closed:     make(chan struct{}),
+
+		maxAssemblies:    datagramMaxAssemblies,
+		maxAssemblyBytes: datagramMaxAssemblyBytes,
+	}
+	go d.read()
+	return d, nil
+}
+
+// Send delivers the message to addr, blocking until every fragment has been acknowledged.
+func (d *DatagramTransport) Send(addr net.Addr, id uint32, data []byte) error {
+	fragmentSize := d.mtu - datagramHeaderSize
+	count := (len(data) + fragmentSize - 1) / fragmentSize
+	if count == 0 {
+		count = 1
+	} else if count > datagramMaxFragments {
+		return errors.New(fmt.Sprintf("Message of %d bytes needs more than %d fragments", len(data), datagramMaxFragments))
+	}
+	key := datagramKey(addr, id)
+	acks := make(chan uint32, 2*d.window)
+	d.mu.Lock()
+	d.sending[key] = acks
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.sending, key)
+		d.mu.Unlock()
+	}()
+
+	acked := make([]bool, count)
+	sentAt := make([]time.Time, count)
+	attempts := make([]int, count)
+	sendFragment := func(index int) error {
+		if attempts[index] == datagramMaxAttempts {
+			return errors.New(fmt.Sprintf("Fragment %d of message %d was not acknowledged after %d attempts", index, id, datagramMaxAttempts))
+		}
+		start := index * fragmentSize
+		end := start + fragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		attempts[index]++
+		sentAt[index] = time.Now()
+		_, err := d.conn.WriteTo(encodeDatagram(datagramData, id, uint32(index), uint32(count), data[start:end]), addr)
+		return err
+	}
+	remaining, base, next := count, 0, 0
+	for remaining > 0 {
+		for acked[base] {
+			base++
+		}
+		now := time.Now()
+		for i := base; i < next; i++ {
+			if !acked[i] && now.Sub(sentAt[i]) >= datagramRetransmit {
+				if err := sendFragment(i); err != nil {
+					return err
+				}
+			}
+		}
+		for ; next < count && next < base+d.window; next++ {
+			if err := sendFragment(next); err != nil {
+				return err
+			}
+		}
+		select {
+		case index := <-acks:
+			if int(index) < count && !acked[index] {
+				acked[index] = true
+				remaining--
+			}
+		case <-time.After(datagramRetransmit):
+		case <-d.closed:
+			return d.err
+		}
+	}
+	return nil
+}
+
+// Receive returns the next complete message.
+func (d *DatagramTransport) Receive() (DatagramMessage, error) {
+	select {
+	case msg := <-d.messages:
+		return msg, nil
+	case <-d.closed:
+		return DatagramMessage{}, d.err
+	}
+}
+
+// Close closes the underlying connection, failing any pending Send and Receive calls.
+func (d *DatagramTransport) Close() error {
+	err := d.conn.Close()
+	d.shutdown(errors.New("datagram transport closed"))
+	return err
+}
+
+func (d *DatagramTransport) shutdown(err error) {
+	d.closeOnce.Do(func() {
+		d.err = err
+		close(d.closed)
+	})
+}
+
+// Reads datagrams until the connection fails, routing acknowledgements to senders and reassembling messages.
+func (d *DatagramTransport) read() {
+	buf := make([]byte, MaxDatagramMTU)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			d.shutdown(err)
+			return
+		}
+		if n < datagramHeaderSize {
+			continue
+		}
+		kind := buf[0]
+		id := binary.BigEndian.Uint32(buf[1:5])
+		index := binary.BigEndian.Uint32(buf[5:9])
+		count := binary.BigEndian.Uint32(buf[9:13])
+		key := datagramKey(addr, id)
+		switch kind {
+		case datagramAck:
+			d.mu.Lock()
+			acks, ok := d.sending[key]
+			d.mu.Unlock()
+			if ok {
+				select {
+				case acks <- index:
+				default:
+				}
+			}
+		case datagramData:
+			if count == 0 || count > datagramMaxFragments || index >= count {
+				continue
+			}
+			fragment := append([]byte{}, buf[datagramHeaderSize:n]...)
+			data, complete, accepted := d.assemble(key, index, count, fragment)
+			if !accepted {
+				continue
+			}
+			d.conn.WriteTo(encodeDatagram(datagramAck, id, index, count, nil), addr)
+			if complete {
+				select {
+				case d.messages <- DatagramMessage{Addr: addr, ID: id, Data: data}:
+				case <-d.closed:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stores a received fragment, returning the reassembled message once all of its fragments have arrived. Fragments
+// that do not match their message or do not fit within the assembly bounds are not accepted.
+func (d *DatagramTransport) assemble(key string, index uint32, count uint32, fragment []byte) ([]byte, bool, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.expire(now)
+	if _, ok := d.completed[key]; ok {
+		return nil, false, true
+	}
+	assembly, ok := d.assembling[key]
+	if !ok {
+		if len(d.assembling) >= d.maxAssemblies {
+			return nil, false, false
+		}
+		assembly = &datagramAssembly{count: count, fragments: make(map[uint32][]byte)}
+		d.assembling[key] = assembly
+	} else if assembly.count != count {
+		return nil, false, false
+	}
+	if _, ok = assembly.fragments[index]; !ok {
+		if d.assemblingBytes+len(fragment) > d.maxAssemblyBytes {
+			if len(assembly.fragments) == 0 {
+				delete(d.assembling, key)
+			}
+			return nil, false, false
+		}
+		assembly.fragments[index] = fragment
+		assembly.size += len(fragment)
+		d.assemblingBytes += len(fragment)
+	}
+	assembly.updated = now
+	if uint32(len(assembly.fragments)) < assembly.count {
+		return nil, false, true
+	}
+	d.removeAssembly(key)
+	d.completed[key] = now
+	data := make([]byte, 0, assembly.size)
+	for i := uint32(0); i < assembly.count; i++ {
+		data = append(data, assembly.fragments[i]...)
+	}
+	return data, true, true
+}
+
+// Must be called with the lock held.
+func (d *DatagramTransport) removeAssembly(key string) {
+	if assembly, ok := d.assembling[key]; ok {
+		d.assemblingBytes -= assembly.size
+		delete(d.assembling, key)
+	}
+}
+
+// Discards stale partial messages and forgets old completed ones. Must be called with the lock held.
+func (d *DatagramTransport) expire(now time.Time) {
+	for key, assembly := range d.assembling {
+		if now.Sub(assembly.updated) > datagramExpiry {
+			d.removeAssembly(key)
+		}
+	}
+	for key, completedAt := range d.completed {
+		if now.Sub(completedAt) > datagramExpiry {
+			delete(d.completed, key)
+		}
+	}
+}
+
+func encodeDatagram(kind uint8, id uint32, index uint32, count uint32, payload []byte) []byte {
+	buf := make([]byte, 0, datagramHeaderSize+len(payload))
+	buf = append(buf, kind)
+	buf = appendUint32(buf, id)
+	buf = appendUint32(buf, index)
+	buf = appendUint32(buf, count)
+	return append(buf, payload...)
+}
+
+func datagramKey(addr net.Addr, id uint32) string {
+	return fmt.Sprintf("%s/%d", addr.String(), id)
+}
@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Packet connection that drops or duplicates the datagrams it sends.
+type lossyConn struct {
+	net.PacketConn
+	mu        sync.Mutex
+	dropEach  int // drop every dropEach-th datagram, 0 to drop none
+	dropAll   bool
+	duplicate bool
+	written   int
+	dropped   int
+}
+
+func (c *lossyConn) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.written++
+	drop := c.dropAll || (c.dropEach > 0 && c.written%c.dropEach == 0)
+	if drop {
+		c.dropped++
+	}
+	duplicate := c.duplicate
+	c.mu.Unlock()
+	if drop {
+		return len(buf), nil
+	}
+	if duplicate {
+		c.PacketConn.WriteTo(buf, addr)
+	}
+	return c.PacketConn.WriteTo(buf, addr)
+}
+
+func (c *lossyConn) setLoss(dropEach int, dropAll bool, duplicate bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropEach, c.dropAll, c.duplicate = dropEach, dropAll, duplicate
+}
+
+func (c *lossyConn) droppedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// Returns a sending and a receiving transport on local sockets. The sender's datagrams go through conn, and the
+// receiver's acknowledgements through the returned lossy connection.
+func newTestTransports(t *testing.T, mtu int, window int) (*DatagramTransport, *lossyConn, *DatagramTransport, *lossyConn) {
+	newTransport := func() (*DatagramTransport, *lossyConn) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lossy := &lossyConn{PacketConn: conn}
+		transport, err := NewDatagramTransport(lossy, mtu, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transport, lossy
+	}
+	sender, senderConn := newTransport()
+	receiver, receiverConn := newTransport()
+	return sender, senderConn, receiver, receiverConn
+}
+
+func receiveWithin(t *testing.T, transport *DatagramTransport, timeout time.Duration) (DatagramMessage, bool) {
+	received := make(chan DatagramMessage, 1)
+	go func() {
+		if msg, err := transport.Receive(); err == nil {
+			received <- msg
+		}
+	}()
+	select {
+	case msg := <-received:
+		return msg, true
+	case <-time.After(timeout):
+		return DatagramMessage{}, false
+	}
+}
+
+func testMessage(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestDatagramFragmentsAndReassembles(t *testing.T) {
+	sender, _, receiver, _ := newTestTransports(t, 100, 4)
+	defer sender.Close()
+	defer receiver.Close()
+	data := testMessage(1000)
+	if err := sender.Send(receiver.conn.LocalAddr(), 42, data); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := receiveWithin(t, receiver, time.Second)
+	if !ok {
+		t.Fatal("message not received")
+	}
+	if msg.ID != 42 || !bytes.Equal(msg.Data, data) || msg.Addr.String() != sender.conn.LocalAddr().String() {
+		t.Errorf("unexpected message %d of %d bytes from %s", msg.ID, len(msg.Data), msg.Addr)
+	}
+
+	// Empty messages take a single fragment.
+	if err := sender.Send(receiver.conn.LocalAddr(), 43, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok = receiveWithin(t, receiver, time.Second); !ok || msg.ID != 43 || len(msg.Data) != 0 {
+		t.Errorf("empty message not received: %+v", msg)
+	}
+}
+
+func TestDatagramRetransmitsLostFragmentsAndAcks(t *testing.T) {
+	sender, senderConn, receiver, receiverConn := newTestTransports(t, 64, 8)
+	defer sender.Close()
+	defer receiver.Close()
+	senderConn.setLoss(3, false, false)
+	receiverConn.setLoss(4, false, false)
+	data := testMessage(600)
+	if err := sender.Send(receiver.conn.LocalAddr(), 1, data); err != nil {
+		t.Fatal(err)
+	}
+	msg, ok := receiveWithin(t, receiver, time.Second)
+	if !ok || !bytes.Equal(msg.Data, data) {
+		t.Fatalf("message not reassembled after losses: %d bytes", len(msg.Data))
+	}
+	if senderConn.droppedCount() == 0 || receiverConn.droppedCount() == 0 {
+		t.Error("no datagrams were dropped")
+	}
+}
+
+func TestDatagramDropsDuplicates(t *testing.T) {
+	sender, senderConn, receiver, _ := newTestTransports(t, 64, 4)
+	defer sender.Close()
+	defer receiver.Close()
+	senderConn.setLoss(0, false, true)
+	if err := sender.Send(receiver.conn.LocalAddr(), 7, testMessage(300)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := receiveWithin(t, receiver, time.Second); !ok {
+		t.Fatal("message not received")
+	}
+	if msg, ok := receiveWithin(t, receiver, 200*time.Millisecond); ok {
+		t.Errorf("duplicate message %d delivered", msg.ID)
+	}
+}
+
+func TestDatagramSendFailsWithoutAcks(t *testing.T) {
+	sender, senderConn, receiver, _ := newTestTransports(t, 64, 4)
+	defer sender.Close()
+	defer receiver.Close()
+	senderConn.setLoss(0, true, false)
+	start := time.Now()
+	if err := sender.Send(receiver.conn.LocalAddr(), 1, testMessage(10)); err == nil {
+		t.Fatal("send succeeded without acknowledgements")
+	}
+	if elapsed := time.Since(start); elapsed < (datagramMaxAttempts-1)*datagramRetransmit {
+		t.Errorf("send gave up after %s, before retransmitting", elapsed)
+	}
+	if dropped := senderConn.droppedCount(); dropped != datagramMaxAttempts {
+		t.Errorf("expected %d attempts, got %d", datagramMaxAttempts, dropped)
+	}
+}
+
+func TestDatagramSendFailsOnClose(t *testing.T) {
+	sender, senderConn, receiver, _ := newTestTransports(t, 64, 4)
+	defer receiver.Close()
+	senderConn.setLoss(0, true, false)
+	result := make(chan error, 1)
+	go func() {
+		result <- sender.Send(receiver.conn.LocalAddr(), 1, testMessage(10))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	sender.Close()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("send succeeded on closed transport")
+		}
+	case <-time.After(time.Second):
+		t.Error("send did not fail when the transport was closed")
+	}
+	if _, err := sender.Receive(); err == nil {
+		t.Error("receive succeeded on closed transport")
+	}
+}
+
+func TestNewDatagramTransportValidatesSettings(t *testing.T) {
+	for _, settings := range [][2]int{{datagramHeaderSize, 1}, {MaxDatagramMTU + 1, 1}, {DefaultDatagramMTU, 0}} {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewDatagramTransport(conn, settings[0], settings[1]); err == nil {
+			t.Errorf("transport created with MTU %d and window %d", settings[0], settings[1])
+		}
+		conn.Close()
+	}
+}
+
+func TestDatagramBoundsPartialMessages(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDatagramTransport(conn, 64, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.mu.Lock()
+	d.maxAssemblies, d.maxAssemblyBytes = 2, 10
+	d.mu.Unlock()
+
+	if _, _, accepted := d.assemble("a", 0, 2, testMessage(4)); !accepted {
+		t.Fatal("first partial message not accepted")
+	}
+	if _, _, accepted := d.assemble("b", 0, 2, testMessage(4)); !accepted {
+		t.Fatal("second partial message not accepted")
+	}
+	if _, _, accepted := d.assemble("c", 0, 1, nil); accepted {
+		t.Error("partial message accepted beyond the assembly limit")
+	}
+	if _, _, accepted := d.assemble("b", 1, 2, testMessage(4)); accepted {
+		t.Error("fragment accepted beyond the byte limit")
+	}
+	if _, _, accepted := d.assemble("a", 1, 3, testMessage(2)); accepted {
+		t.Error("fragment with a mismatched count accepted")
+	}
+
+	// Completing a message frees its slot and bytes.
+	data, complete, accepted := d.assemble("a", 1, 2, testMessage(2))
+	if !accepted || !complete || len(data) != 6 {
+		t.Fatalf("message not completed: %d bytes, complete %t, accepted %t", len(data), complete, accepted)
+	}
+	if _, _, accepted = d.assemble("a", 1, 2, testMessage(2)); !accepted {
+		t.Error("retransmitted fragment of a completed message not acknowledged")
+	}
+	if _, _, accepted = d.assemble("b", 1, 2, testMessage(4)); !accepted {
+		t.Error("fragment not accepted after bytes were freed")
+	}
+	if _, complete, accepted = d.assemble("c", 0, 1, nil); !accepted || !complete {
+		t.Error("message not accepted after a slot was freed")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.assembling) != 0 || d.assemblingBytes != 0 {
+		t.Errorf("%d partial messages of %d bytes left after completion", len(d.assembling), d.assemblingBytes)
+	}
+}
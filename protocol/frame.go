@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame types
+const (
+	FrameBeacon    uint8 = 1
+	FrameResults   uint8 = 2
+	FramePayload   uint8 = 3
+	FrameUpload    uint8 = 4
+	FrameKeepalive uint8 = 5
+	FrameP2p       uint8 = 6 // Data holds a JSON-encoded peer-to-peer message
+)
+
+// Frame statuses
+const (
+	FrameOK    uint8 = 0
+	FrameError uint8 = 1 // Data holds the error message
+)
+
+// MaxFrameSize bounds the size of a single frame, excluding its length prefix.
+const MaxFrameSize = 64 * 1024 * 1024
+
+const frameHeaderSize = 1 + 1 + 4 + 2 + 2
+
+// Frame is a binary message exchanged over stream-based contacts. On the wire, a frame is a 4-byte big-endian
+// length of the rest of the frame, followed by the type, status, 4-byte request ID, 2-byte length-prefixed name
+// and encoding strings, and finally the data. Responses carry the type and ID of the request they answer.
+type Frame struct {
+	Type     uint8
+	Status   uint8
+	ID       uint32
+	Name     string
+	Encoding string
+	Data     []byte
+}
+
+// WriteFrame writes the frame to w in a single write.
+func WriteFrame(w io.Writer, frame Frame) error {
+	if len(frame.Name) > 0xffff || len(frame.Encoding) > 0xffff {
+		return errors.New("frame name or encoding too long")
+	}
+	size := frameHeaderSize + len(frame.Name) + len(frame.Encoding) + len(frame.Data)
+	if size > MaxFrameSize {
+		return errors.New(fmt.Sprintf("frame of %d bytes exceeds the maximum frame size", size))
+	}
+	buf := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf = append(buf, frame.Type, frame.Status)
+	buf = appendUint32(buf, frame.ID)
+	buf = appendUint16(buf, uint16(len(frame.Name)))
+	buf = append(buf, frame.Name...)
+	buf = appendUint16(buf, uint16(len(frame.Encoding)))
+	buf = append(buf, frame.Encoding...)
+	buf = append(buf, frame.Data...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads the next frame from r.
+func ReadFrame(r io.Reader) (Frame, error) {
+	return ReadFrameLimit(r, MaxFrameSize)
+}
+
+// ReadFrameLimit reads the next frame from r, rejecting frames larger than maxSize or MaxFrameSize. Memory is
+// allocated as the frame's data arrives rather than for the size it declares.
+func ReadFrameLimit(r io.Reader, maxSize int) (Frame, error) {
+	var frame Frame
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(r, sizeBuf[:]); err != nil {
+		return frame, err
+	}
+	size := binary.BigEndian.Uint32(sizeBuf[:])
+	if size < frameHeaderSize || size > MaxFrameSize || (maxSize > 0 && int64(size) > int64(maxSize)) {
+		return frame, errors.New(fmt.Sprintf("invalid frame size %d", size))
+	}
+	var frameBuf bytes.Buffer
+	if _, err := io.CopyN(&frameBuf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame, err
+	}
+	buf := frameBuf.Bytes()
+	frame.Type = buf[0]
+	frame.Status = buf[1]
+	frame.ID = binary.BigEndian.Uint32(buf[2:6])
+	rest := buf[6:]
+	var err error
+	if frame.Name, rest, err = readFrameString(rest); err != nil {
+		return frame, err
+	}
+	if frame.Encoding, rest, err = readFrameString(rest); err != nil {
+		return frame, err
+	}
+	frame.Data = rest
+	return frame, nil
+}
+
+// Err returns the error carried by a frame with an error status, or nil.
+func (f Frame) Err() error {
+	if f.Status == FrameOK {
+		return nil
+	}
+	return errors.New(string(f.Data))
+}
+
+func readFrameString(buf []byte) (string, []byte, error) {
+	if len(buf) < 2 {
+		return "", nil, errors.New("truncated frame")
+	}
+	length := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+length {
+		return "", nil, errors.New("truncated frame")
+	}
+	return string(buf[2 : 2+length]), buf[2+length:], nil
+}
+
+func appendUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value>>8), byte(value))
+}
+
+func appendUint32(buf []byte, value uint32) []byte {
+	return append(buf, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
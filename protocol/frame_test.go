@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Type: FrameBeacon, ID: 1, Data: []byte("beacon")},
+		{Type: FramePayload, Status: FrameError, ID: 0xffffffff, Name: "payload.exe", Encoding: "aes-gcm,base64", Data: []byte("not found")},
+		{Type: FrameKeepalive, ID: 3},
+	}
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range frames {
+		frame, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame.Data) == 0 {
+			frame.Data = nil
+		}
+		if !reflect.DeepEqual(frame, expected) {
+			t.Errorf("expected %+v, got %+v", expected, frame)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("expected EOF after the last frame, got %v", err)
+	}
+}
+
+func TestFrameErr(t *testing.T) {
+	if err := (Frame{Status: FrameOK, Data: []byte("data")}).Err(); err != nil {
+		t.Errorf("frame with OK status returned error %v", err)
+	}
+	if err := (Frame{Status: FrameError, Data: []byte("failed")}).Err(); err == nil || err.Error() != "failed" {
+		t.Errorf("expected error failed, got %v", err)
+	}
+}
+
+func TestWriteFrameRejectsOversizedFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, Frame{Data: make([]byte, MaxFrameSize)}); err == nil {
+		t.Error("frame larger than the maximum frame size was written")
+	}
+	if err := WriteFrame(&buf, Frame{Name: string(make([]byte, 0x10000))}); err == nil {
+		t.Error("frame with an oversized name was written")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("rejected frames wrote %d bytes", buf.Len())
+	}
+}
+
+func TestReadFrameRejectsMalformedFrames(t *testing.T) {
+	var valid bytes.Buffer
+	if err := WriteFrame(&valid, Frame{Type: FrameUpload, ID: 7, Name: "file", Encoding: "base64", Data: []byte("data")}); err != nil {
+		t.Fatal(err)
+	}
+	withSize := func(size uint32, rest []byte) []byte {
+		frame := make([]byte, 4, 4+len(rest))
+		binary.BigEndian.PutUint32(frame, size)
+		return append(frame, rest...)
+	}
+	header := valid.Bytes()[4 : 4+frameHeaderSize-4]
+	malformed := map[string][]byte{
+		"truncated length":      valid.Bytes()[:3],
+		"truncated body":        valid.Bytes()[:valid.Len()-1],
+		"size below header":     withSize(frameHeaderSize-1, make([]byte, frameHeaderSize-1)),
+		"size above maximum":    withSize(MaxFrameSize+1, nil),
+		"name overruns frame":   withSize(frameHeaderSize, append(append([]byte(nil), header...), 0xff, 0xff, 0, 0)),
+		"missing encoding size": withSize(frameHeaderSize, append(append([]byte(nil), header...), 0, 2, 'a', 'b')),
+	}
+	for name, data := range malformed {
+		if frame, err := ReadFrame(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: malformed frame read as %+v", name, frame)
+		}
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, Frame{Type: FrameP2p, ID: 1, Data: make([]byte, 100)}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	if _, err := ReadFrameLimit(bytes.NewReader(encoded), 64); err == nil {
+		t.Error("frame above the limit accepted")
+	}
+	if frame, err := ReadFrameLimit(bytes.NewReader(encoded), 1024); err != nil || len(frame.Data) != 100 {
+		t.Errorf("frame within the limit rejected: %v", err)
+	}
+	if _, err := ReadFrameLimit(bytes.NewReader(encoded[:50]), 1024); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+}
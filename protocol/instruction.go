@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Instruction is a single command sent by the C2 server for the agent to run.
+type Instruction struct {
+	ID       string   `json:"id"`
+	Sleep    float64  `json:"sleep"`
+	Command  string   `json:"command"`
+	Executor string   `json:"executor"`
+	Timeout  int      `json:"timeout"`
+	Payloads []string `json:"payloads"`
+	Uploads  []string `json:"uploads"`
+	Deadman  bool     `json:"deadman"`
+}
+
+// UnmarshalJSON accepts any JSON number as the timeout, such as 60.0 from servers that store timeouts as floats.
+// Fractional timeouts are rounded up to whole seconds.
+func (i *Instruction) UnmarshalJSON(data []byte) error {
+	type instructionFields Instruction
+	raw := struct {
+		*instructionFields
+		Timeout float64 `json:"timeout"`
+	}{instructionFields: (*instructionFields)(i)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw.Timeout > math.MaxInt32 {
+		return fmt.Errorf("timeout too large: %v", raw.Timeout)
+	}
+	i.Timeout = int(math.Ceil(raw.Timeout))
+	return nil
+}
+
+// InstructionError is returned when an instruction received from the C2 server cannot be used.
+// ID is populated whenever the instruction ID could be recovered, so that the failure can be reported.
+type InstructionError struct {
+	ID  string
+	Err error
+}
+
+var requiredInstructionFields = []string{"id", "command", "executor", "timeout"}
+
+func (e *InstructionError) Error() string {
+	if len(e.ID) == 0 {
+		return fmt.Sprintf("invalid instruction: %s", e.Err.Error())
+	}
+	return fmt.Sprintf("invalid instruction %s: %s", e.ID, e.Err.Error())
+}
+
+// ParseInstruction converts the JSON representation of an instruction into an Instruction and validates it.
+// Returns an *InstructionError if the instruction is malformed.
+func ParseInstruction(data []byte) (Instruction, error) {
+	var instruction Instruction
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return instruction, &InstructionError{Err: err}
+	}
+	var id string
+	if rawID, ok := fields["id"]; ok {
+		if err := json.Unmarshal(rawID, &id); err != nil {
+			return instruction, &InstructionError{Err: errors.New("id must be a string")}
+		}
+	}
+	for _, field := range requiredInstructionFields {
+		if _, ok := fields[field]; !ok {
+			return instruction, &InstructionError{ID: id, Err: fmt.Errorf("missing required field %s", field)}
+		}
+	}
+	if err := json.Unmarshal(data, &instruction); err != nil {
+		return instruction, &InstructionError{ID: id, Err: err}
+	}
+	if err := instruction.Validate(); err != nil {
+		return instruction, &InstructionError{ID: id, Err: err}
+	}
+	return instruction, nil
+}
+
+// Validate checks that the instruction contains usable values.
+func (i Instruction) Validate() error {
+	if len(i.ID) == 0 {
+		return errors.New("empty instruction id")
+	}
+	if len(i.Command) == 0 {
+		return errors.New("empty command")
+	}
+	if len(i.Executor) == 0 {
+		return errors.New("empty executor")
+	}
+	if i.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %d", i.Timeout)
+	}
+	if i.Sleep < 0 {
+		return fmt.Errorf("sleep must not be negative, got %v", i.Sleep)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseInstruction(t *testing.T) {
+	data := `{"id": "link-1", "sleep": 1.5, "command": "whoami", "executor": "sh", "timeout": 60,
+		"payloads": ["payload.sh"], "uploads": ["upload.txt"], "deadman": true, "unknown": {"nested": [1, 2]}}`
+	instruction, err := ParseInstruction([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Instruction{ID: "link-1", Sleep: 1.5, Command: "whoami", Executor: "sh", Timeout: 60,
+		Payloads: []string{"payload.sh"}, Uploads: []string{"upload.txt"}, Deadman: true}
+	if !reflect.DeepEqual(instruction, expected) {
+		t.Errorf("expected %+v, got %+v", expected, instruction)
+	}
+}
+
+func TestParseInstructionAcceptsFloatTimeouts(t *testing.T) {
+	for data, expected := range map[string]int{
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 60.0}`: 60,
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 0.5}`:  1,
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 6e1}`:  60,
+	} {
+		instruction, err := ParseInstruction([]byte(data))
+		if err != nil {
+			t.Errorf("%s rejected: %s", data, err.Error())
+		} else if instruction.Timeout != expected {
+			t.Errorf("%s parsed with timeout %d, expected %d", data, instruction.Timeout, expected)
+		}
+	}
+}
+
+func TestParseInstructionRejectsMalformedInstructions(t *testing.T) {
+	for data, expectedID := range map[string]string{
+		`not json`:   "",
+		`["link-1"]`: "",
+		`{"id": 1, "command": "whoami", "executor": "sh", "timeout": 60}`:                         "",
+		`{"command": "whoami", "executor": "sh", "timeout": 60}`:                                  "",
+		`{"id": "link-1", "executor": "sh", "timeout": 60}`:                                       "link-1",
+		`{"id": "link-1", "command": "whoami", "timeout": 60}`:                                    "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh"}`:                                 "link-1",
+		`{"id": "link-1", "command": 1, "executor": "sh", "timeout": 60}`:                         "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": "60"}`:                "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 1e300}`:               "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 0}`:                   "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": -1}`:                  "link-1",
+		`{"id": "link-1", "command": "", "executor": "sh", "timeout": 60}`:                        "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 60, "sleep": -1}`:     "link-1",
+		`{"id": "link-1", "command": "whoami", "executor": "sh", "timeout": 60, "payloads": "a"}`: "link-1",
+	} {
+		_, err := ParseInstruction([]byte(data))
+		instructionErr, ok := err.(*InstructionError)
+		if !ok {
+			t.Errorf("%s not rejected with an InstructionError: %v", data, err)
+		} else if instructionErr.ID != expectedID {
+			t.Errorf("%s rejected with ID %q, expected %q", data, instructionErr.ID, expectedID)
+		}
+	}
+	_, err := ParseInstruction([]byte(`{"id": "link-1", "executor": "sh", "timeout": 60}`))
+	if err == nil || !strings.Contains(err.Error(), "missing required field command") {
+		t.Errorf("missing field not named in the error: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package protocol
+
+// ProxyHop describes a single peer-to-peer hop in the form [forwarder paw, receiver address, peer protocol].
+type ProxyHop [3]string
+
+// Statuses of a RunningLink.
+const (
+	LINK_QUEUED  = "queued"
+	LINK_RUNNING = "running"
+)
+
+// RunningLink is an instruction that the agent has queued or is running.
+type RunningLink struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Pid    int    `json:"pid,omitempty"` // process running the instruction, once it has started
+}
+
+// Profile describes the agent to the C2 server and is included in every request made by a contact. Executors and
+// proxy receivers are sent even when empty, as the server replaces the agent's stored values with them.
+type Profile struct {
+	Paw               string              `json:"paw"`
+	Server            string              `json:"server"`
+	Group             string              `json:"group,omitempty"`
+	Host              string              `json:"host"`
+	Contact           string              `json:"contact"`
+	Username          string              `json:"username,omitempty"`
+	Architecture      string              `json:"architecture,omitempty"`
+	Platform          string              `json:"platform"`
+	Location          string              `json:"location,omitempty"`
+	Pid               int                 `json:"pid,omitempty"`
+	Ppid              int                 `json:"ppid,omitempty"`
+	Executors         []string            `json:"executors"`
+	Privilege         string              `json:"privilege,omitempty"`
+	ExeName           string              `json:"exe_name,omitempty"`
+	ProxyReceivers    map[string][]string `json:"proxy_receivers"`
+	OriginLinkID      string              `json:"origin_link_id,omitempty"`
+	DeadmanEnabled    bool                `json:"deadman_enabled,omitempty"`
+	AvailableContacts []string            `json:"available_contacts,omitempty"`
+	AvailableEncoders []string            `json:"available_data_encoders,omitempty"`
+	HostIPAddrs       []string            `json:"host_ip_addrs,omitempty"`
+	UpstreamDest      string              `json:"upstream_dest"`
+	ClientCertID      string              `json:"client_cert_identity,omitempty"`
+	ProxyChain        []ProxyHop          `json:"proxy_chain,omitempty"`
+	RunningLinks      []RunningLink       `json:"running_links,omitempty"`
+	Results           []Result            `json:"results,omitempty"`
+}
+
+// Returns the minimal subset of the profile used for result submission and payload requests.
+func (p Profile) Trimmed() Profile {
+	return Profile{
+		Paw:          p.Paw,
+		Server:       p.Server,
+		Platform:     p.Platform,
+		Host:         p.Host,
+		Contact:      p.Contact,
+		UpstreamDest: p.UpstreamDest,
+	}
+}
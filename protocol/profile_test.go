@@ -0,0 +1,23 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestProfileKeepsEmptyExecutorsAndReceivers(t *testing.T) {
+	data, err := json.Marshal(Profile{Paw: "testpaw", Executors: []string{}, ProxyReceivers: map[string][]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if string(fields["executors"]) != "[]" || string(fields["proxy_receivers"]) != "{}" {
+		t.Errorf("empty executors or proxy receivers not sent: %s", data)
+	}
+	if _, ok := fields["results"]; ok {
+		t.Errorf("empty results sent: %s", data)
+	}
+}
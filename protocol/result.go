@@ -0,0 +1,10 @@
+package protocol
+
+// Result holds the outcome of a single executed instruction.
+type Result struct {
+	ID                string `json:"id"`
+	Output            []byte `json:"output"`
+	Status            string `json:"status"`
+	Pid               string `json:"pid"`
+	AgentReportedTime string `json:"agent_reported_time"`
+}
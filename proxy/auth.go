@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/encoders"
+	"github.com/mitre/gocat/output"
+)
+
+const (
+	// Peer-to-peer messages are sealed with the aes-gcm data encoder, which authenticates them and rejects replays.
+	p2pSealEncoder = "aes-gcm"
+
+	// How long after a key change messages sealed with the previous key are still accepted.
+	p2pKeyTransition = 10 * time.Minute
+)
+
+var (
+	errUnauthenticatedPeer = errors.New("Unauthenticated or replayed peer message rejected.")
+	errNoGroupKey          = errors.New("No peer-to-peer group key set.")
+)
+
+var (
+	groupKeyMu sync.Mutex // guards groupKey, previousGroupKey, groupKeyChangedAt and firstGroupKeyAt
+
+	// Key shared by the agents of a peer-to-peer group. Defaults to the receiverKey build variable and can be
+	// replaced by C2. Without a key, agents neither send nor accept peer-to-peer messages.
+	groupKey string
+
+	// Key in use before the last change, still accepted during the transition so that peers can pick up the new key
+	// at their own pace.
+	previousGroupKey  string
+	groupKeyChangedAt time.Time
+
+	// When C2 first replaced the linked receiverKey. The linked key is accepted until the transition after this
+	// change ends, so that a leaked or rotated linked key stops working.
+	firstGroupKeyAt time.Time
+)
+
+func init() {
+	groupKey = receiverKey
+}
+
+// SetGroupKey replaces the key used to seal and open peer-to-peer messages. Returns false if the key is already in
+// use.
+func SetGroupKey(key string) bool {
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	if key == groupKey {
+		return false
+	}
+	previousGroupKey = groupKey
+	groupKey = key
+	groupKeyChangedAt = time.Now()
+	if firstGroupKeyAt.IsZero() {
+		firstGroupKeyAt = groupKeyChangedAt
+	}
+	return true
+}
+
+// HasGroupKey returns true if a peer-to-peer group key is set.
+func HasGroupKey() bool {
+	key, _, _ := getGroupKeys()
+	return len(key) > 0
+}
+
+// Returns the current and previous group keys, and whether the previous key is still accepted.
+func getGroupKeys() (string, string, bool) {
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	inTransition := !groupKeyChangedAt.IsZero() && time.Since(groupKeyChangedAt) < p2pKeyTransition
+	return groupKey, previousGroupKey, inTransition
+}
+
+// Returns the keys that peer-to-peer messages may be sealed with: the current group key, the previous one during a key
+// transition and the linked receiverKey until the transition after the first key from C2 ends. Empty keys are left out.
+func getAcceptedKeys() []string {
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	keys := []string{groupKey}
+	if !groupKeyChangedAt.IsZero() && time.Since(groupKeyChangedAt) < p2pKeyTransition {
+		keys = append(keys, previousGroupKey)
+	}
+	if firstGroupKeyAt.IsZero() || time.Since(firstGroupKeyAt) < p2pKeyTransition {
+		keys = append(keys, receiverKey)
+	}
+	var accepted []string
+	for _, key := range keys {
+		if len(key) > 0 {
+			accepted = append(accepted, key)
+		}
+	}
+	return accepted
+}
+
+// Seals the message with the given key. Returns an error if the key is empty.
+func sealP2pMsg(data []byte, key string) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errNoGroupKey
+	}
+	return encoders.DataEncoders[p2pSealEncoder].EncodeData(data, map[string]interface{}{"key": key})
+}
+
+// Returns the marshaled message inside a sealed message along with the key it was sealed with. Returns
+// errUnauthenticatedPeer if the message was not sealed with one of the accepted keys, or was already received. Peers
+// that start after the group key changed can reach C2 with the linked receiverKey and pick up the current key until
+// the first key from C2 has been in force for the transition period.
+func openP2pMsg(data []byte) ([]byte, string, error) {
+	err := errors.New("no peer-to-peer group key set")
+	for _, candidate := range getAcceptedKeys() {
+		opened, openErr := encoders.DataEncoders[p2pSealEncoder].DecodeData(data, map[string]interface{}{"key": candidate})
+		if openErr == nil {
+			return opened, candidate, nil
+		}
+		err = openErr
+	}
+	output.VerbosePrint(fmt.Sprintf("[-] Rejected peer message: %s", err.Error()))
+	return nil, "", errUnauthenticatedPeer
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Sets the group keys as if they last changed at the given time, which is also taken as when C2 first replaced the
+// linked key. The returned function restores the previous state.
+func setTestGroupKeys(key string, previousKey string, changedAt time.Time) func() {
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	savedKey, savedPreviousKey, savedChangedAt, savedFirstKeyAt := groupKey, previousGroupKey, groupKeyChangedAt, firstGroupKeyAt
+	groupKey, previousGroupKey, groupKeyChangedAt, firstGroupKeyAt = key, previousKey, changedAt, changedAt
+	return func() {
+		groupKeyMu.Lock()
+		defer groupKeyMu.Unlock()
+		groupKey, previousGroupKey, groupKeyChangedAt, firstGroupKeyAt = savedKey, savedPreviousKey, savedChangedAt, savedFirstKeyAt
+	}
+}
+
+// Sets when C2 first replaced the linked receiverKey. Restored along with the group keys.
+func setTestFirstGroupKeyAt(firstKeyAt time.Time) {
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	firstGroupKeyAt = firstKeyAt
+}
+
+// Sets the linked receiverKey. The returned function restores the previous key.
+func setTestReceiverKey(key string) func() {
+	savedKey := receiverKey
+	receiverKey = key
+	return func() {
+		receiverKey = savedKey
+	}
+}
+
+func sealTestMsg(t *testing.T, key string) []byte {
+	data, err := buildP2pMsgBytes("testpaw", GET_INSTRUCTIONS, []byte("payload"), "", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestOpenP2pMsgWithoutKeyFailsClosed(t *testing.T) {
+	defer setTestGroupKeys("", "", time.Time{})()
+	if _, err := buildP2pMsgBytes("testpaw", GET_INSTRUCTIONS, nil, "", ""); err != errNoGroupKey {
+		t.Errorf("message built without a group key: %v", err)
+	}
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "other key")); err != errUnauthenticatedPeer {
+		t.Errorf("sealed message accepted without a group key: %v", err)
+	}
+	unsealed, err := json.Marshal(P2pMessage{SourcePaw: "testpaw", MessageType: GET_INSTRUCTIONS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = bytesToP2pMsg(unsealed); err != errUnauthenticatedPeer {
+		t.Errorf("unsealed message accepted without a group key: %v", err)
+	}
+}
+
+func TestOpenP2pMsgReturnsSealingKey(t *testing.T) {
+	defer setTestGroupKeys("new key", "old key", time.Now())()
+	for _, key := range []string{"new key", "old key"} {
+		msg, sealedWith, err := bytesToP2pMsg(sealTestMsg(t, key))
+		if err != nil || msg.SourcePaw != "testpaw" || sealedWith != key {
+			t.Errorf("message sealed with %s: opened with %q, error %v", key, sealedWith, err)
+		}
+	}
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "unknown key")); err != errUnauthenticatedPeer {
+		t.Errorf("message sealed with an unknown key accepted: %v", err)
+	}
+}
+
+func TestOpenP2pMsgRejectsUnsealedAfterFirstKey(t *testing.T) {
+	defer setTestGroupKeys("new key", "", time.Now())()
+	unsealed, err := json.Marshal(P2pMessage{SourcePaw: "testpaw", MessageType: GET_INSTRUCTIONS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = bytesToP2pMsg(unsealed); err != errUnauthenticatedPeer {
+		t.Errorf("unsealed message accepted right after the first key was set: %v", err)
+	}
+}
+
+func TestOpenP2pMsgExpiresPreviousKey(t *testing.T) {
+	defer setTestGroupKeys("new key", "old key", time.Now().Add(-p2pKeyTransition))()
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "old key")); err != errUnauthenticatedPeer {
+		t.Errorf("message sealed with the previous key accepted after the transition: %v", err)
+	}
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "new key")); err != nil {
+		t.Errorf("message sealed with the current key rejected: %v", err)
+	}
+}
+
+func TestSetGroupKeyStartsTransition(t *testing.T) {
+	defer setTestGroupKeys("", "", time.Time{})()
+	if !SetGroupKey("first key") || SetGroupKey("first key") {
+		t.Fatal("SetGroupKey did not report the key change correctly")
+	}
+	if key, previousKey, inTransition := getGroupKeys(); key != "first key" || previousKey != "" || !inTransition {
+		t.Errorf("unexpected keys after the change: %q, %q, transition %v", key, previousKey, inTransition)
+	}
+}
+
+func TestLatePeerReachesC2WithLinkedKey(t *testing.T) {
+	defer setTestReceiverKey("linked key")()
+	// The group key changed twice since the late peer's build, and the second transition already ended.
+	defer setTestGroupKeys("current key", "previous key", time.Now().Add(-p2pKeyTransition))()
+	setTestFirstGroupKeyAt(time.Now().Add(-p2pKeyTransition / 2))
+	msg, sealedWith, err := bytesToP2pMsg(sealTestMsg(t, "linked key"))
+	if err != nil || msg.SourcePaw != "testpaw" || sealedWith != "linked key" {
+		t.Fatalf("message from a late peer rejected: opened with %q, error %v", sealedWith, err)
+	}
+	if _, _, err = bytesToP2pMsg(sealTestMsg(t, "previous key")); err != errUnauthenticatedPeer {
+		t.Errorf("message sealed with an expired key accepted: %v", err)
+	}
+}
+
+func TestOpenP2pMsgExpiresLinkedKey(t *testing.T) {
+	defer setTestReceiverKey("linked key")()
+	defer setTestGroupKeys("current key", "linked key", time.Now().Add(-p2pKeyTransition))()
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "linked key")); err != errUnauthenticatedPeer {
+		t.Errorf("message sealed with the linked key accepted after the first key's transition: %v", err)
+	}
+	if _, _, err := bytesToP2pMsg(sealTestMsg(t, "current key")); err != nil {
+		t.Errorf("message sealed with the current key rejected: %v", err)
+	}
+}
+
+func TestSetGroupKeyRecordsFirstKeyOnly(t *testing.T) {
+	defer setTestGroupKeys("linked key", "", time.Time{})()
+	SetGroupKey("first key")
+	groupKeyMu.Lock()
+	firstKeyAt := firstGroupKeyAt
+	groupKeyMu.Unlock()
+	SetGroupKey("second key")
+	groupKeyMu.Lock()
+	defer groupKeyMu.Unlock()
+	if firstKeyAt.IsZero() || !firstGroupKeyAt.Equal(firstKeyAt) {
+		t.Errorf("first key change not recorded: %v, then %v", firstKeyAt, firstGroupKeyAt)
+	}
+}
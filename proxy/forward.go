@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Payload of GET_PAYLOAD_BYTES, RESPONSE_PAYLOAD_BYTES and SEND_FILE_UPLOAD_BYTES messages.
+type p2pFileTransfer struct {
+	Profile *protocol.Profile `json:"profile,omitempty"`
+	Name    string            `json:"name"`
+	Data    []byte            `json:"data,omitempty"`
+}
+
+var (
+	errPeerLoop        = errors.New("Peer request would create a proxy loop.")
+	errUpstreamFailure = errors.New("Upstream request failed.")
+)
+
+// Relays a peer's request through the upstream contact and returns the response message to send back. The
+// forwarding agent is appended to the proxy chain of the peer's profile, and requests that already passed through
+// the forwarding agent are refused with errPeerLoop. Route requests are answered locally.
+func forwardP2pMessage(msg P2pMessage, upstreamComs contact.Contact, agentPaw string, receiverAddr string, peerProtocol string) (P2pMessage, error) {
+	if msg.MessageType == GET_ROUTE_INFO {
+		route, err := getLocalRouteBytes(agentPaw)
+		if err != nil {
+			return P2pMessage{}, err
+		}
+		return buildP2pResponse(agentPaw, RESPONSE_ROUTE_INFO, route), nil
+	}
+	if upstreamComs == nil {
+		return P2pMessage{}, errors.New("No upstream contact available.")
+	}
+	response, err := relayP2pMessage(msg, upstreamComs, agentPaw, receiverAddr, peerProtocol)
+	if err == errUpstreamFailure {
+		markLocalRouteUnhealthy()
+	}
+	return response, err
+}
+
+func relayP2pMessage(msg P2pMessage, upstreamComs contact.Contact, agentPaw string, receiverAddr string, peerProtocol string) (P2pMessage, error) {
+	switch msg.MessageType {
+	case GET_INSTRUCTIONS:
+		profile, err := getForwardedProfile(msg.Payload, agentPaw, receiverAddr, peerProtocol)
+		if err != nil {
+			return P2pMessage{}, err
+		}
+		response := upstreamComs.GetBeaconBytes(profile)
+		if response == nil {
+			return P2pMessage{}, errUpstreamFailure
+		}
+		return buildP2pResponse(agentPaw, RESPONSE_INSTRUCTIONS, response), nil
+	case SEND_EXECUTION_RESULTS:
+		profile, err := getForwardedProfile(msg.Payload, agentPaw, receiverAddr, peerProtocol)
+		if err != nil {
+			return P2pMessage{}, err
+		}
+		results := profile.Results
+		profile.Results = nil
+		for _, result := range results {
+			upstreamComs.SendExecutionResults(profile, result)
+		}
+		return buildP2pResponse(agentPaw, ACK_EXECUTION_RESULTS, nil), nil
+	case GET_PAYLOAD_BYTES:
+		var request p2pFileTransfer
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			return P2pMessage{}, err
+		}
+		if err := forwardProfile(request.Profile, agentPaw, receiverAddr, peerProtocol); err != nil {
+			return P2pMessage{}, err
+		}
+		data, filename := upstreamComs.GetPayloadBytes(*request.Profile, request.Name)
+		if data == nil {
+			return P2pMessage{}, errUpstreamFailure
+		}
+		payload, err := json.Marshal(p2pFileTransfer{Name: filename, Data: data})
+		if err != nil {
+			return P2pMessage{}, err
+		}
+		return buildP2pResponse(agentPaw, RESPONSE_PAYLOAD_BYTES, payload), nil
+	case SEND_FILE_UPLOAD_BYTES:
+		var request p2pFileTransfer
+		if err := json.Unmarshal(msg.Payload, &request); err != nil {
+			return P2pMessage{}, err
+		}
+		if err := forwardProfile(request.Profile, agentPaw, receiverAddr, peerProtocol); err != nil {
+			return P2pMessage{}, err
+		}
+		if err := upstreamComs.UploadFileBytes(*request.Profile, request.Name, request.Data); err != nil {
+			return P2pMessage{}, err
+		}
+		return buildP2pResponse(agentPaw, RESPONSE_FILE_UPLOAD, nil), nil
+	}
+	return P2pMessage{}, errors.New(fmt.Sprintf("Unsupported peer message type %d", msg.MessageType))
+}
+
+func getForwardedProfile(payload []byte, agentPaw string, receiverAddr string, peerProtocol string) (protocol.Profile, error) {
+	var profile protocol.Profile
+	if err := json.Unmarshal(payload, &profile); err != nil {
+		return profile, err
+	}
+	return profile, forwardProfile(&profile, agentPaw, receiverAddr, peerProtocol)
+}
+
+// Refuses profiles from this agent or that already passed through it, and appends this hop to the proxy chain.
+func forwardProfile(profile *protocol.Profile, agentPaw string, receiverAddr string, peerProtocol string) error {
+	if profile == nil {
+		return errors.New("Peer request is missing the agent profile.")
+	}
+	if len(agentPaw) > 0 && (profile.Paw == agentPaw || isInPeerChain(profile, agentPaw)) {
+		return errPeerLoop
+	}
+	updatePeerChain(profile, agentPaw, receiverAddr, peerProtocol)
+	return nil
+}
+
+func buildP2pResponse(agentPaw string, messageType int, payload []byte) P2pMessage {
+	return P2pMessage{
+		SourcePaw:   agentPaw,
+		MessageType: messageType,
+		Payload:     payload,
+		Populated:   true,
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+)
+
+const (
+	apiP2p            = "/p2p"
+	maxP2pMessageSize = 256 * 1024 * 1024
+)
+
+// Port for the HTTP proxy receiver. Can be overridden during linking.
+var httpReceiverPort = "61889"
+
+// HttpReceiver listens on all local interfaces for P2pMessage requests that peers POST to its /p2p endpoint, and
+// relays them to C2 through the agent's current beacon contact.
+type HttpReceiver struct {
+	receiverName string
+	agentServer  *string
+	upstreamComs *contact.Contact
+	waitgroup    *sync.WaitGroup
+	httpServer   *http.Server
+	listener     net.Listener
+	urlList      []string
+
+	mu       sync.Mutex // guards agentPaw
+	agentPaw string
+}
+
+func init() {
+	P2pReceiverChannels["HTTP"] = &HttpReceiver{receiverName: "HTTP"}
+}
+
+func (h *HttpReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", httpReceiverPort))
+	if err != nil {
+		return err
+	}
+	urlList, err := getReceiverURLs("http", listener.Addr())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	h.agentServer = agentServer
+	h.upstreamComs = upstreamComs
+	h.waitgroup = waitgroup
+	h.listener = listener
+	h.urlList = urlList
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiP2p, h.handleP2pRequest)
+	h.httpServer = &http.Server{Handler: mux}
+	return nil
+}
+
+func (h *HttpReceiver) RunReceiver() {
+	defer h.waitgroup.Done()
+	output.VerbosePrint(fmt.Sprintf("[*] Starting HTTP proxy receiver on %s", h.listener.Addr().String()))
+	if err := h.httpServer.Serve(h.listener); err != nil && err != http.ErrServerClosed {
+		output.VerbosePrint(fmt.Sprintf("[-] HTTP proxy receiver stopped: %s", err.Error()))
+	}
+}
+
+func (h *HttpReceiver) UpdateAgentPaw(newPaw string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.agentPaw = newPaw
+}
+
+func (h *HttpReceiver) Terminate() {
+	if err := h.httpServer.Close(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error when terminating HTTP proxy receiver: %s", err.Error()))
+	}
+}
+
+func (h *HttpReceiver) GetReceiverAddresses() []string {
+	return h.urlList
+}
+
+func (h *HttpReceiver) getAgentPaw() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.agentPaw
+}
+
+// Relays a single peer message upstream and writes the response message.
+func (h *HttpReceiver) handleP2pRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxP2pMessageSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg, key, err := bytesToP2pMsg(body)
+	if err == errUnauthenticatedPeer {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil || msgIsEmpty(msg) {
+		http.Error(w, "malformed peer message", http.StatusBadRequest)
+		return
+	}
+	receiverAddr := fmt.Sprintf("http://%s", r.Context().Value(http.LocalAddrContextKey).(net.Addr).String())
+	output.VerbosePrint(fmt.Sprintf("[*] HTTP proxy receiver forwarding message type %d from peer %s", msg.MessageType, msg.SourcePaw))
+	response, err := forwardP2pMessage(msg, *h.upstreamComs, h.getAgentPaw(), receiverAddr, h.receiverName)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error forwarding message from peer %s: %s", msg.SourcePaw, err.Error()))
+		if err == errPeerLoop {
+			http.Error(w, err.Error(), http.StatusLoopDetected)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	data, err := buildP2pMsgBytes(response.SourcePaw, response.MessageType, response.Payload, response.SourceAddress, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// Returns the addresses at which peers can reach the listener, one per local IPv4 address, in the form
+// scheme://ip:port. Falls back to the loopback address if the machine has no other IPv4 addresses.
+func getReceiverURLs(scheme string, listenAddr net.Addr) ([]string, error) {
+	_, port, err := net.SplitHostPort(listenAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	ipList, err := GetLocalIPv4Addresses()
+	if err != nil {
+		return nil, err
+	}
+	if len(ipList) == 0 {
+		ipList = []string{"127.0.0.1"}
+	}
+	urlList := make([]string, 0, len(ipList))
+	for _, ip := range ipList {
+		urlList = append(urlList, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(ip, port)))
+	}
+	return urlList, nil
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+const (
+	p2pClientTimeout = 5 * time.Minute
+	p2pProbeTimeout  = 5 * time.Second
+)
+
+// HttpClient is the peer-to-peer counterpart of HttpReceiver. It implements contact.Contact by POSTing P2pMessage
+// envelopes to the upstream peer's /p2p endpoint, so that an agent without direct C2 reachability can beacon
+// through a neighbour.
+type HttpClient struct {
+	p2pClient
+	client      *http.Client
+	probeClient *http.Client
+}
+
+func init() {
+	httpClient := &HttpClient{probeClient: &http.Client{Timeout: p2pProbeTimeout}}
+	httpClient.p2pClient = p2pClient{name: "HTTP", roundTrip: httpClient.post, probe: httpClient.postProbe}
+	P2pClientChannels["HTTP"] = httpClient
+}
+
+func (h *HttpClient) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	h.client = &http.Client{Timeout: p2pClientTimeout}
+	return true, nil
+}
+
+func (h *HttpClient) post(upstreamDestAddr string, msg []byte) ([]byte, error) {
+	return postP2pMsg(h.client, upstreamDestAddr, msg)
+}
+
+func (h *HttpClient) postProbe(receiverAddr string, msg []byte) ([]byte, error) {
+	return postP2pMsg(h.probeClient, receiverAddr, msg)
+}
+
+func postP2pMsg(client *http.Client, upstreamDestAddr string, msg []byte) ([]byte, error) {
+	address := fmt.Sprintf("%s%s", upstreamDestAddr, apiP2p)
+	resp, err := client.Post(address, "application/json", bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxP2pMessageSize))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Peer responded with status code %d: %s", resp.StatusCode, string(bytes.TrimSpace(body))))
+	}
+	return body, nil
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Starts an HTTP receiver on a local port that relays through the given upstream contact, and returns its address.
+func startTestHttpReceiver(t *testing.T, upstream contact.Contact) (*HttpReceiver, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &HttpReceiver{
+		receiverName: "HTTP",
+		upstreamComs: &upstream,
+		waitgroup:    &sync.WaitGroup{},
+		listener:     listener,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiP2p, receiver.handleP2pRequest)
+	receiver.httpServer = &http.Server{Handler: mux}
+	receiver.UpdateAgentPaw("receiverpaw")
+	receiver.waitgroup.Add(1)
+	go receiver.RunReceiver()
+	return receiver, "http://" + listener.Addr().String()
+}
+
+// Posts a beacon request for the given profile, sealed with the given key, and returns the response.
+func postTestBeacon(t *testing.T, receiverAddr string, profile protocol.Profile, key string) *http.Response {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := buildP2pMsgBytes(profile.Paw, GET_INSTRUCTIONS, data, "", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(receiverAddr+apiP2p, "application/json", bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHttpReceiverRelaysBeaconWithProxyChain(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestHttpReceiver(t, upstream)
+	defer receiver.Terminate()
+
+	resp := postTestBeacon(t, receiverAddr, protocol.Profile{Paw: "peerpaw"}, "test key")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("beacon relay failed with status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, key, err := bytesToP2pMsg(body)
+	if err != nil || key != "test key" {
+		t.Fatalf("response not sealed with the request's key: %q, %v", key, err)
+	}
+	if response.MessageType != RESPONSE_INSTRUCTIONS || string(response.Payload) != `{"paw": "peerpaw"}` {
+		t.Errorf("unexpected response: type %d, payload %s", response.MessageType, response.Payload)
+	}
+	beacons := upstream.requireBeacons(t, 1)
+	chain := beacons[0].ProxyChain
+	if len(chain) != 1 || chain[0] != (protocol.ProxyHop{"receiverpaw", receiverAddr, "HTTP"}) {
+		t.Errorf("unexpected proxy chain: %v", chain)
+	}
+}
+
+func TestHttpReceiverRefusesLoops(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestHttpReceiver(t, upstream)
+	defer receiver.Terminate()
+
+	profiles := []protocol.Profile{
+		{Paw: "receiverpaw"},
+		{Paw: "peerpaw", ProxyChain: []protocol.ProxyHop{{"receiverpaw", "http://127.0.0.1:1", "HTTP"}}},
+	}
+	for _, profile := range profiles {
+		resp := postTestBeacon(t, receiverAddr, profile, "test key")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("beacon from %s via %v answered with status %d", profile.Paw, profile.ProxyChain, resp.StatusCode)
+		}
+	}
+	if beacons := upstream.getBeacons(); len(beacons) > 0 {
+		t.Errorf("looping beacons relayed: %v", beacons)
+	}
+}
+
+func TestHttpReceiverRefusesUnauthenticatedPeers(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestHttpReceiver(t, upstream)
+	defer receiver.Terminate()
+
+	resp := postTestBeacon(t, receiverAddr, protocol.Profile{Paw: "peerpaw"}, "other key")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("beacon sealed with an unknown key answered with status %d", resp.StatusCode)
+	}
+	if beacons := upstream.getBeacons(); len(beacons) > 0 {
+		t.Errorf("unauthenticated beacon relayed: %v", beacons)
+	}
+}
+
+// Returns an HTTP client contact set up the way the agent sets up its peer-to-peer clients.
+func newTestHttpClient(upstreamDestAddr string) *HttpClient {
+	httpClient := &HttpClient{probeClient: &http.Client{Timeout: p2pProbeTimeout}}
+	httpClient.p2pClient = p2pClient{name: "HTTP", roundTrip: httpClient.post, probe: httpClient.postProbe}
+	httpClient.C2RequirementsMet(protocol.Profile{}, nil)
+	httpClient.SetUpstreamDestAddr(upstreamDestAddr)
+	return httpClient
+}
+
+func TestHttpClientRelaysThroughReceiver(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestHttpReceiver(t, upstream)
+	defer receiver.Terminate()
+	client := newTestHttpClient(receiverAddr)
+	profile := protocol.Profile{Paw: "peerpaw"}
+
+	if beacon := client.GetBeaconBytes(profile); string(beacon) != `{"paw": "peerpaw"}` {
+		t.Errorf("unexpected beacon response: %s", beacon)
+	}
+	client.SendExecutionResults(profile, protocol.Result{ID: "link-1", Output: []byte("output")})
+	if payload, name := client.GetPayloadBytes(profile, "payload.sh"); string(payload) != "payload payload.sh" || name != "payload.sh" {
+		t.Errorf("unexpected payload %q named %q", payload, name)
+	}
+	if err := client.UploadFileBytes(profile, "upload.txt", []byte("upload")); err != nil {
+		t.Errorf("upload failed: %s", err.Error())
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.results) != 1 || upstream.results[0].ID != "link-1" || string(upstream.results[0].Output) != "output" {
+		t.Errorf("unexpected results relayed: %v", upstream.results)
+	}
+	if string(upstream.uploads["upload.txt"]) != "upload" {
+		t.Errorf("unexpected uploads relayed: %v", upstream.uploads)
+	}
+}
+
+func TestHttpClientFailsOnRefusedLoops(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	receiver, receiverAddr := startTestHttpReceiver(t, &testUpstream{})
+	defer receiver.Terminate()
+	client := newTestHttpClient(receiverAddr)
+
+	if beacon := client.GetBeaconBytes(protocol.Profile{Paw: "receiverpaw"}); beacon != nil {
+		t.Errorf("looping beacon answered: %s", beacon)
+	}
+	if err := client.UploadFileBytes(protocol.Profile{Paw: "receiverpaw"}, "upload.txt", nil); err == nil {
+		t.Error("looping upload succeeded")
+	}
+}
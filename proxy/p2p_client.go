@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Implements the contact.Contact methods shared by the peer-to-peer clients. Each request is wrapped in a
+// P2pMessage envelope and handed to roundTrip, which delivers it to the upstream peer receiver and returns the
+// marshaled response envelope. Route probes use probe instead, which must work for any receiver address and
+// return quickly.
+type p2pClient struct {
+	name             string
+	upstreamDestAddr string
+	roundTrip        func(upstreamDestAddr string, msg []byte) ([]byte, error)
+	probe            func(receiverAddr string, msg []byte) ([]byte, error)
+}
+
+func (p *p2pClient) GetBeaconBytes(profile protocol.Profile) []byte {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request beacon. Error with profile marshal: %s", err.Error()))
+		return nil
+	}
+	response, err := p.send(profile.Paw, GET_INSTRUCTIONS, data, RESPONSE_INSTRUCTIONS)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Peer beacon failed: %s", err.Error()))
+		return nil
+	}
+	return response.Payload
+}
+
+func (p *p2pClient) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	data, err := json.Marshal(p2pFileTransfer{Profile: &profile, Name: payload})
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot request payload. Error with request marshal: %s", err.Error()))
+		return nil, ""
+	}
+	response, err := p.send(profile.Paw, GET_PAYLOAD_BYTES, data, RESPONSE_PAYLOAD_BYTES)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error sending payload request to peer: %s", err.Error()))
+		return nil, ""
+	}
+	var transfer p2pFileTransfer
+	if err = json.Unmarshal(response.Payload, &transfer); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Malformed payload response from peer: %s", err.Error()))
+		return nil, ""
+	}
+	return transfer.Data, transfer.Name
+}
+
+func (p *p2pClient) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	profile.Results = []protocol.Result{result}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Cannot send results. Error with profile marshal: %s", err.Error()))
+		return
+	}
+	if _, err = p.send(profile.Paw, SEND_EXECUTION_RESULTS, data, ACK_EXECUTION_RESULTS); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to send results to peer: %s", err.Error()))
+	}
+}
+
+func (p *p2pClient) GetName() string {
+	return p.name
+}
+
+func (p *p2pClient) SetUpstreamDestAddr(upstreamDestAddr string) {
+	p.upstreamDestAddr = upstreamDestAddr
+}
+
+func (p *p2pClient) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	request, err := json.Marshal(p2pFileTransfer{Profile: &profile, Name: uploadName, Data: data})
+	if err != nil {
+		return err
+	}
+	_, err = p.send(profile.Paw, SEND_FILE_UPLOAD_BYTES, request, RESPONSE_FILE_UPLOAD)
+	return err
+}
+
+func (p *p2pClient) ProbeRoute(receiverAddr string, paw string) (RouteInfo, error) {
+	var route RouteInfo
+	response, err := exchangeP2pMsg(p.probe, receiverAddr, paw, GET_ROUTE_INFO, nil, RESPONSE_ROUTE_INFO)
+	if err != nil {
+		return route, err
+	}
+	err = json.Unmarshal(response.Payload, &route)
+	return route, err
+}
+
+// Wraps the payload in a P2pMessage, sends it to the upstream peer and returns the unwrapped response, which must
+// be of the expected type.
+func (p *p2pClient) send(paw string, messageType int, payload []byte, expectedType int) (P2pMessage, error) {
+	return exchangeP2pMsg(p.roundTrip, p.upstreamDestAddr, paw, messageType, payload, expectedType)
+}
+
+func exchangeP2pMsg(roundTrip func(string, []byte) ([]byte, error), address string, paw string, messageType int, payload []byte, expectedType int) (P2pMessage, error) {
+	key, _, _ := getGroupKeys()
+	msgBytes, err := buildP2pMsgBytes(paw, messageType, payload, "", key)
+	if err != nil {
+		return P2pMessage{}, err
+	}
+	responseBytes, err := roundTrip(address, msgBytes)
+	if err != nil {
+		return P2pMessage{}, err
+	}
+	response, _, err := bytesToP2pMsg(responseBytes)
+	if err != nil {
+		return P2pMessage{}, err
+	}
+	if msgIsEmpty(response) || response.MessageType != expectedType {
+		return P2pMessage{}, errors.New(fmt.Sprintf("Unexpected response message type %d from peer", response.MessageType))
+	}
+	return response, nil
+}
@@ -16,6 +16,8 @@ const (
 	ACK_EXECUTION_RESULTS = 6
 	SEND_FILE_UPLOAD_BYTES = 7
 	RESPONSE_FILE_UPLOAD = 8
+	GET_ROUTE_INFO = 9
+	RESPONSE_ROUTE_INFO = 10
 )
 
 // P2pReceiver defines required functions for relaying messages between peers and an upstream peer/c2.
@@ -27,6 +29,11 @@ type P2pReceiver interface {
 	GetReceiverAddresses() []string
 }
 
+// PeerStatsReporter is implemented by receivers that track the traffic they relay for each downstream peer.
+type PeerStatsReporter interface {
+	GetPeerStats() []PeerStats
+}
+
 // P2pClient will implement the contact.Contact interface.
 
 // Defines message structure for p2p
@@ -45,10 +52,15 @@ var (
 	// Contains the C2 Contact implementations strictly for peer-to-peer communications.
 	P2pClientChannels = map[string]contact.Contact{}
 
-	// Contains the base64-encoded JSON-dumped list of available proxy receiver information
-	// in the form [["Proxy protocol 1","Proxy receiver 1"], ... ["Proxy protocol N","Proxy receiver N"]]
+	// Contains the base64-encoded JSON map of proxy protocols to peer receiver addresses, XOR-encoded with
+	// receiverKey.
+	//
+	// Deprecated: peer receivers are provided by the agent configuration. Still read at startup for agents built
+	// by servers that set it during linking, see GetAvailablePeerReceivers.
 	encodedReceivers = ""
 
-	// XOR key for the encoded proxy receiver info.
+	// Peer-to-peer group key used until C2 provides one. Must be set during linking for peer-to-peer
+	// communication, and is accepted by receivers even after C2 changed the key. Peer receivers to connect to are
+	// provided by the agent configuration.
 	receiverKey = ""
 )
\ No newline at end of file
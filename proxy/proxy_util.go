@@ -3,11 +3,14 @@ package proxy
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net"
+
+	"github.com/mitre/gocat/protocol"
 )
 
-// Build p2p message and return the bytes of its JSON marshal.
-func buildP2pMsgBytes(sourcePaw string, messageType int, payload []byte, srcAddr string) ([]byte, error) {
+// Build p2p message and return the bytes of its JSON marshal, sealed with the given key if there is one.
+func buildP2pMsgBytes(sourcePaw string, messageType int, payload []byte, srcAddr string, key string) ([]byte, error) {
 	p2pMsg := &P2pMessage{
 		SourcePaw: sourcePaw,
 		SourceAddress: srcAddr,
@@ -15,15 +18,23 @@ func buildP2pMsgBytes(sourcePaw string, messageType int, payload []byte, srcAddr
 		Payload: payload,
 		Populated: true,
 	}
-	return json.Marshal(p2pMsg)
+	data, err := json.Marshal(p2pMsg)
+	if err != nil {
+		return nil, err
+	}
+	return sealP2pMsg(data, key)
 }
-// Convert bytes of JSON marshal into P2pMessage struct
-func bytesToP2pMsg(data []byte) (P2pMessage, error) {
+// Convert bytes of JSON marshal into P2pMessage struct. Also returns the key the message was sealed with.
+func bytesToP2pMsg(data []byte) (P2pMessage, string, error) {
 	var message P2pMessage
+	data, key, err := openP2pMsg(data)
+	if err != nil {
+		return message, key, err
+	}
 	if err := json.Unmarshal(data, &message); err == nil {
-		return message, nil
+		return message, key, nil
 	} else {
-		return message, err
+		return message, key, err
 	}
 }
 
@@ -41,49 +52,40 @@ func decodeXor(ciphertext string, xorKey string) string {
 	return decoded
 }
 
-// Returns map mapping proxy receiver protocol to list of peer receiver addresses.
+// Returns map mapping proxy receiver protocol to list of peer receiver addresses, decoded from encodedReceivers.
+//
+// Deprecated: peer receivers are provided by the agent configuration. Only kept for agents built by servers that
+// still set encodedReceivers during linking, whose receivers are added to the configuration at startup.
 func GetAvailablePeerReceivers() (map[string][]string, error) {
 	peerReceiverInfo := make(map[string][]string)
-	if len(encodedReceivers) > 0 && len(receiverKey) > 0 {
-		ciphertext, err := base64.StdEncoding.DecodeString(encodedReceivers)
-		if err != nil {
-			return nil, err
-		}
-		decodedReceiverInfo := decodeXor(string(ciphertext), receiverKey)
-		if err = json.Unmarshal([]byte(decodedReceiverInfo), &peerReceiverInfo); err != nil {
-			return nil, err
-		}
+	if len(encodedReceivers) == 0 {
+		return peerReceiverInfo, nil
+	}
+	if len(receiverKey) == 0 {
+		return nil, errors.New("encodedReceivers is set, but receiverKey is not")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encodedReceivers)
+	if err != nil {
+		return nil, err
+	}
+	decodedReceiverInfo := decodeXor(string(ciphertext), receiverKey)
+	if err = json.Unmarshal([]byte(decodedReceiverInfo), &peerReceiverInfo); err != nil {
+		return nil, err
 	}
 	return peerReceiverInfo, nil
 }
 
 // Given the client profile, append the forwarder's paw, receiver address, and peer protocol to the peer proxy
 // chain information in the profile to update the peer-to-peer hops. Modifies the given client profile.
-func updatePeerChain(clientProfile map[string]interface{}, forwarderPaw string, receiverAddr string, peerProtocol string) {
-	// Proxy chain must be a list of length-3 lists ([forwarder paw, receiver address, peer protocol])
-	var proxyChain []interface{}
-	if _, ok := clientProfile["proxy_chain"]; ok {
-		proxyChain = clientProfile["proxy_chain"].([]interface{})
-	} else {
-		proxyChain = make([]interface{}, 0)
-	}
-	nextHop := make([]string, 3)
-	nextHop[0] = forwarderPaw
-	nextHop[1] = receiverAddr
-	nextHop[2] = peerProtocol
-	proxyChain = append(proxyChain, nextHop)
-	clientProfile["proxy_chain"] = proxyChain
+func updatePeerChain(clientProfile *protocol.Profile, forwarderPaw string, receiverAddr string, peerProtocol string) {
+	clientProfile.ProxyChain = append(clientProfile.ProxyChain, protocol.ProxyHop{forwarderPaw, receiverAddr, peerProtocol})
 }
 
 // check if a given address/paw is contained in the peer chain
-func isInPeerChain(clientProfile map[string]interface{}, searchPaw string) bool {
-    // Proxy chain is a list of length-3 lists ([forwarder paw, receiver address, peer protocol])
-	if _, ok := clientProfile["proxy_chain"]; ok {
-		proxyChain := clientProfile["proxy_chain"].([]interface{})
-		for _, peer := range proxyChain {
-		    if peer.([]interface{})[0].(string) == searchPaw {
-		        return true
-		    }
+func isInPeerChain(clientProfile *protocol.Profile, searchPaw string) bool {
+	for _, hop := range clientProfile.ProxyChain {
+		if hop[0] == searchPaw {
+			return true
 		}
 	}
 	return false
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+// Sets the linked encodedReceivers. The returned function restores the previous value.
+func setTestEncodedReceivers(encoded string) func() {
+	saved := encodedReceivers
+	encodedReceivers = encoded
+	return func() {
+		encodedReceivers = saved
+	}
+}
+
+func TestGetAvailablePeerReceiversDecodesLinkedReceivers(t *testing.T) {
+	defer setTestReceiverKey("linked key")()
+	receivers := `{"HTTP": ["http://10.0.0.1:61889"], "TCP": ["tcp://10.0.0.2:61890"]}`
+	defer setTestEncodedReceivers(base64.StdEncoding.EncodeToString([]byte(decodeXor(receivers, "linked key"))))()
+
+	peers, err := GetAvailablePeerReceivers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"HTTP": {"http://10.0.0.1:61889"}, "TCP": {"tcp://10.0.0.2:61890"}}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("expected %v, got %v", expected, peers)
+	}
+}
+
+func TestGetAvailablePeerReceiversFailsOnInvalidReceivers(t *testing.T) {
+	defer setTestReceiverKey("")()
+	defer setTestEncodedReceivers("")()
+	if peers, err := GetAvailablePeerReceivers(); err != nil || len(peers) > 0 {
+		t.Errorf("unexpected receivers without encodedReceivers: %v, %v", peers, err)
+	}
+
+	defer setTestEncodedReceivers(base64.StdEncoding.EncodeToString([]byte(`{"HTTP": []}`)))()
+	if _, err := GetAvailablePeerReceivers(); err == nil {
+		t.Error("encodedReceivers accepted without receiverKey")
+	}
+	defer setTestReceiverKey("linked key")()
+	for _, encoded := range []string{"not base64", base64.StdEncoding.EncodeToString([]byte("not json"))} {
+		defer setTestEncodedReceivers(encoded)()
+		if _, err := GetAvailablePeerReceivers(); err == nil {
+			t.Errorf("invalid encodedReceivers %s accepted", encoded)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// RouteInfo is advertised by proxy receivers in response to GET_ROUTE_INFO messages, so that downstream peers can
+// pick the shortest route to C2 that is currently working.
+type RouteInfo struct {
+	Paw     string   `json:"paw"`            // paw of the agent running the receiver
+	Hops    int      `json:"hops"`           // number of peers between that agent and C2
+	Path    []string `json:"path,omitempty"` // paws of those peers, nearest first
+	Healthy bool     `json:"healthy"`        // whether that agent's last request to C2 succeeded
+}
+
+// RouteProber is implemented by peer-to-peer clients that can ask a peer receiver for its route to C2 without
+// switching to it.
+type RouteProber interface {
+	ProbeRoute(receiverAddr string, paw string) (RouteInfo, error)
+}
+
+var (
+	localRouteMu sync.Mutex
+	localRoute   RouteInfo
+)
+
+// SetLocalRoute updates the route that this agent's receivers advertise to their peers.
+func SetLocalRoute(route RouteInfo) {
+	localRouteMu.Lock()
+	defer localRouteMu.Unlock()
+	localRoute = route
+}
+
+// Marks the advertised route as unhealthy until the agent next reaches C2.
+func markLocalRouteUnhealthy() {
+	localRouteMu.Lock()
+	defer localRouteMu.Unlock()
+	localRoute.Healthy = false
+}
+
+func getLocalRouteBytes(agentPaw string) ([]byte, error) {
+	localRouteMu.Lock()
+	route := localRoute
+	localRouteMu.Unlock()
+	route.Paw = agentPaw
+	return json.Marshal(route)
+}
+
+// Returns whether the route passes through the agent with the given paw, in which case using it would create a loop.
+func (r RouteInfo) Contains(paw string) bool {
+	if r.Paw == paw {
+		return true
+	}
+	for _, hop := range r.Path {
+		if hop == paw {
+			return true
+		}
+	}
+	return false
+}
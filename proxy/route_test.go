@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/protocol"
+)
+
+// Sets the route that the local receivers advertise. The returned function restores the previous route.
+func setTestLocalRoute(route RouteInfo) func() {
+	localRouteMu.Lock()
+	defer localRouteMu.Unlock()
+	savedRoute := localRoute
+	localRoute = route
+	return func() {
+		localRouteMu.Lock()
+		defer localRouteMu.Unlock()
+		localRoute = savedRoute
+	}
+}
+
+func TestReceiversAdvertiseLocalRoute(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	defer setTestLocalRoute(RouteInfo{Hops: 2, Path: []string{"upstreampaw"}, Healthy: true})()
+	upstream := &testUpstream{}
+	httpReceiver, httpAddr := startTestHttpReceiver(t, upstream)
+	defer httpReceiver.Terminate()
+	tcpReceiver, tcpAddr := startTestTcpReceiver(t, upstream, "0")
+	defer tcpReceiver.Terminate()
+	tcpClient := newTestStreamClient("TCP", "tcp", "")
+
+	expected := RouteInfo{Paw: "receiverpaw", Hops: 2, Path: []string{"upstreampaw"}, Healthy: true}
+	probers := map[string]RouteProber{httpAddr: newTestHttpClient(""), tcpAddr: tcpClient}
+	for receiverAddr, prober := range probers {
+		route, err := prober.ProbeRoute(receiverAddr, "peerpaw")
+		if err != nil {
+			t.Errorf("route probe of %s failed: %s", receiverAddr, err.Error())
+		} else if !reflect.DeepEqual(route, expected) {
+			t.Errorf("unexpected route from %s: %v", receiverAddr, route)
+		}
+	}
+	if len(upstream.getBeacons()) > 0 {
+		t.Error("route probe relayed upstream")
+	}
+	if tcpClient.conn != nil {
+		t.Error("route probe replaced the client's upstream connection")
+	}
+}
+
+func TestUpstreamFailureMarksRouteUnhealthy(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	defer setTestLocalRoute(RouteInfo{Hops: 1, Healthy: true})()
+	upstream := &testUpstream{failing: true}
+	receiver, receiverAddr := startTestHttpReceiver(t, upstream)
+	defer receiver.Terminate()
+	client := newTestHttpClient(receiverAddr)
+
+	if beacon := client.GetBeaconBytes(protocol.Profile{Paw: "peerpaw"}); beacon != nil {
+		t.Errorf("failed upstream beacon answered: %s", beacon)
+	}
+	route, err := client.ProbeRoute(receiverAddr, "peerpaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.Healthy || route.Hops != 1 {
+		t.Errorf("unexpected route after an upstream failure: %v", route)
+	}
+}
+
+func TestRouteContains(t *testing.T) {
+	route := RouteInfo{Paw: "receiverpaw", Hops: 2, Path: []string{"middlepaw"}}
+	for paw, expected := range map[string]bool{"receiverpaw": true, "middlepaw": true, "peerpaw": false} {
+		if route.Contains(paw) != expected {
+			t.Errorf("route %v contains %s: expected %v", route, paw, expected)
+		}
+	}
+}
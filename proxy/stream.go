@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Limits applied to each downstream peer of a stream receiver, across all of the peer's connections. Peers are told
+// apart by their remote host. Zero values mean no limit.
+type peerQuota struct {
+	maxInFlight          int // concurrent requests awaiting a response
+	maxRequestsPerMinute int
+	maxConnections       int
+	maxFrameSize         int // applies before the message is authenticated, and so also bounds relayed files
+}
+
+// Quota usage of one downstream peer across all of its connections.
+type peerUsage struct {
+	connections    int
+	inFlight       int
+	windowStart    time.Time
+	windowRequests int
+}
+
+// PeerStats describes the traffic a proxy receiver has relayed for one downstream peer connection.
+type PeerStats struct {
+	Address   string
+	Paw       string // paw from the peer's most recent request
+	Connected time.Time
+	LastSeen  time.Time
+	Requests  int
+	Rejected  int // requests refused because the peer exceeded its quota
+	Errors    int
+	InFlight  int
+	BytesIn   int64
+	BytesOut  int64
+}
+
+// Tracks one downstream peer connection of a stream receiver.
+type peerSession struct {
+	conn     net.Conn
+	peer     string // remote host that the peer's quota is tracked for
+	writeMu  sync.Mutex
+	inFlight sync.WaitGroup
+
+	mu    sync.Mutex // guards stats
+	stats PeerStats
+}
+
+// Relays P2pMessage requests that peers send as protocol.Frame messages over connections accepted from a stream
+// listener. Each request is relayed in its own goroutine, so that one connection can carry many concurrent
+// exchanges, and responses carry the frame ID of the request they answer.
+type streamReceiver struct {
+	receiverName string
+	scheme       string // scheme of the receiver address recorded in the proxy chain of relayed profiles
+	upstreamComs *contact.Contact
+	listener     net.Listener
+	quota        peerQuota
+
+	mu       sync.Mutex // guards agentPaw, sessions, peers and closed
+	agentPaw string
+	sessions map[net.Conn]*peerSession
+	peers    map[string]*peerUsage // quota usage by remote host
+	closed   bool
+}
+
+func newStreamReceiver(receiverName string, scheme string, upstreamComs *contact.Contact, listener net.Listener, quota peerQuota) *streamReceiver {
+	return &streamReceiver{
+		receiverName: receiverName,
+		scheme:       scheme,
+		upstreamComs: upstreamComs,
+		listener:     listener,
+		quota:        quota,
+		sessions:     make(map[net.Conn]*peerSession),
+		peers:        make(map[string]*peerUsage),
+	}
+}
+
+// Accepts connections until the listener is closed.
+func (s *streamReceiver) serve() {
+	output.VerbosePrint(fmt.Sprintf("[*] Starting %s proxy receiver on %s", s.receiverName, s.listener.Addr().String()))
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				output.VerbosePrint(fmt.Sprintf("[-] %s proxy receiver stopped: %s", s.receiverName, err.Error()))
+			}
+			return
+		}
+		now := time.Now()
+		session := &peerSession{
+			conn:  conn,
+			peer:  getPeerHost(conn.RemoteAddr()),
+			stats: PeerStats{Address: conn.RemoteAddr().String(), Connected: now, LastSeen: now},
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		usage := s.getPeerUsage(session.peer, now)
+		if s.quota.maxConnections > 0 && usage.connections >= s.quota.maxConnections {
+			s.mu.Unlock()
+			output.VerbosePrint(fmt.Sprintf("[-] %s proxy receiver refused connection from peer %s: more than %d connections", s.receiverName, session.stats.Address, s.quota.maxConnections))
+			conn.Close()
+			continue
+		}
+		usage.connections++
+		s.sessions[conn] = session
+		s.mu.Unlock()
+		go s.handleConn(session)
+	}
+}
+
+// Returns the quota usage of the given peer host, dropping the usage of disconnected peers whose request window
+// ended. Must be called with s.mu held.
+func (s *streamReceiver) getPeerUsage(peer string, now time.Time) *peerUsage {
+	for host, usage := range s.peers {
+		if usage.connections == 0 && usage.inFlight == 0 && now.Sub(usage.windowStart) >= time.Minute {
+			delete(s.peers, host)
+		}
+	}
+	usage, ok := s.peers[peer]
+	if !ok {
+		usage = &peerUsage{windowStart: now}
+		s.peers[peer] = usage
+	}
+	return usage
+}
+
+// Reads request frames from a peer connection until it closes, relaying each one concurrently.
+func (s *streamReceiver) handleConn(session *peerSession) {
+	conn := session.conn
+	defer func() {
+		session.inFlight.Wait()
+		s.mu.Lock()
+		delete(s.sessions, conn)
+		s.peers[session.peer].connections--
+		s.mu.Unlock()
+		conn.Close()
+		stats := session.getStats()
+		output.VerbosePrint(fmt.Sprintf("[*] %s proxy receiver peer %s (paw %s) disconnected after %d requests: %d rejected, %d errors, %d bytes in, %d bytes out",
+			s.receiverName, stats.Address, stats.Paw, stats.Requests, stats.Rejected, stats.Errors, stats.BytesIn, stats.BytesOut))
+	}()
+	for {
+		frame, err := protocol.ReadFrameLimit(conn, s.quota.maxFrameSize)
+		if err != nil {
+			return
+		}
+		if err = s.admit(session, frame); err != nil {
+			output.VerbosePrint(fmt.Sprintf("[-] %s proxy receiver rejected request from peer %s: %s", s.receiverName, session.stats.Address, err.Error()))
+			session.respond(p2pErrorFrame(protocol.Frame{Type: protocol.FrameP2p, ID: frame.ID}, err.Error()))
+			continue
+		}
+		session.inFlight.Add(1)
+		go func() {
+			defer session.inFlight.Done()
+			response := s.relay(session, frame)
+			s.complete(session, response)
+			session.respond(response)
+		}()
+	}
+}
+
+// Relays a single request frame upstream and returns the response frame.
+func (s *streamReceiver) relay(session *peerSession, frame protocol.Frame) protocol.Frame {
+	response := protocol.Frame{Type: protocol.FrameP2p, ID: frame.ID}
+	if frame.Type != protocol.FrameP2p {
+		return p2pErrorFrame(response, fmt.Sprintf("unsupported frame type %d", frame.Type))
+	}
+	msg, key, err := bytesToP2pMsg(frame.Data)
+	if err == errUnauthenticatedPeer {
+		return p2pErrorFrame(response, err.Error())
+	}
+	if err != nil || msgIsEmpty(msg) {
+		return p2pErrorFrame(response, "malformed peer message")
+	}
+	session.setPaw(msg.SourcePaw)
+	output.VerbosePrint(fmt.Sprintf("[*] %s proxy receiver forwarding message type %d from peer %s", s.receiverName, msg.MessageType, msg.SourcePaw))
+	receiverAddr := fmt.Sprintf("%s://%s", s.scheme, session.conn.LocalAddr().String())
+	responseMsg, err := forwardP2pMessage(msg, *s.upstreamComs, s.getAgentPaw(), receiverAddr, s.receiverName)
+	if err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error forwarding message from peer %s: %s", msg.SourcePaw, err.Error()))
+		return p2pErrorFrame(response, err.Error())
+	}
+	if response.Data, err = buildP2pMsgBytes(responseMsg.SourcePaw, responseMsg.MessageType, responseMsg.Payload, responseMsg.SourceAddress, key); err != nil {
+		return p2pErrorFrame(response, err.Error())
+	}
+	return response
+}
+
+func (s *streamReceiver) UpdateAgentPaw(newPaw string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agentPaw = newPaw
+}
+
+func (s *streamReceiver) getAgentPaw() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.agentPaw
+}
+
+// Returns the stats of all currently connected peers.
+func (s *streamReceiver) GetPeerStats() []PeerStats {
+	s.mu.Lock()
+	sessions := make([]*peerSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.Unlock()
+	peerStats := make([]PeerStats, 0, len(sessions))
+	for _, session := range sessions {
+		peerStats = append(peerStats, session.getStats())
+	}
+	return peerStats
+}
+
+// Stops accepting peers and closes all peer connections.
+func (s *streamReceiver) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if err := s.listener.Close(); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Error when terminating %s proxy receiver: %s", s.receiverName, err.Error()))
+	}
+	for conn := range s.sessions {
+		conn.Close()
+	}
+}
+
+// Records an incoming request and checks it against the quota of the peer that sent it.
+func (s *streamReceiver) admit(session *peerSession, frame protocol.Frame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	now := time.Now()
+	session.stats.LastSeen = now
+	session.stats.Requests++
+	session.stats.BytesIn += int64(len(frame.Data))
+	usage := s.peers[session.peer]
+	if now.Sub(usage.windowStart) >= time.Minute {
+		usage.windowStart = now
+		usage.windowRequests = 0
+	}
+	if s.quota.maxInFlight > 0 && usage.inFlight >= s.quota.maxInFlight {
+		session.stats.Rejected++
+		return errors.New(fmt.Sprintf("peer quota exceeded: more than %d concurrent requests", s.quota.maxInFlight))
+	}
+	if s.quota.maxRequestsPerMinute > 0 && usage.windowRequests >= s.quota.maxRequestsPerMinute {
+		session.stats.Rejected++
+		return errors.New(fmt.Sprintf("peer quota exceeded: more than %d requests per minute", s.quota.maxRequestsPerMinute))
+	}
+	usage.windowRequests++
+	usage.inFlight++
+	session.stats.InFlight++
+	return nil
+}
+
+// Records the outcome of a relayed request.
+func (s *streamReceiver) complete(session *peerSession, response protocol.Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	s.peers[session.peer].inFlight--
+	session.stats.InFlight--
+	if response.Status != protocol.FrameOK {
+		session.stats.Errors++
+	}
+}
+
+// Writes a response frame to the peer.
+func (p *peerSession) respond(response protocol.Frame) {
+	p.mu.Lock()
+	p.stats.BytesOut += int64(len(response.Data))
+	p.mu.Unlock()
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if err := protocol.WriteFrame(p.conn, response); err != nil {
+		output.VerbosePrint(fmt.Sprintf("[-] Failed to respond to peer %s: %s", p.conn.RemoteAddr().String(), err.Error()))
+	}
+}
+
+func (p *peerSession) setPaw(paw string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Paw = paw
+}
+
+func (p *peerSession) getStats() PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Returns the host of a network peer, or the address of a local one, such as a Unix domain socket peer.
+func getPeerHost(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+func p2pErrorFrame(response protocol.Frame, message string) protocol.Frame {
+	response.Status = protocol.FrameError
+	response.Data = []byte(message)
+	return response
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/output"
+	"github.com/mitre/gocat/protocol"
+)
+
+const (
+	streamDialTimeout    = 10 * time.Second
+	streamRequestTimeout = 5 * time.Minute
+)
+
+// StreamClient is the peer-to-peer counterpart of the stream-based proxy receivers. It sends P2pMessage envelopes
+// as protocol.Frame messages over a persistent connection to the upstream peer, matching responses to requests by
+// frame ID so that concurrent requests share the connection. Upstream addresses take the form network://address.
+type StreamClient struct {
+	p2pClient
+	network string
+
+	mu       sync.Mutex // guards conn, connAddr, pending and nextID
+	conn     net.Conn
+	connAddr string
+	pending  map[uint32]chan protocol.Frame
+	nextID   uint32
+	writeMu  sync.Mutex
+}
+
+func newStreamClient(name string, network string) *StreamClient {
+	streamClient := &StreamClient{
+		network: network,
+		pending: make(map[uint32]chan protocol.Frame),
+	}
+	streamClient.p2pClient = p2pClient{name: name, roundTrip: streamClient.exchange, probe: streamClient.probe}
+	return streamClient
+}
+
+func (s *StreamClient) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	s.closeConnection()
+	return true, nil
+}
+
+// Sends the message to the upstream peer and waits for the response frame with the same ID.
+func (s *StreamClient) exchange(upstreamDestAddr string, msg []byte) ([]byte, error) {
+	conn, err := s.getConnection(upstreamDestAddr)
+	if err != nil {
+		return nil, err
+	}
+	responseChan := make(chan protocol.Frame, 1)
+	s.mu.Lock()
+	s.nextID++
+	frame := protocol.Frame{Type: protocol.FrameP2p, ID: s.nextID, Data: msg}
+	s.pending[frame.ID] = responseChan
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, frame.ID)
+		s.mu.Unlock()
+	}()
+
+	s.writeMu.Lock()
+	err = protocol.WriteFrame(conn, frame)
+	s.writeMu.Unlock()
+	if err != nil {
+		s.disconnect(conn, err)
+		return nil, err
+	}
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return nil, errors.New("Peer connection closed before response was received.")
+		}
+		if err = response.Err(); err != nil {
+			return nil, err
+		}
+		return response.Data, nil
+	case <-time.After(streamRequestTimeout):
+		err = errors.New("Timed out waiting for peer response.")
+		s.disconnect(conn, err)
+		return nil, err
+	}
+}
+
+// Sends a single message to the given receiver over a short-lived connection, leaving the current connection in
+// place.
+func (s *StreamClient) probe(receiverAddr string, msg []byte) ([]byte, error) {
+	prefix := s.network + "://"
+	if !strings.HasPrefix(receiverAddr, prefix) {
+		return nil, errors.New(fmt.Sprintf("Peer address %s does not start with %s", receiverAddr, prefix))
+	}
+	conn, err := net.DialTimeout(s.network, strings.TrimPrefix(receiverAddr, prefix), p2pProbeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p2pProbeTimeout))
+	if err = protocol.WriteFrame(conn, protocol.Frame{Type: protocol.FrameP2p, ID: 1, Data: msg}); err != nil {
+		return nil, err
+	}
+	response, err := protocol.ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err = response.Err(); err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// Returns the connection to the given upstream peer, replacing the current connection if it leads elsewhere.
+func (s *StreamClient) getConnection(upstreamDestAddr string) (net.Conn, error) {
+	s.mu.Lock()
+	conn := s.conn
+	connAddr := s.connAddr
+	s.mu.Unlock()
+	if conn != nil {
+		if connAddr == upstreamDestAddr {
+			return conn, nil
+		}
+		s.disconnect(conn, errors.New("upstream peer changed"))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn, nil
+	}
+	prefix := s.network + "://"
+	if !strings.HasPrefix(upstreamDestAddr, prefix) {
+		return nil, errors.New(fmt.Sprintf("Peer address %s does not start with %s", upstreamDestAddr, prefix))
+	}
+	conn, err := net.DialTimeout(s.network, strings.TrimPrefix(upstreamDestAddr, prefix), streamDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	s.connAddr = upstreamDestAddr
+	go s.receive(conn)
+	return conn, nil
+}
+
+// Reads response frames until the connection fails, dispatching them to waiting requests.
+func (s *StreamClient) receive(conn net.Conn) {
+	for {
+		frame, err := protocol.ReadFrame(conn)
+		if err != nil {
+			s.disconnect(conn, err)
+			return
+		}
+		s.mu.Lock()
+		responseChan, ok := s.pending[frame.ID]
+		delete(s.pending, frame.ID)
+		s.mu.Unlock()
+		if ok {
+			responseChan <- frame
+		}
+	}
+}
+
+// Closes the given connection if it is still the current one and fails any requests waiting on it.
+func (s *StreamClient) disconnect(conn net.Conn, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	output.VerbosePrint(fmt.Sprintf("[!] Connection to peer %s lost: %s", s.connAddr, err.Error()))
+	s.conn.Close()
+	s.conn = nil
+	for id, responseChan := range s.pending {
+		close(responseChan)
+		delete(s.pending, id)
+	}
+}
+
+func (s *StreamClient) closeConnection() {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		s.disconnect(conn, errors.New("connection reset"))
+	}
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Upstream contact of a receiver under test. Records the profiles relayed to it and answers beacons with the
+// profile's paw.
+type testUpstream struct {
+	mu      sync.Mutex
+	beacons []protocol.Profile
+	results []protocol.Result
+	uploads map[string][]byte
+	hold    chan struct{} // if set, beacons wait until it is closed
+	failing bool          // if set, beacons fail as if C2 were unreachable
+}
+
+func (u *testUpstream) GetBeaconBytes(profile protocol.Profile) []byte {
+	u.mu.Lock()
+	u.beacons = append(u.beacons, profile)
+	hold, failing := u.hold, u.failing
+	u.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	if failing {
+		return nil
+	}
+	return []byte(`{"paw": "` + profile.Paw + `"}`)
+}
+
+func (u *testUpstream) GetPayloadBytes(profile protocol.Profile, payload string) ([]byte, string) {
+	return []byte("payload " + payload), payload
+}
+
+func (u *testUpstream) C2RequirementsMet(profile protocol.Profile, c2Config map[string]string) (bool, map[string]string) {
+	return true, nil
+}
+
+func (u *testUpstream) SendExecutionResults(profile protocol.Profile, result protocol.Result) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.results = append(u.results, result)
+}
+
+func (u *testUpstream) GetName() string {
+	return "test"
+}
+
+func (u *testUpstream) SetUpstreamDestAddr(upstreamDestAddr string) {}
+
+func (u *testUpstream) UploadFileBytes(profile protocol.Profile, uploadName string, data []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.uploads == nil {
+		u.uploads = make(map[string][]byte)
+	}
+	u.uploads[uploadName] = data
+	return nil
+}
+
+func (u *testUpstream) getBeacons() []protocol.Profile {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]protocol.Profile(nil), u.beacons...)
+}
+
+// Waits until the upstream contact received the given number of beacons.
+func (u *testUpstream) requireBeacons(t *testing.T, count int) []protocol.Profile {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if beacons := u.getBeacons(); len(beacons) >= count {
+			return beacons
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("upstream received %d beacons, expected %d", len(u.getBeacons()), count)
+	return nil
+}
+
+// Starts a stream receiver on a local TCP port that relays through the given upstream contact.
+func startTestStreamReceiver(t *testing.T, upstream contact.Contact, quota peerQuota) *streamReceiver {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := newStreamReceiver("TCP", "tcp", &upstream, listener, quota)
+	receiver.UpdateAgentPaw("receiverpaw")
+	go receiver.serve()
+	return receiver
+}
+
+// Sends a sealed beacon request from the given paw over the connection and returns the response frame.
+func exchangeTestBeaconFrame(conn net.Conn, id uint32, paw string) (protocol.Frame, error) {
+	profile, err := json.Marshal(protocol.Profile{Paw: paw})
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	key, _, _ := getGroupKeys()
+	data, err := buildP2pMsgBytes(paw, GET_INSTRUCTIONS, profile, "", key)
+	if err != nil {
+		return protocol.Frame{}, err
+	}
+	if err = protocol.WriteFrame(conn, protocol.Frame{Type: protocol.FrameP2p, ID: id, Data: data}); err != nil {
+		return protocol.Frame{}, err
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return protocol.ReadFrame(conn)
+}
+
+func sendTestBeaconFrame(t *testing.T, conn net.Conn, id uint32, paw string) protocol.Frame {
+	response, err := exchangeTestBeaconFrame(conn, id, paw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func dialTestReceiver(t *testing.T, receiver *streamReceiver) net.Conn {
+	conn, err := net.Dial("tcp", receiver.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Returns true if the receiver closes the connection without answering.
+func isClosedByReceiver(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := protocol.ReadFrame(conn)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestStreamReceiverAppliesRequestQuotaAcrossConnections(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver := startTestStreamReceiver(t, upstream, peerQuota{maxRequestsPerMinute: 1})
+	defer receiver.close()
+
+	first := dialTestReceiver(t, receiver)
+	defer first.Close()
+	if response := sendTestBeaconFrame(t, first, 1, "peerpaw"); response.Err() != nil {
+		t.Fatalf("first request rejected: %s", response.Err())
+	}
+	// A new connection from the same host shares the quota.
+	second := dialTestReceiver(t, receiver)
+	defer second.Close()
+	response := sendTestBeaconFrame(t, second, 1, "peerpaw")
+	if response.Err() == nil || !strings.Contains(response.Err().Error(), "quota exceeded") {
+		t.Errorf("request over the quota on a new connection not rejected: %v", response.Err())
+	}
+}
+
+func TestStreamReceiverAppliesInFlightQuotaAcrossConnections(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{hold: make(chan struct{})}
+	receiver := startTestStreamReceiver(t, upstream, peerQuota{maxInFlight: 1})
+	defer receiver.close()
+
+	first := dialTestReceiver(t, receiver)
+	defer first.Close()
+	held := make(chan error, 1)
+	go func() {
+		response, err := exchangeTestBeaconFrame(first, 1, "peerpaw")
+		if err == nil {
+			err = response.Err()
+		}
+		held <- err
+	}()
+	upstream.requireBeacons(t, 1)
+
+	second := dialTestReceiver(t, receiver)
+	defer second.Close()
+	if response := sendTestBeaconFrame(t, second, 1, "peerpaw"); response.Err() == nil {
+		t.Error("concurrent request over the quota on a new connection not rejected")
+	}
+	close(upstream.hold)
+	if err := <-held; err != nil {
+		t.Errorf("held request failed: %s", err.Error())
+	}
+}
+
+func TestStreamReceiverLimitsConnectionsPerPeer(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	receiver := startTestStreamReceiver(t, &testUpstream{}, peerQuota{maxConnections: 1})
+	defer receiver.close()
+
+	first := dialTestReceiver(t, receiver)
+	defer first.Close()
+	if response := sendTestBeaconFrame(t, first, 1, "peerpaw"); response.Err() != nil {
+		t.Fatalf("first connection rejected: %s", response.Err())
+	}
+	second := dialTestReceiver(t, receiver)
+	defer second.Close()
+	if !isClosedByReceiver(second) {
+		t.Error("connection over the limit not closed")
+	}
+
+	// The peer can connect again once its connection closed.
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(receiver.GetPeerStats()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third := dialTestReceiver(t, receiver)
+	defer third.Close()
+	if response := sendTestBeaconFrame(t, third, 1, "peerpaw"); response.Err() != nil {
+		t.Errorf("reconnection rejected: %s", response.Err())
+	}
+}
+
+func TestStreamReceiverRejectsOversizedFramesBeforeReadingThem(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver := startTestStreamReceiver(t, upstream, peerQuota{maxFrameSize: 1024})
+	defer receiver.close()
+
+	conn := dialTestReceiver(t, receiver)
+	defer conn.Close()
+	// Only the length prefix of a 1 MiB frame is sent.
+	if _, err := conn.Write([]byte{0, 0x10, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosedByReceiver(conn) {
+		t.Error("connection announcing an oversized frame not closed")
+	}
+	if beacons := upstream.getBeacons(); len(beacons) > 0 {
+		t.Errorf("oversized frame relayed: %v", beacons)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/output"
+)
+
+// Port and per-peer quotas for the TCP proxy receiver. Can be overridden during linking. A quota of 0 disables
+// the corresponding limit. The frame size limit also bounds the files that peers can upload through the receiver.
+var (
+	tcpReceiverPort             = "61890"
+	tcpPeerMaxInFlight          = "32"
+	tcpPeerMaxRequestsPerMinute = "600"
+	tcpPeerMaxConnections       = "4"
+	tcpPeerMaxFrameSize         = "16777216"
+)
+
+// TcpReceiver accepts many downstream peers on a single TCP listener. Each peer keeps one connection open and
+// multiplexes its concurrent P2pMessage exchanges over it by frame ID, subject to per-peer quotas that apply across
+// all connections from the peer's host.
+type TcpReceiver struct {
+	*streamReceiver
+	waitgroup *sync.WaitGroup
+	urlList   []string
+}
+
+func init() {
+	P2pReceiverChannels["TCP"] = &TcpReceiver{}
+	P2pClientChannels["TCP"] = newStreamClient("TCP", "tcp")
+}
+
+func (t *TcpReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	quota := peerQuota{
+		maxInFlight:          parseQuota("tcpPeerMaxInFlight", tcpPeerMaxInFlight),
+		maxRequestsPerMinute: parseQuota("tcpPeerMaxRequestsPerMinute", tcpPeerMaxRequestsPerMinute),
+		maxConnections:       parseQuota("tcpPeerMaxConnections", tcpPeerMaxConnections),
+		maxFrameSize:         parseQuota("tcpPeerMaxFrameSize", tcpPeerMaxFrameSize),
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", tcpReceiverPort))
+	if err != nil {
+		return err
+	}
+	urlList, err := getReceiverURLs("tcp", listener.Addr())
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	t.streamReceiver = newStreamReceiver("TCP", "tcp", upstreamComs, listener, quota)
+	t.waitgroup = waitgroup
+	t.urlList = urlList
+	return nil
+}
+
+func (t *TcpReceiver) RunReceiver() {
+	defer t.waitgroup.Done()
+	t.serve()
+}
+
+func (t *TcpReceiver) Terminate() {
+	t.close()
+}
+
+func (t *TcpReceiver) GetReceiverAddresses() []string {
+	return t.urlList
+}
+
+func parseQuota(name string, value string) int {
+	quota, err := strconv.Atoi(value)
+	if err != nil || quota < 0 {
+		output.VerbosePrint(fmt.Sprintf("[-] Invalid %s value %s, disabling the limit", name, value))
+		return 0
+	}
+	return quota
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Starts a TCP receiver on a free local port with the given per-minute request quota, and returns it along with its
+// loopback address.
+func startTestTcpReceiver(t *testing.T, upstream contact.Contact, maxRequestsPerMinute string) (*TcpReceiver, string) {
+	savedPort, savedQuota := tcpReceiverPort, tcpPeerMaxRequestsPerMinute
+	tcpReceiverPort, tcpPeerMaxRequestsPerMinute = "0", maxRequestsPerMinute
+	defer func() { tcpReceiverPort, tcpPeerMaxRequestsPerMinute = savedPort, savedQuota }()
+
+	receiver := &TcpReceiver{}
+	if err := receiver.InitializeReceiver(nil, &upstream, &sync.WaitGroup{}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("receiverpaw")
+	receiver.waitgroup.Add(1)
+	go receiver.RunReceiver()
+	_, port, err := net.SplitHostPort(receiver.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receiver, fmt.Sprintf("tcp://127.0.0.1:%s", port)
+}
+
+func TestTcpClientRelaysThroughReceiver(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestTcpReceiver(t, upstream, "0")
+	defer receiver.Terminate()
+	client := newTestStreamClient("TCP", "tcp", receiverAddr)
+	defer client.closeConnection()
+	profile := protocol.Profile{Paw: "peerpaw"}
+
+	if beacon := client.GetBeaconBytes(profile); string(beacon) != `{"paw": "peerpaw"}` {
+		t.Errorf("unexpected beacon response: %s", beacon)
+	}
+	if payload, name := client.GetPayloadBytes(profile, "payload.sh"); string(payload) != "payload payload.sh" || name != "payload.sh" {
+		t.Errorf("unexpected payload %q named %q", payload, name)
+	}
+	if err := client.UploadFileBytes(profile, "upload.txt", []byte("upload")); err != nil {
+		t.Errorf("upload failed: %s", err.Error())
+	}
+	stats := receiver.GetPeerStats()
+	if len(stats) != 1 || stats[0].Paw != "peerpaw" || stats[0].Requests != 3 || stats[0].Errors != 0 {
+		t.Errorf("unexpected peer stats: %v", stats)
+	}
+	hop := upstream.requireBeacons(t, 1)[0].ProxyChain[0]
+	if hop[0] != "receiverpaw" || hop[1] != receiverAddr || hop[2] != "TCP" {
+		t.Errorf("unexpected proxy hop: %v", hop)
+	}
+}
+
+func TestTcpClientRejectedOverQuota(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{}
+	receiver, receiverAddr := startTestTcpReceiver(t, upstream, "1")
+	defer receiver.Terminate()
+	client := newTestStreamClient("TCP", "tcp", receiverAddr)
+	defer client.closeConnection()
+
+	if beacon := client.GetBeaconBytes(protocol.Profile{Paw: "peerpaw"}); beacon == nil {
+		t.Fatal("beacon within the quota failed")
+	}
+	if err := client.UploadFileBytes(protocol.Profile{Paw: "peerpaw"}, "upload.txt", []byte("upload")); err == nil {
+		t.Error("upload over the quota succeeded")
+	}
+	if stats := receiver.GetPeerStats(); len(stats) != 1 || stats[0].Rejected != 1 {
+		t.Errorf("rejection not recorded: %v", stats)
+	}
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	if len(upstream.uploads) > 0 {
+		t.Errorf("upload over the quota relayed: %v", upstream.uploads)
+	}
+}
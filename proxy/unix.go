@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+)
+
+// Path of the Unix domain socket for the proxy receiver. Can be overridden during linking, e.g. to place the socket
+// on a mount shared with other containers. Defaults to a socket named after the agent's PID in the temp directory.
+var unixReceiverPath = ""
+
+// UnixReceiver relays P2pMessage requests from peers that share a filesystem with this agent over a Unix domain
+// socket, without opening any network ports. Its addresses take the form unix:///path/to/socket.
+type UnixReceiver struct {
+	*streamReceiver
+	waitgroup *sync.WaitGroup
+	addresses []string
+}
+
+func init() {
+	P2pReceiverChannels["Unix"] = &UnixReceiver{}
+	P2pClientChannels["Unix"] = newStreamClient("Unix", "unix")
+}
+
+func (u *UnixReceiver) InitializeReceiver(agentServer *string, upstreamComs *contact.Contact, waitgroup *sync.WaitGroup) error {
+	path := unixReceiverPath
+	if len(path) == 0 {
+		path = filepath.Join(os.TempDir(), fmt.Sprintf("sandcat-%d.sock", os.Getpid()))
+	}
+	removeStaleSocket(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	address := fmt.Sprintf("unix://%s", path)
+	u.streamReceiver = newStreamReceiver("Unix", "unix", upstreamComs, listener, peerQuota{})
+	u.waitgroup = waitgroup
+	u.addresses = []string{address}
+	return nil
+}
+
+func (u *UnixReceiver) RunReceiver() {
+	defer u.waitgroup.Done()
+	u.serve()
+}
+
+// Closing the listener also removes the socket file.
+func (u *UnixReceiver) Terminate() {
+	u.close()
+}
+
+func (u *UnixReceiver) GetReceiverAddresses() []string {
+	return u.addresses
+}
+
+// Removes a socket file left behind by an agent that did not shut down cleanly. Sockets that still accept
+// connections are left alone.
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return
+	}
+	os.Remove(path)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/protocol"
+)
+
+// Starts a Unix receiver on a socket in a temp directory that relays through the given upstream contact. The
+// returned function stops the receiver and removes the directory.
+func startTestUnixReceiver(t *testing.T, upstream contact.Contact) (*UnixReceiver, func()) {
+	dir, err := ioutil.TempDir("", "sandcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedPath := unixReceiverPath
+	unixReceiverPath = filepath.Join(dir, "receiver.sock")
+	defer func() { unixReceiverPath = savedPath }()
+
+	receiver := &UnixReceiver{}
+	var waitgroup sync.WaitGroup
+	if err = receiver.InitializeReceiver(nil, &upstream, &waitgroup); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	receiver.UpdateAgentPaw("receiverpaw")
+	waitgroup.Add(1)
+	go receiver.RunReceiver()
+	return receiver, func() {
+		receiver.Terminate()
+		waitgroup.Wait()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestStreamClient(name string, network string, upstreamDestAddr string) *StreamClient {
+	client := newStreamClient(name, network)
+	client.C2RequirementsMet(protocol.Profile{}, nil)
+	client.SetUpstreamDestAddr(upstreamDestAddr)
+	return client
+}
+
+func TestUnixReceiverMultiplexesStreamClientRequests(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	upstream := &testUpstream{hold: make(chan struct{})}
+	receiver, stop := startTestUnixReceiver(t, upstream)
+	defer stop()
+	receiverAddr := receiver.GetReceiverAddresses()[0]
+	client := newTestStreamClient("Unix", "unix", receiverAddr)
+	defer client.closeConnection()
+
+	// All requests reach the upstream contact while the first ones are still waiting for C2.
+	responses := make(chan string, 4)
+	for i := 0; i < 4; i++ {
+		go func(paw string) {
+			responses <- string(client.GetBeaconBytes(protocol.Profile{Paw: paw}))
+		}(fmt.Sprintf("peerpaw-%d", i))
+	}
+	beacons := upstream.requireBeacons(t, 4)
+	close(upstream.hold)
+	for i := 0; i < 4; i++ {
+		if response := <-responses; !strings.HasPrefix(response, `{"paw": "peerpaw-`) {
+			t.Errorf("unexpected beacon response: %s", response)
+		}
+	}
+	if stats := receiver.GetPeerStats(); len(stats) != 1 || stats[0].Requests != 4 {
+		t.Errorf("requests not multiplexed over a single connection: %v", stats)
+	}
+	for _, beacon := range beacons {
+		hop := beacon.ProxyChain[0]
+		if hop[0] != "receiverpaw" || hop[1] != receiverAddr || hop[2] != "Unix" {
+			t.Errorf("unexpected proxy hop: %v", hop)
+		}
+	}
+}
+
+func TestStreamClientFailsOnRefusedLoops(t *testing.T) {
+	defer setTestGroupKeys("test key", "", time.Time{})()
+	receiver, stop := startTestUnixReceiver(t, &testUpstream{})
+	defer stop()
+	client := newTestStreamClient("Unix", "unix", receiver.GetReceiverAddresses()[0])
+	defer client.closeConnection()
+
+	if beacon := client.GetBeaconBytes(protocol.Profile{Paw: "receiverpaw"}); beacon != nil {
+		t.Errorf("looping beacon answered: %s", beacon)
+	}
+	// The refusal does not cost the client its connection.
+	if beacon := client.GetBeaconBytes(protocol.Profile{Paw: "peerpaw"}); string(beacon) != `{"paw": "peerpaw"}` {
+		t.Errorf("unexpected beacon response after a refused loop: %s", beacon)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandcat-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "receiver.sock")
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeStaleSocket(path)
+	if _, err = os.Lstat(path); err != nil {
+		t.Errorf("live socket removed: %s", err.Error())
+	}
+	// Simulate an agent that exited without removing its socket.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	removeStaleSocket(path)
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("stale socket not removed: %v", err)
+	}
+}
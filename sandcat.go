@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
-	"github.com/mitre/gocat/contact"
+	"github.com/mitre/gocat/config"
 	"github.com/mitre/gocat/core"
+	"github.com/mitre/gocat/proxy"
 )
 
 /*
@@ -23,39 +27,147 @@ var (
 	c2Key     = ""
 	listenP2P = "false" // need to set as string to allow ldflags -X build-time variable change on server-side.
 	httpProxyGateway = ""
+	beaconEncoders = "base64"
+	fileEncoders = "plain-text"
+	tlsStrict = "false" // need to set as string to allow ldflags -X build-time variable change on server-side.
+	tlsPins = ""
+	tlsCaCert = "" // base64-encoded PEM bundle
+	tlsClientCert = "" // base64-encoded PEM certificate
+	tlsClientKey = "" // base64-encoded PEM private key
+	dnsDomain = ""
+	killDate = "" // RFC 3339 time after which the agent exits, e.g. 2026-12-31T18:00:00Z
+	maxRuntime = "" // duration after which the agent exits, e.g. 72h
 )
 
 func main() {
-	parsedListenP2P, err := strconv.ParseBool(listenP2P)
+	agentConfig, err := getLinkedConfig()
 	if err != nil {
-		parsedListenP2P = false
+		fmt.Println(fmt.Sprintf("[!] Error loading embedded config: %s", err.Error()))
+		return
 	}
-	server := flag.String("server", server, "The FQDN of the server")
-	httpProxyUrl :=  flag.String("httpProxyGateway", httpProxyGateway, "URL for the HTTP proxy gateway. For environments that use proxies to reach the internet.")
-	paw := flag.String("paw", paw, "Optionally specify a PAW on initialization")
-	group := flag.String("group", group, "Attach a group to this agent")
-	c2Protocol := flag.String("c2", c2Name, "C2 Channel for agent")
-	delay := flag.Int("delay", 0, "Delay starting this agent by n-seconds")
+	contacts := agentConfig.Contacts
+	parsedTlsStrict, err := strconv.ParseBool(contacts["tlsStrict"])
+	if err != nil {
+		parsedTlsStrict = false
+	}
+	flag.String("server", agentConfig.Servers[0].Address, "The FQDN of the server")
+	flag.String("servers", "", "Comma-separated C2 servers in order of preference, each as address[|contact[|proxy]]. The agent fails over to the next server after repeated beacon failures. Overrides -server.")
+	flag.String("httpProxyGateway", contacts["httpProxyGateway"], "URL for the HTTP proxy gateway. For environments that use proxies to reach the internet.")
+	flag.String("paw", agentConfig.Paw, "Optionally specify a PAW on initialization")
+	flag.String("group", agentConfig.Group, "Attach a group to this agent")
+	flag.String("c2", contacts["c2Name"], "C2 Channel for agent")
+	flag.Int("delay", agentConfig.Delay, "Delay starting this agent by n-seconds")
+	flag.Int("sleep", agentConfig.Sleep, "Seconds between beacons until the server sets a sleep, and after a failed beacon.")
+	flag.Int("jitter", agentConfig.Jitter, "Percentage by which sleeps are randomly varied in either direction.")
+	flag.Int("maxSleep", agentConfig.MaxSleep, "Cap in seconds on the exponential backoff after consecutive failed beacons.")
+	flag.String("schedule", agentConfig.Schedule, "Times at which the agent beacons, as [days] HH:MM-HH:MM [timezone], e.g. \"Mon-Fri 08:00-18:00 Europe/Berlin\". The agent stays quiet outside them.")
+	flag.String("killDate", agentConfig.KillDate, "RFC 3339 time after which the agent runs its deadman instructions and exits, e.g. 2026-12-31T18:00:00Z.")
+	flag.String("maxRuntime", agentConfig.MaxRuntime, "Duration after which the agent runs its deadman instructions and exits, e.g. 72h.")
+	flag.Int("maxJobs", agentConfig.MaxJobs, "Maximum number of instructions that run at the same time. Defaults to 8.")
+	flag.Int("jobQueueSize", agentConfig.JobQueueSize, "Maximum number of instructions waiting for a free job slot. Further instructions are rejected. Defaults to 256.")
+	flag.String("allowedHosts", strings.Join(agentConfig.Scope.AllowedHosts, ","), "Comma-separated hostnames (with * wildcards), IPs or CIDRs of the hosts the agent may run instructions on.")
+	flag.String("blockedCommands", strings.Join(agentConfig.Scope.BlockedCommands, ","), "Comma-separated regular expressions of commands the agent refuses to run. Use a config file for patterns that contain commas.")
+	flag.String("blockedPaths", strings.Join(agentConfig.Scope.BlockedPaths, ","), "Comma-separated paths (with * wildcards) that the agent refuses to upload or delete, including everything below them.")
 	verbose := flag.Bool("v", false, "Enable verbose output")
-	listenP2P := flag.Bool("listenP2P", parsedListenP2P, "Enable peer-to-peer receivers")
-	originLinkID := flag.String("originLinkID", "", "Optionally set originating link ID")
-	tunnelProtocol := flag.String("tunnelProtocol", "", "C2 comms tunnel type to use.")
-	tunnelAddr := flag.String("tunnelAddr", "", "Address used to connect to or start the tunnel.")
-	tunnelUsername := flag.String("tunnelUser", "", "Username used to authenticate to the tunnel.")
-	tunnelPassword := flag.String("tunnelPassword", "", "Password used to authenticate to the tunnel.")
+	flag.Bool("listenP2P", agentConfig.ListenP2P, "Enable peer-to-peer receivers")
+	flag.String("originLinkID", agentConfig.OriginLinkID, "Optionally set originating link ID")
+	flag.String("tunnelProtocol", agentConfig.Tunnel.Protocol, "C2 comms tunnel type to use.")
+	flag.String("tunnelAddr", agentConfig.Tunnel.Addr, "Address used to connect to or start the tunnel.")
+	flag.String("tunnelUser", agentConfig.Tunnel.Username, "Username used to authenticate to the tunnel.")
+	flag.String("tunnelPassword", agentConfig.Tunnel.Password, "Password used to authenticate to the tunnel.")
+	flag.String("beaconEncoders", contacts["beaconEncoders"], "Comma-separated data encoders applied to beacons and results.")
+	flag.String("fileEncoders", contacts["fileEncoders"], "Comma-separated data encoders applied to payload downloads and file uploads.")
+	flag.Bool("tlsStrict", parsedTlsStrict, "Verify the C2 server's TLS certificate chain and hostname.")
+	flag.String("tlsPins", contacts["tlsPins"], "Comma-separated SHA-256 SPKI pins (sha256/BASE64) trusted for the C2 server.")
+	flag.String("tlsCaFile", contacts["tlsCaFile"], "Path to a PEM bundle of CA certificates trusted for the C2 server.")
+	flag.String("tlsClientCertFile", contacts["tlsClientCertFile"], "Path to a PEM client certificate for mutual TLS.")
+	flag.String("tlsClientKeyFile", contacts["tlsClientKeyFile"], "Path to the PEM private key for the mutual TLS client certificate.")
+	flag.String("dnsDomain", contacts["dnsDomain"], "Domain the C2 server is authoritative for, used by the DNS contact.")
+	flag.String("tcpAddr", contacts["tcpAddr"], "Address (host or host:port) of the C2 server's TCP listener, used by the TCP contact. Defaults to the server's host on port 7020.")
+	flag.String("udpAddr", contacts["udpAddr"], "Address (host or host:port) of the C2 server's UDP listener, used by the UDP contact. Defaults to the server's host on port 7021.")
+	flag.String("udpMtu", contacts["udpMtu"], "Maximum datagram size in bytes used by the UDP contact.")
+	flag.String("udpWindow", contacts["udpWindow"], "Maximum number of unacknowledged datagrams in flight for the UDP contact.")
+	flag.String("dnsServer", contacts["dnsServer"], "DNS server (host or host:port) queried by the DNS contact. Defaults to the system resolver.")
+	configFile := flag.String("config", os.Getenv("SANDCAT_CONFIG"), "Path to a JSON or YAML (.yaml, .yml) config file. SANDCAT_* environment variables and command-line flags take precedence over it.")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration and exit.")
 
 	flag.Parse()
 
-	trimmedServer := strings.TrimRight(*server, "/")
-	tunnelConfig, err := contact.BuildTunnelConfig(*tunnelProtocol, *tunnelAddr, trimmedServer, *tunnelUsername, *tunnelPassword)
-	if err != nil && *verbose {
-		fmt.Println(fmt.Sprintf("[!] Error building tunnel config: %s", err.Error()))
+	if err = applyRuntimeConfig(agentConfig, *configFile); err != nil {
+		fmt.Println(fmt.Sprintf("[!] %s", err.Error()))
+		return
+	}
+	if *printConfig {
+		printed, _ := json.MarshalIndent(agentConfig.Redacted(), "", "  ")
+		fmt.Println(string(printed))
 		return
 	}
-	contactConfig := map[string]string{
-		"c2Name": *c2Protocol,
-		"c2Key": c2Key,
-		"httpProxyGateway": *httpProxyUrl,
+	core.Core(agentConfig, *verbose)
+}
+
+// Applies the config file, then SANDCAT_* environment variables, then the command-line flags that were given.
+func applyRuntimeConfig(agentConfig *config.Config, configFile string) error {
+	if len(configFile) > 0 {
+		fileConfig, err := config.LoadFile(configFile)
+		if err != nil {
+			return err
+		}
+		agentConfig.Merge(fileConfig)
+	}
+	if err := agentConfig.ApplyEnvironment(); err != nil {
+		return err
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil && f.Name != "v" && f.Name != "config" && f.Name != "print-config" {
+			err = agentConfig.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// Returns the configuration made of the linked default values, overridden by the embedded configuration blob if
+// there is one.
+func getLinkedConfig() (*config.Config, error) {
+	parsedListenP2P, err := strconv.ParseBool(listenP2P)
+	if err != nil {
+		parsedListenP2P = false
+	}
+	agentConfig := &config.Config{
+		Servers:    []config.Server{{Address: strings.TrimRight(server, "/")}},
+		Group:      group,
+		Paw:        paw,
+		ListenP2P:  parsedListenP2P,
+		KillDate:   killDate,
+		MaxRuntime: maxRuntime,
+		Contacts: map[string]string{
+			"c2Name":           c2Name,
+			"c2Key":            c2Key,
+			"httpProxyGateway": httpProxyGateway,
+			"beaconEncoders":   beaconEncoders,
+			"fileEncoders":     fileEncoders,
+			"tlsStrict":        tlsStrict,
+			"tlsPins":          tlsPins,
+			"tlsCaCert":        tlsCaCert,
+			"tlsClientCert":    tlsClientCert,
+			"tlsClientKey":     tlsClientKey,
+			"dnsDomain":        dnsDomain,
+		},
+	}
+	// Older servers link in the peer receivers to connect to instead of embedding them in the configuration.
+	legacyPeers, err := proxy.GetAvailablePeerReceivers()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid encodedReceivers linked in: %s", err.Error()))
+	}
+	if len(legacyPeers) > 0 {
+		agentConfig.Peers = legacyPeers
+	}
+	embeddedConfig, err := config.Embedded()
+	if err != nil {
+		return nil, err
+	}
+	if embeddedConfig != nil {
+		agentConfig.Merge(embeddedConfig)
 	}
-	core.Core(trimmedServer, tunnelConfig, *group, *delay, contactConfig, *listenP2P, *verbose, *paw, *originLinkID)
+	return agentConfig, nil
 }